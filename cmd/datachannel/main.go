@@ -4,10 +4,11 @@ import (
 	"bufio"
 	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"log"
-	"net/url"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
@@ -16,14 +17,18 @@ import (
 	"github.com/HMasataka/conic/internal/transport"
 	webrtcinternal "github.com/HMasataka/conic/internal/webrtc"
 	"github.com/HMasataka/conic/logging"
-	"github.com/gorilla/websocket"
 	"github.com/pion/webrtc/v4"
 	"github.com/rs/xid"
 )
 
 var (
-	addr = flag.String("addr", "localhost:3000", "http service address")
-	role = flag.String("role", "offer", "role: offer, answer")
+	addr   = flag.String("addr", "localhost:3000", "http service address")
+	role   = flag.String("role", "offer", "role: offer, answer")
+	peerID = flag.String("id", "", "client ID to register as (random when empty)")
+	token  = flag.String("token", "", "authentication token for the signal server")
+	useTLS = flag.Bool("tls", false, "connect to the signal server with wss://")
+	caFile = flag.String("ca", "", "PEM file with CA certificates to trust for wss:// in addition to the system roots")
+	codec  = flag.String("codec", "json", "wire codec: json or msgpack")
 )
 
 func main() {
@@ -34,17 +39,34 @@ func main() {
 		Format: "text",
 	})
 
-	id := xid.New().String()
+	id := *peerID
+	if id == "" {
+		id = xid.New().String()
+	}
 	logger.Info("Creating peer connection", "id", id)
 
-	u := url.URL{
-		Scheme: "ws",
-		Host:   *addr,
-		Path:   "/ws",
+	dialOptions := transport.DefaultDialOptions()
+	if *caFile != "" {
+		pool, err := transport.LoadCertPool(*caFile)
+		if err != nil {
+			logger.Error("Failed to load CA certificates", "error", err)
+			return
+		}
+		dialOptions.RootCAs = pool
 	}
 
-	logger.Info("Connecting to WebSocket", "url", u.String())
-	conn, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	switch *codec {
+	case "json":
+	case "msgpack":
+		dialOptions.Subprotocols = []string{transport.MessagePackSubprotocol}
+	default:
+		logger.Error("Unknown codec", "codec", *codec)
+		return
+	}
+
+	serverURL := transport.ServerURL(*addr, *useTLS)
+	logger.Info("Connecting to WebSocket", "url", serverURL)
+	conn, err := transport.Dial(context.Background(), serverURL, dialOptions)
 	if err != nil {
 		logger.Error("Failed to connect to WebSocket", "error", err)
 		return
@@ -66,9 +88,6 @@ func main() {
 
 	logger.Info("Client started", "id", client.ID())
 
-	// Wait for WebSocket connection to be fully established
-	time.Sleep(100 * time.Millisecond)
-
 	// Register with server
 	if err := registerToServer(pc, client, logger); err != nil {
 		logger.Error("Failed to register with server", "error", err)
@@ -85,45 +104,80 @@ func main() {
 	}
 }
 
-// registerToServer sends registration message to the server
+// registerToServer registers with the server and waits for its response
 func registerToServer(pc *webrtcinternal.PeerConnection, client *transport.Client, logger *logging.Logger) error {
-	regReq := domain.RegisterRequest{
+	regMsg, err := domain.NewMessage(domain.MessageTypeRegisterRequest, domain.RegisterRequest{
 		ClientID: pc.ID(),
+		Token:    *token,
+	})
+	if err != nil {
+		return err
 	}
 
-	regData, err := json.Marshal(regReq)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	capabilities, err := client.Hello(ctx, domain.Features()...)
 	if err != nil {
 		return err
 	}
+	logger.Debug("Protocol negotiated", "version", capabilities.Version, "features", capabilities.Features)
 
-	regMsg := domain.Message{
-		ID:        xid.New().String(),
-		Type:      domain.MessageTypeRegisterRequest,
-		Timestamp: time.Now(),
-		Data:      regData,
+	response, err := client.Request(ctx, regMsg)
+	if err != nil {
+		return err
 	}
 
-	regMsgData, err := json.Marshal(regMsg)
-	if err != nil {
+	var regResp domain.RegisterResponse
+	if err := json.Unmarshal(response.Data, &regResp); err != nil {
 		return err
 	}
 
-	ctx := context.Background()
-	if err := client.Send(ctx, regMsgData); err != nil {
-		logger.Error("Failed to send registration message, continuing anyway", "error", err)
-		return nil // Don't fail completely, just warn
+	if !regResp.Success {
+		return errors.New("registration rejected by server: " + regResp.Error)
 	}
 
-	logger.Info("Registration message sent", "id", pc.ID())
+	logger.Info("Registered with server", "id", regResp.ClientID)
 	return nil
 }
 
+// listPeers asks the server for the other online clients
+func listPeers(client *transport.Client) ([]string, error) {
+	msg, err := domain.NewMessage(domain.MessageTypeListPeersRequest, domain.ListPeersRequest{})
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	response, err := client.Request(ctx, msg)
+	if err != nil {
+		return nil, err
+	}
+
+	var list domain.ListPeersResponse
+	if err := json.Unmarshal(response.Data, &list); err != nil {
+		return nil, err
+	}
+
+	return list.Peers, nil
+}
+
 func runOfferMode(pc *webrtcinternal.PeerConnection, client *transport.Client, logging *logging.Logger) {
 	logging.Info("Running in offer mode")
 
 	var targetID string
 
-	log.Println("Enter target peer ID to create offer:")
+	peers, err := listPeers(client)
+	if err != nil {
+		logging.Warn("Failed to list peers", "error", err)
+	}
+	for i, peer := range peers {
+		log.Printf("  [%d] %s", i+1, peer)
+	}
+
+	log.Println("Enter target peer ID (or number) to create offer:")
 	scanner := bufio.NewScanner(os.Stdin)
 	for scanner.Scan() {
 		input := strings.TrimSpace(scanner.Text())
@@ -132,6 +186,9 @@ func runOfferMode(pc *webrtcinternal.PeerConnection, client *transport.Client, l
 		}
 
 		targetID = input
+		if n, err := strconv.Atoi(input); err == nil && n >= 1 && n <= len(peers) {
+			targetID = peers[n-1]
+		}
 		break
 	}
 
@@ -191,6 +248,8 @@ func runOfferMode(pc *webrtcinternal.PeerConnection, client *transport.Client, l
 	req := domain.Message{
 		ID:        xid.New().String(),
 		Type:      domain.MessageTypeSDP,
+		FromID:    pc.ID(),
+		ToID:      targetID,
 		Timestamp: time.Now(),
 		Data:      data,
 	}
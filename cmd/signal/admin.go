@@ -0,0 +1,168 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/HMasataka/conic/domain"
+	"github.com/HMasataka/conic/logging"
+	"github.com/HMasataka/conic/signal"
+	"github.com/go-chi/chi/v5"
+)
+
+// clientInfo is a client as listed by the admin API. Clients on other nodes
+// have no stats.
+type clientInfo struct {
+	ID    string   `json:"id"`
+	Rooms []string `json:"rooms"`
+	*domain.ClientStats
+}
+
+type admin struct {
+	hub      domain.Hub
+	sessions *signal.Sessions
+	logger   *logging.Logger
+}
+
+// newAdminRouter serves the admin API to requests bearing token
+func newAdminRouter(hub domain.Hub, sessions *signal.Sessions, token string, logger *logging.Logger) chi.Router {
+	a := &admin{
+		hub:      hub,
+		sessions: sessions,
+		logger:   logger,
+	}
+
+	r := chi.NewRouter()
+	r.Use(requireToken(token))
+
+	r.Get("/stats", a.stats)
+	r.Get("/clients", a.clients)
+	r.Delete("/clients/{clientID}", a.kick)
+	r.Post("/notice", a.notice)
+
+	return r
+}
+
+// requireToken rejects requests without the bearer token
+func requireToken(token string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			presented, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(presented), []byte(token)) != 1 {
+				writeError(w, domain.NewError(domain.ErrorCodeUnauthorized, "admin token required"))
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func (a *admin) stats(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, a.hub.GetStats())
+}
+
+func (a *admin) clients(w http.ResponseWriter, r *http.Request) {
+	clients := a.hub.GetClients()
+	slices.SortFunc(clients, func(x, y domain.Client) int {
+		return strings.Compare(x.ID(), y.ID())
+	})
+
+	infos := make([]clientInfo, 0, len(clients))
+	for _, client := range clients {
+		info := clientInfo{
+			ID:    client.ID(),
+			Rooms: a.hub.GetClientRooms(client.ID()),
+		}
+		if reporter, ok := client.(domain.StatsReporter); ok {
+			stats := reporter.Stats()
+			info.ClientStats = &stats
+		}
+		infos = append(infos, info)
+	}
+
+	writeJSON(w, http.StatusOK, infos)
+}
+
+func (a *admin) kick(w http.ResponseWriter, r *http.Request) {
+	clientID := chi.URLParam(r, "clientID")
+
+	reason := r.URL.Query().Get("reason")
+	if reason == "" {
+		reason = "kicked by administrator"
+	}
+
+	if err := a.sessions.Kick(clientID, reason); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	a.logger.Info("admin kicked client", "client_id", clientID, "remote_addr", r.RemoteAddr)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *admin) notice(w http.ResponseWriter, r *http.Request) {
+	var notice domain.Notice
+	if err := json.NewDecoder(r.Body).Decode(&notice); err != nil || notice.Text == "" {
+		writeError(w, domain.NewError(domain.ErrorCodeInvalidMessage, "notice text is required"))
+		return
+	}
+
+	msg, err := domain.NewMessage(domain.MessageTypeNotice, notice)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	data, err := json.Marshal(msg)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	var recipients []string
+	for _, client := range a.hub.GetClients() {
+		if domain.ClientSupports(client, domain.FeatureNotice) {
+			recipients = append(recipients, client.ID())
+		}
+	}
+
+	if err := a.hub.SendToMultiple(recipients, data); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	a.logger.Info("admin broadcast notice", "text", notice.Text, "remote_addr", r.RemoteAddr)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeError writes err in the shape of an error message payload
+func writeError(w http.ResponseWriter, err error) {
+	domainErr := domain.ErrorFrom(err)
+
+	status := http.StatusInternalServerError
+	switch domainErr.Code {
+	case domain.ErrorCodeInvalidMessage:
+		status = http.StatusBadRequest
+	case domain.ErrorCodeUnauthorized:
+		status = http.StatusUnauthorized
+	case domain.ErrorCodeNotFound:
+		status = http.StatusNotFound
+	case domain.ErrorCodeUnavailable:
+		status = http.StatusServiceUnavailable
+	}
+
+	writeJSON(w, status, domain.ErrorMessage{
+		Code:    domainErr.Code,
+		Message: domainErr.Message,
+		Fields:  domainErr.Fields,
+	})
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/HMasataka/conic/domain"
+	"github.com/HMasataka/conic/hub"
+	"github.com/HMasataka/conic/internal/config"
+	"github.com/HMasataka/conic/internal/transport"
+	"github.com/HMasataka/conic/logging"
+	"github.com/HMasataka/conic/signal"
+)
+
+// envPrefix prefixes the environment variables that override the config file
+const envPrefix = "CONIC"
+
+// Config is the configuration of the signal server. Values are taken from
+// the defaults, then the config file, then CONIC_* environment variables,
+// then flags given on the command line.
+type Config struct {
+	Server     ServerConfig       `json:"server"`
+	Log        logging.Config     `json:"log"`
+	Connection ConnectionConfig   `json:"connection"`
+	Auth       AuthConfig         `json:"auth"`
+	Limits     LimitsConfig       `json:"limits"`
+	Session    SessionConfig      `json:"session"`
+	Cluster    ClusterConfig      `json:"cluster"`
+	ICEServers []domain.ICEServer `json:"ice_servers"`
+}
+
+type ServerConfig struct {
+	Addr            string          `json:"addr"`
+	ShutdownTimeout config.Duration `json:"shutdown_timeout"`
+	ReconnectWindow config.Duration `json:"reconnect_window"`
+	TLS             TLSConfig       `json:"tls"`
+
+	// AdminToken enables the admin API. Like the other secrets it is read
+	// from the config file or the environment only, so that it does not show
+	// up in the process list.
+	AdminToken string `json:"admin_token"`
+
+	// PublicMetrics serves /metrics without the admin token, for scrapers
+	// on a trusted network. Otherwise /metrics needs the admin token and is
+	// not served without one.
+	PublicMetrics bool `json:"public_metrics"`
+
+	AllowedOrigins     []string `json:"allowed_origins"`
+	Subprotocols       []string `json:"subprotocols"`
+	RequireSubprotocol bool     `json:"require_subprotocol"`
+
+	// RequireHello refuses clients that register without agreeing on a
+	// protocol version first
+	RequireHello bool `json:"require_hello"`
+}
+
+// TLSConfig serves wss:// and https:// when a certificate and key are set.
+// The files are checked for changes every ReloadInterval.
+type TLSConfig struct {
+	CertFile       string          `json:"cert_file"`
+	KeyFile        string          `json:"key_file"`
+	ReloadInterval config.Duration `json:"reload_interval"`
+}
+
+func (c TLSConfig) Enabled() bool {
+	return c.CertFile != "" || c.KeyFile != ""
+}
+
+type ConnectionConfig struct {
+	WriteTimeout    config.Duration `json:"write_timeout"`
+	ReadTimeout     config.Duration `json:"read_timeout"`
+	PingInterval    config.Duration `json:"ping_interval"`
+	MaxMessageSize  int64           `json:"max_message_size"`
+	ReadBufferSize  int             `json:"read_buffer_size"`
+	WriteBufferSize int             `json:"write_buffer_size"`
+
+	// Compression enables permessage-deflate for peers that offer it
+	Compression bool `json:"compression"`
+
+	// HandlerTimeout bounds how long handling a message may take, and
+	// HandlerTimeouts overrides it per message type
+	HandlerTimeout  config.Duration            `json:"handler_timeout"`
+	HandlerTimeouts map[string]config.Duration `json:"handler_timeouts"`
+}
+
+type AuthConfig struct {
+	// Secret is read from the config file or the environment only
+	Secret      string `json:"secret"`
+	PolicyRules string `json:"policy_rules"`
+}
+
+type LimitsConfig struct {
+	Rate           float64                    `json:"rate"`
+	Burst          int                        `json:"burst"`
+	ThrottleAction string                     `json:"throttle_action"`
+	Types          map[string]RateLimitConfig `json:"types"`
+
+	// ClientQueue is how many messages may wait for each client before it
+	// is a slow consumer, and SlowConsumer what happens to it then
+	ClientQueue  int             `json:"client_queue"`
+	SendTimeout  config.Duration `json:"send_timeout"`
+	SlowConsumer string          `json:"slow_consumer"`
+}
+
+type RateLimitConfig struct {
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst"`
+}
+
+type SessionConfig struct {
+	Presence    string          `json:"presence"`
+	ResumeGrace config.Duration `json:"resume_grace"`
+	MailboxTTL  config.Duration `json:"mailbox_ttl"`
+}
+
+type ClusterConfig struct {
+	NodeID          string `json:"node_id"`
+	Backplane       string `json:"backplane"`
+	BackplaneListen string `json:"backplane_listen"`
+
+	// BackplaneSecret is shared by the broker and the nodes. It is read from
+	// the config file or the environment only, never from a flag.
+	BackplaneSecret string `json:"backplane_secret"`
+}
+
+func DefaultConfig() Config {
+	connectionOptions := transport.DefaultConnectionOptions()
+	serverOptions := signal.DefaultServerOptions()
+	routerOptions := signal.DefaultRouterOptions()
+
+	return Config{
+		Server: ServerConfig{
+			Addr:            ":3000",
+			ShutdownTimeout: config.Duration(30 * time.Second),
+			ReconnectWindow: config.Duration(5 * time.Second),
+			TLS: TLSConfig{
+				ReloadInterval: config.Duration(time.Minute),
+			},
+		},
+		Log: logging.Config{
+			Level:  "info",
+			Format: "text",
+		},
+		Connection: ConnectionConfig{
+			WriteTimeout:    config.Duration(connectionOptions.WriteTimeout),
+			ReadTimeout:     config.Duration(connectionOptions.ReadTimeout),
+			PingInterval:    config.Duration(connectionOptions.PingInterval),
+			MaxMessageSize:  connectionOptions.MaxMessageSize,
+			ReadBufferSize:  connectionOptions.ReadBufferSize,
+			WriteBufferSize: connectionOptions.WriteBufferSize,
+			HandlerTimeout:  config.Duration(routerOptions.HandlerTimeout),
+		},
+		Limits: LimitsConfig{
+			Rate:           serverOptions.RateLimit.Rate,
+			Burst:          serverOptions.RateLimit.Burst,
+			ThrottleAction: string(serverOptions.ThrottleAction),
+			ClientQueue:    256,
+			SendTimeout:    config.Duration(5 * time.Second),
+			SlowConsumer:   string(hub.SlowConsumerEvict),
+		},
+		Session: SessionConfig{
+			Presence: string(signal.PresenceGlobal),
+		},
+	}
+}
+
+var configPath = flag.String("config", "", "JSON or YAML config file, reloaded on SIGHUP")
+var addr = flag.String("addr", ":3000", "http service address")
+var tlsCert = flag.String("tls-cert", "", "PEM certificate file to serve TLS with, reloaded when it changes")
+var tlsKey = flag.String("tls-key", "", "PEM private key file for -tls-cert")
+var allowedOrigins = flag.String("allowed-origins", "", "comma separated origins browsers may connect from, such as https://*.example.com (same origin only when empty, * for any)")
+var logLevel = flag.String("log-level", "info", "log level: debug, info, warn or error")
+var rateLimit = flag.Float64("rate-limit", 50, "messages per second each connection may send (0 disables the limit)")
+var rateBurst = flag.Int("rate-burst", 100, "messages a connection may send in a burst")
+var throttleAction = flag.String("throttle-action", string(transport.ThrottleError), "what to do with messages over the rate limit: drop, error or disconnect")
+var presence = flag.String("presence", string(signal.PresenceGlobal), "who clients see come and go: global or room")
+var nodeID = flag.String("node-id", "", "ID of this node on the backplane (random when empty)")
+var backplaneAddr = flag.String("backplane", "", "address of the backplane broker to share clients with other nodes")
+var backplaneListen = flag.String("backplane-listen", "", "run a backplane broker on this address")
+var mailboxTTL = flag.Duration("mailbox-ttl", 0, "how long messages for clients that have not registered yet are held (0 drops them)")
+var resumeGrace = flag.Duration("resume-grace", 0, "how long clients whose connection dropped may resume their session (0 disables resumption)")
+var shutdownTimeout = flag.Duration("shutdown-timeout", 30*time.Second, "how long to wait for connections to close on SIGTERM or SIGINT")
+var reconnectWindow = flag.Duration("reconnect-window", 5*time.Second, "clients are told to reconnect after a random delay of up to this long on shutdown")
+var policyRules = flag.String("policy-rules", "", "JSON file with authorization rules (every client may message every other when empty)")
+
+// loadConfig builds the configuration from the defaults, the -config file,
+// the environment and the flags set on the command line
+func loadConfig() (Config, error) {
+	cfg := DefaultConfig()
+
+	if *configPath != "" {
+		if err := config.LoadFile(*configPath, &cfg); err != nil {
+			return Config{}, err
+		}
+	}
+
+	if err := config.ApplyEnv(envPrefix, &cfg); err != nil {
+		return Config{}, err
+	}
+
+	cfg.applyFlags()
+
+	if err := cfg.Validate(); err != nil {
+		return Config{}, err
+	}
+
+	return cfg, nil
+}
+
+// applyFlags overrides the configuration with the flags given on the command
+// line. Flags left at their defaults do not override the file or environment.
+func (c *Config) applyFlags() {
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "addr":
+			c.Server.Addr = *addr
+		case "tls-cert":
+			c.Server.TLS.CertFile = *tlsCert
+		case "tls-key":
+			c.Server.TLS.KeyFile = *tlsKey
+		case "allowed-origins":
+			c.Server.AllowedOrigins = nil
+			for origin := range strings.SplitSeq(*allowedOrigins, ",") {
+				if origin = strings.TrimSpace(origin); origin != "" {
+					c.Server.AllowedOrigins = append(c.Server.AllowedOrigins, origin)
+				}
+			}
+		case "log-level":
+			c.Log.Level = *logLevel
+		case "rate-limit":
+			c.Limits.Rate = *rateLimit
+		case "rate-burst":
+			c.Limits.Burst = *rateBurst
+		case "throttle-action":
+			c.Limits.ThrottleAction = *throttleAction
+		case "presence":
+			c.Session.Presence = *presence
+		case "node-id":
+			c.Cluster.NodeID = *nodeID
+		case "backplane":
+			c.Cluster.Backplane = *backplaneAddr
+		case "backplane-listen":
+			c.Cluster.BackplaneListen = *backplaneListen
+		case "mailbox-ttl":
+			c.Session.MailboxTTL = config.Duration(*mailboxTTL)
+		case "resume-grace":
+			c.Session.ResumeGrace = config.Duration(*resumeGrace)
+		case "shutdown-timeout":
+			c.Server.ShutdownTimeout = config.Duration(*shutdownTimeout)
+		case "reconnect-window":
+			c.Server.ReconnectWindow = config.Duration(*reconnectWindow)
+		case "policy-rules":
+			c.Auth.PolicyRules = *policyRules
+		}
+	})
+}
+
+// Validate reports every invalid value in the configuration
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	check(c.Server.Addr != "", "server.addr is required")
+	check(c.Server.ShutdownTimeout > 0, "server.shutdown_timeout must be positive")
+	check(c.Server.ReconnectWindow >= 0, "server.reconnect_window must not be negative")
+	if c.Server.TLS.Enabled() {
+		check(c.Server.TLS.CertFile != "" && c.Server.TLS.KeyFile != "", "server.tls.cert_file and server.tls.key_file must be set together")
+		check(c.Server.TLS.ReloadInterval > 0, "server.tls.reload_interval must be positive")
+	}
+
+	for _, origin := range c.Server.AllowedOrigins {
+		check(signal.ValidOriginPattern(origin), "server.allowed_origins %q is not an origin such as https://example.com or https://*.example.com", origin)
+	}
+	check(!c.Server.RequireSubprotocol || len(c.Server.Subprotocols) > 0, "server.require_subprotocol needs server.subprotocols")
+
+	check(logging.ValidLevel(c.Log.Level), "log.level %q is not one of debug, info, warn or error", c.Log.Level)
+	switch strings.ToLower(c.Log.Format) {
+	case "", "text", "json":
+	default:
+		check(false, "log.format %q is not one of text or json", c.Log.Format)
+	}
+
+	check(c.Connection.WriteTimeout > 0, "connection.write_timeout must be positive")
+	check(c.Connection.ReadTimeout > 0, "connection.read_timeout must be positive")
+	check(c.Connection.PingInterval > 0 && c.Connection.PingInterval < c.Connection.ReadTimeout,
+		"connection.ping_interval must be positive and shorter than connection.read_timeout")
+	check(c.Connection.MaxMessageSize > 0, "connection.max_message_size must be positive")
+	check(c.Connection.ReadBufferSize >= 0, "connection.read_buffer_size must not be negative")
+	check(c.Connection.WriteBufferSize >= 0, "connection.write_buffer_size must not be negative")
+	check(c.Connection.HandlerTimeout >= 0, "connection.handler_timeout must not be negative")
+	for messageType, timeout := range c.Connection.HandlerTimeouts {
+		check(timeout >= 0, "connection.handler_timeouts.%s must not be negative", messageType)
+	}
+
+	errs = append(errs, validateRateLimit("limits", RateLimitConfig{Rate: c.Limits.Rate, Burst: c.Limits.Burst})...)
+	for messageType, limit := range c.Limits.Types {
+		errs = append(errs, validateRateLimit("limits.types."+messageType, limit)...)
+	}
+	switch transport.ThrottleAction(c.Limits.ThrottleAction) {
+	case transport.ThrottleDrop, transport.ThrottleError, transport.ThrottleDisconnect:
+	default:
+		check(false, "limits.throttle_action %q is not one of drop, error or disconnect", c.Limits.ThrottleAction)
+	}
+
+	check(c.Limits.ClientQueue > 0, "limits.client_queue must be positive")
+	check(c.Limits.SendTimeout > 0, "limits.send_timeout must be positive")
+	switch hub.SlowConsumerAction(c.Limits.SlowConsumer) {
+	case hub.SlowConsumerEvict, hub.SlowConsumerDrop:
+	default:
+		check(false, "limits.slow_consumer %q is not one of evict or drop", c.Limits.SlowConsumer)
+	}
+
+	switch signal.PresenceScope(c.Session.Presence) {
+	case signal.PresenceGlobal, signal.PresenceRoom:
+	default:
+		check(false, "session.presence %q is not one of global or room", c.Session.Presence)
+	}
+	check(c.Session.ResumeGrace >= 0, "session.resume_grace must not be negative")
+	check(c.Session.MailboxTTL >= 0, "session.mailbox_ttl must not be negative")
+
+	for i, server := range c.ICEServers {
+		check(len(server.URLs) > 0, "ice_servers[%d].urls is required", i)
+		for _, url := range server.URLs {
+			scheme, _, _ := strings.Cut(url, ":")
+			switch scheme {
+			case "stun", "stuns":
+			case "turn", "turns":
+				check(server.Username != "" && server.Credential != "", "ice_servers[%d] needs a username and credential for %s", i, url)
+			default:
+				check(false, "ice_servers[%d].urls %q is not a stun, stuns, turn or turns URL", i, url)
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func validateRateLimit(name string, limit RateLimitConfig) []error {
+	var errs []error
+	if limit.Rate < 0 {
+		errs = append(errs, fmt.Errorf("%s.rate must not be negative", name))
+	}
+	if limit.Rate > 0 && limit.Burst < 1 {
+		errs = append(errs, fmt.Errorf("%s.burst must be at least 1 when %s.rate is set", name, name))
+	}
+	return errs
+}
+
+func (c *Config) connectionOptions(options transport.ConnectionOptions) transport.ConnectionOptions {
+	options.WriteTimeout = time.Duration(c.Connection.WriteTimeout)
+	options.ReadTimeout = time.Duration(c.Connection.ReadTimeout)
+	options.PingInterval = time.Duration(c.Connection.PingInterval)
+	options.MaxMessageSize = c.Connection.MaxMessageSize
+	options.ReadBufferSize = c.Connection.ReadBufferSize
+	options.WriteBufferSize = c.Connection.WriteBufferSize
+	options.EnableCompression = c.Connection.Compression
+	options.RateLimit, options.TypeRateLimits, options.ThrottleAction = c.rateLimits()
+	return options
+}
+
+// handlerTimeouts returns the handler timeout and the per-type overrides
+func (c *Config) handlerTimeouts() (time.Duration, map[domain.MessageType]time.Duration) {
+	timeouts := make(map[domain.MessageType]time.Duration, len(c.Connection.HandlerTimeouts))
+	for messageType, timeout := range c.Connection.HandlerTimeouts {
+		timeouts[domain.MessageType(messageType)] = time.Duration(timeout)
+	}
+	return time.Duration(c.Connection.HandlerTimeout), timeouts
+}
+
+func (c *Config) rateLimits() (transport.RateLimit, map[domain.MessageType]transport.RateLimit, transport.ThrottleAction) {
+	var typeLimits map[domain.MessageType]transport.RateLimit
+	if len(c.Limits.Types) > 0 {
+		typeLimits = make(map[domain.MessageType]transport.RateLimit, len(c.Limits.Types))
+		for messageType, limit := range c.Limits.Types {
+			typeLimits[domain.MessageType(messageType)] = transport.RateLimit{Rate: limit.Rate, Burst: limit.Burst}
+		}
+	}
+
+	limit := transport.RateLimit{Rate: c.Limits.Rate, Burst: c.Limits.Burst}
+	return limit, typeLimits, transport.ThrottleAction(c.Limits.ThrottleAction)
+}
@@ -2,45 +2,245 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"flag"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	ossignal "os/signal"
+	"syscall"
+	"time"
 
 	"github.com/HMasataka/conic/hub"
+	"github.com/HMasataka/conic/internal/transport"
 	"github.com/HMasataka/conic/logging"
 	"github.com/HMasataka/conic/signal"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
-	"github.com/gorilla/websocket"
 )
 
-var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool {
-		return true
-	},
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
+// redactingLogFormatter logs requests without the token query parameter
+// browsers authenticate websocket upgrades with
+type redactingLogFormatter struct {
+	middleware.LogFormatter
+}
+
+func (f redactingLogFormatter) NewLogEntry(r *http.Request) middleware.LogEntry {
+	return f.LogFormatter.NewLogEntry(signal.RedactToken(r))
 }
 
 func main() {
+	flag.Parse()
+
+	cfg, err := loadConfig()
+	if err != nil {
+		log.Fatalf("invalid configuration: %v", err)
+	}
+
 	r := chi.NewRouter()
-	r.Use(middleware.Logger)
+	r.Use(middleware.RequestLogger(redactingLogFormatter{
+		LogFormatter: &middleware.DefaultLogFormatter{Logger: log.New(os.Stdout, "", log.LstdFlags)},
+	}))
 
-	logger := logging.New(logging.Config{
-		Level:  "info",
-		Format: "text",
-	})
+	logger := logging.New(cfg.Log)
 
 	ctx := context.Background()
 
-	hub := hub.New(logger)
-	go hub.Start(ctx)
+	if cfg.Cluster.BackplaneListen != "" {
+		listener, err := net.Listen("tcp", cfg.Cluster.BackplaneListen)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		broker := hub.NewBackplaneBrokerWithOptions(hub.BackplaneBrokerOptions{
+			Logger: logger,
+			Secret: cfg.Cluster.BackplaneSecret,
+		})
+		go broker.Serve(listener)
+		defer broker.Close()
+	}
+
+	hubOptions := hub.HubOptions{
+		Logger:          logger,
+		NodeID:          cfg.Cluster.NodeID,
+		ClientQueueSize: cfg.Limits.ClientQueue,
+		SendTimeout:     time.Duration(cfg.Limits.SendTimeout),
+		SlowConsumer:    hub.SlowConsumerAction(cfg.Limits.SlowConsumer),
+	}
+	if cfg.Session.MailboxTTL > 0 {
+		hubOptions.Mailbox = hub.DefaultMailboxOptions()
+		hubOptions.Mailbox.TTL = time.Duration(cfg.Session.MailboxTTL)
+	}
+	if cfg.Cluster.Backplane != "" {
+		backplaneOptions := hub.DefaultTCPBackplaneOptions()
+		backplaneOptions.Logger = logger
+		backplaneOptions.Secret = cfg.Cluster.BackplaneSecret
+		hubOptions.Backplane = hub.NewTCPBackplaneWithOptions(cfg.Cluster.Backplane, backplaneOptions)
+	}
+
+	hub := hub.NewWithOptions(hubOptions)
+	if err := hub.Start(ctx); err != nil {
+		log.Fatal(err)
+	}
+
+	metrics := signal.NewMetrics(hub)
 
-	router := signal.NewRouter(hub, logger)
-	server := signal.NewServer(router, logger, signal.DefaultServerOptions())
+	routerOptions := signal.DefaultRouterOptions()
+	routerOptions.ICEServers = cfg.ICEServers
+	routerOptions.RequireHello = cfg.Server.RequireHello
+	routerOptions.HandlerTimeout, routerOptions.HandlerTimeouts = cfg.handlerTimeouts()
+	routerOptions.Metrics = metrics
+
+	sessionOptions := signal.DefaultSessionOptions()
+	sessionOptions.Presence = signal.PresenceScope(cfg.Session.Presence)
+	sessionOptions.ResumeGrace = time.Duration(cfg.Session.ResumeGrace)
+	sessionOptions.Metrics = metrics
+	sessions := signal.NewSessions(hub, logger, sessionOptions)
+	routerOptions.Sessions = sessions
+
+	serverOptions := signal.DefaultServerOptions()
+	serverOptions.ConnectionOptions = cfg.connectionOptions(serverOptions.ConnectionOptions)
+	serverOptions.AllowedOrigins = cfg.Server.AllowedOrigins
+	serverOptions.Subprotocols = cfg.Server.Subprotocols
+	serverOptions.RequireSubprotocol = cfg.Server.RequireSubprotocol
+	serverOptions.OnThrottled = hub.RecordThrottled
+
+	serverOptions.Metrics = metrics
+
+	if cfg.Auth.Secret != "" {
+		authenticator := signal.NewHMACAuthenticator([]byte(cfg.Auth.Secret))
+		routerOptions.Authenticator = authenticator
+		serverOptions.Authenticator = authenticator
+	}
+
+	if cfg.Auth.PolicyRules != "" {
+		rules, err := loadRules(cfg.Auth.PolicyRules)
+		if err != nil {
+			log.Fatal(err)
+		}
+		routerOptions.Policy = signal.NewRulePolicy(hub, rules...)
+	}
+
+	router := signal.NewRouter(hub, logger, routerOptions)
+	server, err := signal.NewServer(router, logger, serverOptions)
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	r.Get("/ws", server.Handle)
 
-	if err := http.ListenAndServe(":3000", r); err != nil {
-		log.Println(err)
+	switch {
+	case cfg.Server.PublicMetrics:
+		r.Method(http.MethodGet, "/metrics", metrics)
+	case cfg.Server.AdminToken != "":
+		r.With(requireToken(cfg.Server.AdminToken)).Method(http.MethodGet, "/metrics", metrics)
+	}
+
+	if cfg.Server.AdminToken != "" {
+		r.Mount("/admin", newAdminRouter(hub, sessions, cfg.Server.AdminToken, logger))
+	}
+
+	httpServer := &http.Server{
+		Addr:    cfg.Server.Addr,
+		Handler: r,
+	}
+
+	shutdown, stop := ossignal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	var certificates *transport.CertificateReloader
+	if cfg.Server.TLS.Enabled() {
+		certificates, err = transport.NewCertificateReloader(cfg.Server.TLS.CertFile, cfg.Server.TLS.KeyFile, logger)
+		if err != nil {
+			log.Fatal(err)
+		}
+		httpServer.TLSConfig = certificates.TLSConfig()
+		go certificates.Watch(shutdown, time.Duration(cfg.Server.TLS.ReloadInterval))
+	}
+
+	go func() {
+		var err error
+		if certificates != nil {
+			err = httpServer.ListenAndServeTLS("", "")
+		} else {
+			err = httpServer.ListenAndServe()
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
+
+	logger.Info("listening", "addr", cfg.Server.Addr, "tls", certificates != nil)
+
+	reload := make(chan os.Signal, 1)
+	ossignal.Notify(reload, syscall.SIGHUP)
+	defer ossignal.Stop(reload)
+
+	for done := false; !done; {
+		select {
+		case <-reload:
+			reloadConfig(logger, server, certificates)
+		case <-shutdown.Done():
+			done = true
+		}
+	}
+	stop()
+
+	shutdownTimeout := time.Duration(cfg.Server.ShutdownTimeout)
+	logger.Info("shutting down", "timeout", shutdownTimeout)
+
+	drainCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	// Stop accepting connections first. Websockets are hijacked, so the HTTP
+	// server does not wait for them.
+	if err := httpServer.Shutdown(drainCtx); err != nil {
+		logger.Error("failed to shut down http server", "error", err)
+	}
+
+	if err := server.Shutdown(drainCtx, "server shutting down", time.Duration(cfg.Server.ReconnectWindow)); err != nil {
+		logger.Error("connections did not drain", "error", err)
+	}
+
+	if err := hub.Stop(); err != nil {
+		logger.Error("failed to stop hub", "error", err)
+	}
+}
+
+// reloadConfig applies the log level and rate limits of the reloaded
+// configuration and reloads the TLS certificate. Other settings take effect
+// on restart. An invalid configuration is ignored.
+func reloadConfig(logger *logging.Logger, server *signal.Server, certificates *transport.CertificateReloader) {
+	if certificates != nil {
+		if err := certificates.Reload(); err != nil {
+			logger.Error("failed to reload certificate", "error", err)
+		}
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		logger.Error("failed to reload configuration", "error", err)
+		return
+	}
+
+	logger.SetLevel(cfg.Log.Level)
+	server.SetRateLimits(cfg.rateLimits())
+
+	logger.Info("configuration reloaded", "log_level", cfg.Log.Level)
+}
+
+func loadRules(path string) ([]signal.Rule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
 	}
+
+	var rules []signal.Rule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, err
+	}
+
+	return rules, nil
 }
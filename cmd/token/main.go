@@ -0,0 +1,44 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/HMasataka/conic/signal"
+)
+
+// secretEnv names the environment variable holding the HMAC secret shared
+// with the signal server. It is not a flag so that it stays out of the
+// process list.
+const secretEnv = "CONIC_AUTH_SECRET"
+
+var (
+	clientID = flag.String("id", "", "client ID the token allows")
+	tenant   = flag.String("tenant", "", "tenant the client belongs to (optional)")
+	ttl      = flag.Duration("ttl", 24*time.Hour, "token lifetime")
+)
+
+func main() {
+	flag.Parse()
+
+	secret := os.Getenv(secretEnv)
+	if secret == "" || *clientID == "" {
+		log.Fatal("both " + secretEnv + " and -id are required")
+	}
+
+	authenticator := signal.NewHMACAuthenticator([]byte(secret))
+
+	token, err := authenticator.Issue(signal.Identity{
+		ClientID:  *clientID,
+		Tenant:    *tenant,
+		ExpiresAt: time.Now().Add(*ttl),
+	})
+	if err != nil {
+		log.Fatal("issue token:", err)
+	}
+
+	fmt.Println(token)
+}
@@ -4,10 +4,10 @@ import (
 	"bufio"
 	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
-	"net/url"
 	"os"
 	"strings"
 	"time"
@@ -17,15 +17,19 @@ import (
 	"github.com/HMasataka/conic/internal/transport"
 	webrtcinternal "github.com/HMasataka/conic/internal/webrtc"
 	"github.com/HMasataka/conic/logging"
-	"github.com/gorilla/websocket"
 	"github.com/pion/webrtc/v4"
 	"github.com/pion/webrtc/v4/pkg/media"
 	"github.com/rs/xid"
 )
 
 var (
-	addr = flag.String("addr", "localhost:3000", "http service address")
-	role = flag.String("role", "offer", "role: offer, answer")
+	addr   = flag.String("addr", "localhost:3000", "http service address")
+	role   = flag.String("role", "offer", "role: offer, answer")
+	peerID = flag.String("id", "", "client ID to register as (random when empty)")
+	token  = flag.String("token", "", "authentication token for the signal server")
+	useTLS = flag.Bool("tls", false, "connect to the signal server with wss://")
+	caFile = flag.String("ca", "", "PEM file with CA certificates to trust for wss:// in addition to the system roots")
+	codec  = flag.String("codec", "json", "wire codec: json or msgpack")
 )
 
 func main() {
@@ -36,17 +40,34 @@ func main() {
 		Format: "text",
 	})
 
-	id := xid.New().String()
+	id := *peerID
+	if id == "" {
+		id = xid.New().String()
+	}
 	logger.Info("Creating peer connection with VP8 video support", "id", id)
 
-	u := url.URL{
-		Scheme: "ws",
-		Host:   *addr,
-		Path:   "/ws",
+	dialOptions := transport.DefaultDialOptions()
+	if *caFile != "" {
+		pool, err := transport.LoadCertPool(*caFile)
+		if err != nil {
+			logger.Error("Failed to load CA certificates", "error", err)
+			return
+		}
+		dialOptions.RootCAs = pool
 	}
 
-	logger.Info("Connecting to WebSocket", "url", u.String())
-	conn, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	switch *codec {
+	case "json":
+	case "msgpack":
+		dialOptions.Subprotocols = []string{transport.MessagePackSubprotocol}
+	default:
+		logger.Error("Unknown codec", "codec", *codec)
+		return
+	}
+
+	serverURL := transport.ServerURL(*addr, *useTLS)
+	logger.Info("Connecting to WebSocket", "url", serverURL)
+	conn, err := transport.Dial(context.Background(), serverURL, dialOptions)
 	if err != nil {
 		logger.Error("Failed to connect to WebSocket", "error", err)
 		return
@@ -68,9 +89,6 @@ func main() {
 
 	logger.Info("Client started", "id", client.ID())
 
-	// Wait for WebSocket connection to be fully established
-	time.Sleep(500 * time.Millisecond)
-
 	// Register with server
 	if err := registerToServer(pc, client, logger); err != nil {
 		logger.Error("Failed to register with server", "error", err)
@@ -87,36 +105,40 @@ func main() {
 	}
 }
 
-// registerToServer sends registration message to the server
+// registerToServer registers with the server and waits for its response
 func registerToServer(pc *webrtcinternal.PeerConnection, client *transport.Client, logger *logging.Logger) error {
-	regReq := domain.RegisterRequest{
+	regMsg, err := domain.NewMessage(domain.MessageTypeRegisterRequest, domain.RegisterRequest{
 		ClientID: pc.ID(),
+		Token:    *token,
+	})
+	if err != nil {
+		return err
 	}
 
-	regData, err := json.Marshal(regReq)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	capabilities, err := client.Hello(ctx, domain.Features()...)
 	if err != nil {
 		return err
 	}
+	logger.Debug("Protocol negotiated", "version", capabilities.Version, "features", capabilities.Features)
 
-	regMsg := domain.Message{
-		ID:        xid.New().String(),
-		Type:      domain.MessageTypeRegisterRequest,
-		Timestamp: time.Now(),
-		Data:      regData,
+	response, err := client.Request(ctx, regMsg)
+	if err != nil {
+		return err
 	}
 
-	regMsgData, err := json.Marshal(regMsg)
-	if err != nil {
+	var regResp domain.RegisterResponse
+	if err := json.Unmarshal(response.Data, &regResp); err != nil {
 		return err
 	}
 
-	ctx := context.Background()
-	if err := client.Send(ctx, regMsgData); err != nil {
-		logger.Error("Failed to send registration message, continuing anyway", "error", err)
-		return nil // Don't fail completely, just warn
+	if !regResp.Success {
+		return errors.New("registration rejected by server: " + regResp.Error)
 	}
 
-	logger.Info("Registration message sent", "id", pc.ID())
+	logger.Info("Registered with server", "id", regResp.ClientID)
 	return nil
 }
 
@@ -188,6 +210,8 @@ func runOfferMode(pc *webrtcinternal.PeerConnection, client *transport.Client, l
 	req := domain.Message{
 		ID:        xid.New().String(),
 		Type:      domain.MessageTypeSDP,
+		FromID:    pc.ID(),
+		ToID:      targetID,
 		Timestamp: time.Now(),
 		Data:      data,
 	}
@@ -3,57 +3,102 @@ package domain
 import (
 	"context"
 	"errors"
-
-	"github.com/gorilla/websocket"
+	"sync"
+	"time"
 )
 
-type client struct {
-	id   string
-	conn *websocket.Conn
+// ErrClientBusy is returned by Client.Send when the client cannot take
+// another message right now. The hub retries such clients until its send
+// timeout passes.
+var ErrClientBusy = errors.New("client send queue is full")
+
+type Client interface {
+	ID() string
+
+	Send(ctx context.Context, message []byte) error
+
+	Close() error
 }
 
-func NewClient(id string, conn *websocket.Conn) Client {
-	return &client{
-		id:   id,
-		conn: conn,
-	}
+// ClientStats describes the activity of a connected client
+type ClientStats struct {
+	ConnectedAt      time.Time `json:"connected_at"`
+	MessagesReceived int64     `json:"messages_received"`
+	MessagesSent     int64     `json:"messages_sent"`
 }
 
-func (c *client) ID() string {
-	return c.id
+// StatsReporter is implemented by clients that track their activity
+type StatsReporter interface {
+	Stats() ClientStats
 }
 
-func (c *client) Send(ctx context.Context, message []byte) error {
-	if c.conn == nil {
-		return errors.New("connection is closed")
-	}
+// FeatureSupporter is implemented by clients that know which protocol
+// features their peer agreed on
+type FeatureSupporter interface {
+	Supports(feature Feature) bool
+}
 
-	err := c.conn.WriteMessage(websocket.TextMessage, message)
-	if err != nil {
-		return err
+// ClientSupports reports whether client supports feature. Clients that do
+// not know are assumed to support everything.
+func ClientSupports(client Client, feature Feature) bool {
+	if supporter, ok := client.(FeatureSupporter); ok {
+		return supporter.Supports(feature)
 	}
+	return true
+}
+
+// PreparedMessage is a message sent to many clients at once. Transports
+// cache the frames they build for it, so that a broadcast is framed and
+// compressed once per wire format instead of once per recipient.
+type PreparedMessage struct {
+	data []byte
 
-	return nil
+	mu     sync.Mutex
+	frames map[string]any
 }
 
-func (c *client) Close() error {
-	if c.conn == nil {
-		return errors.New("connection is closed")
+func NewPreparedMessage(data []byte) *PreparedMessage {
+	return &PreparedMessage{data: data}
+}
+
+// Data returns the JSON message
+func (m *PreparedMessage) Data() []byte {
+	return m.data
+}
+
+// Frame returns the frame cached under key, calling build to create it from
+// the message the first time. Failed builds are not cached.
+func (m *PreparedMessage) Frame(key string, build func(data []byte) (any, error)) (any, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if frame, ok := m.frames[key]; ok {
+		return frame, nil
 	}
 
-	err := c.conn.Close()
+	frame, err := build(m.data)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	c.conn = nil
-	return nil
+	if m.frames == nil {
+		m.frames = make(map[string]any)
+	}
+	m.frames[key] = frame
+	return frame, nil
 }
 
-type Client interface {
-	ID() string
-
-	Send(ctx context.Context, message []byte) error
+// PreparedSender is implemented by clients that can send a PreparedMessage
+// without framing it again
+type PreparedSender interface {
+	SendPrepared(ctx context.Context, message *PreparedMessage) error
+}
 
-	Close() error
+// SendPrepared sends message to client, as a plain message when the client
+// cannot send prepared ones
+func SendPrepared(ctx context.Context, client Client, message *PreparedMessage) error {
+	if sender, ok := client.(PreparedSender); ok {
+		return sender.SendPrepared(ctx, message)
+	}
+	return client.Send(ctx, message.Data())
 }
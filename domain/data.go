@@ -5,6 +5,7 @@ import (
 	"time"
 
 	"github.com/pion/webrtc/v4"
+	"github.com/rs/xid"
 )
 
 // MessageType represents the type of signaling message
@@ -18,28 +19,182 @@ const (
 	MessageTypeSDP                MessageType = "sdp"
 	MessageTypeCandidate          MessageType = "candidate"
 	MessageTypeDataChannel        MessageType = "data_channel"
+	MessageTypeJoinRoomRequest    MessageType = "join_room_request"
+	MessageTypeJoinRoomResponse   MessageType = "join_room_response"
+	MessageTypeLeaveRoomRequest   MessageType = "leave_room_request"
+	MessageTypeLeaveRoomResponse  MessageType = "leave_room_response"
+	MessageTypeRoomMemberJoined   MessageType = "room_member_joined"
+	MessageTypeRoomMemberLeft     MessageType = "room_member_left"
+	MessageTypeRoomMessage        MessageType = "room_message"
+	MessageTypePeerJoined         MessageType = "peer_joined"
+	MessageTypePeerLeft           MessageType = "peer_left"
+	MessageTypeListPeersRequest   MessageType = "list_peers_request"
+	MessageTypeListPeersResponse  MessageType = "list_peers_response"
+	MessageTypeInvite             MessageType = "invite"
+	MessageTypeInviteAccept       MessageType = "invite_accept"
+	MessageTypeMessageExpired     MessageType = "message_expired"
+	MessageTypeNotice             MessageType = "notice"
+	MessageTypeServerShutdown     MessageType = "server_shutdown"
+	MessageTypeHello              MessageType = "hello"
+	MessageTypeWelcome            MessageType = "welcome"
+	MessageTypeError              MessageType = "error"
 )
 
-// Message represents a generic signaling message
+// ServerOriginated reports whether only the server sends messages of the
+// type. Clients may not send them to each other.
+func (t MessageType) ServerOriginated() bool {
+	switch t {
+	case MessageTypeRegisterResponse, MessageTypeUnregisterResponse,
+		MessageTypeJoinRoomResponse, MessageTypeLeaveRoomResponse,
+		MessageTypeRoomMemberJoined, MessageTypeRoomMemberLeft,
+		MessageTypePeerJoined, MessageTypePeerLeft,
+		MessageTypeListPeersResponse, MessageTypeMessageExpired,
+		MessageTypeNotice, MessageTypeServerShutdown,
+		MessageTypeWelcome, MessageTypeError:
+		return true
+	default:
+		return false
+	}
+}
+
+// Message represents a generic signaling message.
+// FromID and ToID are routing fields: the server forwards any message with a
+// ToID to that client without decoding Data. ReplyTo holds the ID of the
+// message this one responds to.
 type Message struct {
 	ID        string          `json:"id"`
 	Type      MessageType     `json:"type"`
+	FromID    string          `json:"from_id,omitempty"`
+	ToID      string          `json:"to_id,omitempty"`
+	ReplyTo   string          `json:"reply_to,omitempty"`
 	Timestamp time.Time       `json:"timestamp"`
 	Data      json.RawMessage `json:"data"`
 }
 
+// NewMessage creates a message of the given type with payload marshaled into Data
+func NewMessage(messageType MessageType, payload any) (*Message, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Message{
+		ID:        xid.New().String(),
+		Type:      messageType,
+		Timestamp: time.Now(),
+		Data:      data,
+	}, nil
+}
+
+// NewAddressedMessage creates a message routed from fromID to toID
+func NewAddressedMessage(messageType MessageType, fromID, toID string, payload any) (*Message, error) {
+	msg, err := NewMessage(messageType, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	msg.FromID = fromID
+	msg.ToID = toID
+	return msg, nil
+}
+
 // RegisterRequest represents a client registration request
 type RegisterRequest struct {
 	ClientID string `json:"client_id,omitempty"`
+	Token    string `json:"token,omitempty"`
+	// ResumeToken reclaims the session of ClientID after a reconnect
+	ResumeToken string `json:"resume_token,omitempty"`
 }
 
 // RegisterResponse represents a registration response
 type RegisterResponse struct {
 	ClientID string `json:"client_id"`
 	Success  bool   `json:"success"`
+	Error    string `json:"error,omitempty"`
+	// ResumeToken can be presented after a reconnect to resume the session
+	ResumeToken string `json:"resume_token,omitempty"`
+	// Resumed is set when the registration resumed an existing session
+	Resumed bool `json:"resumed,omitempty"`
+	// ICEServers are the STUN and TURN servers clients should use for their
+	// peer connections
+	ICEServers []ICEServer `json:"ice_servers,omitempty"`
+}
+
+// ICEServer is a STUN or TURN server in the shape of RTCIceServer
+type ICEServer struct {
+	URLs       []string `json:"urls"`
+	Username   string   `json:"username,omitempty"`
+	Credential string   `json:"credential,omitempty"`
+}
+
+// Notice is an announcement from the operators of the server, such as
+// upcoming maintenance
+type Notice struct {
+	Text string `json:"text"`
+}
+
+// ServerShutdown tells clients that the server is about to close their
+// connection. Clients should wait ReconnectAfterMs before reconnecting so
+// that they do not all reconnect at once.
+type ServerShutdown struct {
+	Reason           string `json:"reason"`
+	ReconnectAfterMs int64  `json:"reconnect_after_ms"`
+}
+
+// ErrorMessage reports why the server rejected a message
+type ErrorMessage struct {
+	Code      ErrorCode `json:"code"`
+	Message   string    `json:"message"`
+	MessageID string    `json:"message_id,omitempty"`
+	// Fields lists the invalid fields when the payload was rejected
+	Fields []FieldError `json:"fields,omitempty"`
+}
+
+// Err converts the error message back into an Error
+func (m ErrorMessage) Err() *Error {
+	err := NewError(m.Code, m.Message)
+	err.Fields = m.Fields
+	return err
+}
+
+// UnregisterRequest represents a client unregistration request
+type UnregisterRequest struct {
+	ClientID string `json:"client_id"`
+}
+
+// UnregisterResponse represents an unregistration response
+type UnregisterResponse struct {
+	ClientID string `json:"client_id"`
+	Success  bool   `json:"success"`
 }
 
-// SDPMessage represents an SDP exchange message
+// PeerEvent notifies a client about another client's presence
+type PeerEvent struct {
+	ClientID string `json:"client_id"`
+}
+
+// MessageExpired tells a sender that a message held for an offline
+// recipient was dropped before the recipient registered
+type MessageExpired struct {
+	MessageID string      `json:"message_id"`
+	Type      MessageType `json:"type"`
+	ToID      string      `json:"to_id"`
+}
+
+// ListPeersRequest asks for the clients visible to the sender. With a RoomID
+// only the members of that room are listed.
+type ListPeersRequest struct {
+	RoomID string `json:"room_id,omitempty"`
+}
+
+// ListPeersResponse lists the IDs of the other visible clients
+type ListPeersResponse struct {
+	RoomID string   `json:"room_id,omitempty"`
+	Peers  []string `json:"peers"`
+}
+
+// SDPMessage represents an SDP exchange message.
+// FromID and ToID duplicate the envelope routing fields for older clients.
 type SDPMessage struct {
 	FromID             string                    `json:"from_id"`
 	ToID               string                    `json:"to_id"`
@@ -60,3 +215,41 @@ type DataChannelMessage struct {
 	Label   string `json:"label"`
 	Payload []byte `json:"payload"`
 }
+
+// JoinRoomRequest represents a request to join a room
+type JoinRoomRequest struct {
+	RoomID   string `json:"room_id"`
+	ClientID string `json:"client_id"`
+}
+
+// JoinRoomResponse represents a join room response
+type JoinRoomResponse struct {
+	RoomID  string   `json:"room_id"`
+	Members []string `json:"members"`
+	Success bool     `json:"success"`
+}
+
+// LeaveRoomRequest represents a request to leave a room
+type LeaveRoomRequest struct {
+	RoomID   string `json:"room_id"`
+	ClientID string `json:"client_id"`
+}
+
+// LeaveRoomResponse represents a leave room response
+type LeaveRoomResponse struct {
+	RoomID  string `json:"room_id"`
+	Success bool   `json:"success"`
+}
+
+// RoomMemberEvent notifies room members that a client joined or left
+type RoomMemberEvent struct {
+	RoomID   string `json:"room_id"`
+	ClientID string `json:"client_id"`
+}
+
+// RoomMessage represents an application message sent to every member of a room
+type RoomMessage struct {
+	RoomID  string          `json:"room_id"`
+	FromID  string          `json:"from_id"`
+	Payload json.RawMessage `json:"payload"`
+}
@@ -0,0 +1,107 @@
+package domain
+
+import (
+	"errors"
+	"strings"
+)
+
+// ErrorCode is a machine-readable reason for an error message
+type ErrorCode string
+
+const (
+	// ErrorCodeInvalidMessage means the message or its payload could not be decoded
+	ErrorCodeInvalidMessage ErrorCode = "invalid_message"
+	// ErrorCodeUnknownType means no handler exists for the message type
+	ErrorCodeUnknownType ErrorCode = "unknown_message_type"
+	// ErrorCodeNotRegistered means the sender must register first
+	ErrorCodeNotRegistered ErrorCode = "not_registered"
+	// ErrorCodeUnauthorized means the client failed authentication
+	ErrorCodeUnauthorized ErrorCode = "unauthorized"
+	// ErrorCodeForbidden means policy does not allow the sender to message the recipient
+	ErrorCodeForbidden ErrorCode = "forbidden"
+	// ErrorCodeAlreadyRegistered means the client ID or connection is taken
+	ErrorCodeAlreadyRegistered ErrorCode = "already_registered"
+	// ErrorCodeSenderMismatch means the message claims another client as its sender
+	ErrorCodeSenderMismatch ErrorCode = "sender_mismatch"
+	// ErrorCodeNotFound means the addressed client or room does not exist
+	ErrorCodeNotFound ErrorCode = "not_found"
+	// ErrorCodeRateLimited means the sender exceeded its message rate
+	ErrorCodeRateLimited ErrorCode = "rate_limited"
+	// ErrorCodeIncompatible means the peers share no protocol version or the
+	// server requires a hello first
+	ErrorCodeIncompatible ErrorCode = "incompatible"
+	// ErrorCodeUnavailable means the server could not accept the message right now
+	ErrorCodeUnavailable ErrorCode = "unavailable"
+	// ErrorCodeTimeout means the server gave up handling the message in time
+	ErrorCodeTimeout ErrorCode = "timeout"
+	// ErrorCodeInternal means the server failed to handle a valid message
+	ErrorCodeInternal ErrorCode = "internal"
+)
+
+// Error is an error that can be reported back to the client that caused it
+type Error struct {
+	Code    ErrorCode
+	Message string
+	// Fields lists the invalid fields of a rejected payload
+	Fields []FieldError
+}
+
+// FieldError describes what is wrong with one field of a message
+type FieldError struct {
+	// Field is the JSON path of the field, such as session_description.sdp
+	Field  string `json:"field"`
+	Reason string `json:"reason"`
+}
+
+func (e FieldError) String() string {
+	return e.Field + " " + e.Reason
+}
+
+// NewValidationError creates an invalid message error listing the invalid
+// fields of a messageType message
+func NewValidationError(messageType MessageType, fields ...FieldError) *Error {
+	reasons := make([]string, 0, len(fields))
+	for _, field := range fields {
+		reasons = append(reasons, field.String())
+	}
+
+	return &Error{
+		Code:    ErrorCodeInvalidMessage,
+		Message: "invalid " + string(messageType) + " message: " + strings.Join(reasons, "; "),
+		Fields:  fields,
+	}
+}
+
+// NewError creates a new Error
+func NewError(code ErrorCode, message string) *Error {
+	return &Error{
+		Code:    code,
+		Message: message,
+	}
+}
+
+func (e *Error) Error() string {
+	return string(e.Code) + ": " + e.Message
+}
+
+// ErrorFrom converts err into an Error, reporting untyped errors as internal
+func ErrorFrom(err error) *Error {
+	var e *Error
+	if errors.As(err, &e) {
+		return e
+	}
+
+	return NewError(ErrorCodeInternal, err.Error())
+}
+
+// NewErrorMessage creates an error message in reply to the message with messageID
+func NewErrorMessage(err error, messageID string) (*Message, error) {
+	e := ErrorFrom(err)
+
+	return NewMessage(MessageTypeError, ErrorMessage{
+		Code:      e.Code,
+		Message:   e.Message,
+		MessageID: messageID,
+		Fields:    e.Fields,
+	})
+}
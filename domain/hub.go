@@ -3,10 +3,18 @@ package domain
 import "context"
 
 type HubStats struct {
-	ConnectedClients int     `json:"connected_clients"`
-	MessagesSent     int64   `json:"messages_sent"`
-	MessagesReceived int64   `json:"messages_received"`
-	Uptime           float64 `json:"uptime_seconds"`
+	ConnectedClients  int                   `json:"connected_clients"`
+	Rooms             int                   `json:"rooms"`
+	MessagesSent      int64                 `json:"messages_sent"`
+	MessagesReceived  int64                 `json:"messages_received"`
+	MessagesThrottled int64                 `json:"messages_throttled"`
+	ThrottledByType   map[MessageType]int64 `json:"throttled_by_type,omitempty"`
+	MessagesHeld      int                   `json:"messages_held"`
+	ForwardFailures   int64                 `json:"forward_failures"`
+	MessagesDropped   int64                 `json:"messages_dropped"`
+	SlowConsumers     int64                 `json:"slow_consumers"`
+	SendQueue         int                   `json:"send_queue"`
+	Uptime            float64               `json:"uptime_seconds"`
 }
 
 type Hub interface {
@@ -19,13 +27,19 @@ type Hub interface {
 	// Register registers a new client
 	Register(client Client) error
 
-	// Unregister removes a client
+	// Replace swaps the client registered under the same ID without
+	// unregistering it
+	Replace(client Client) error
+
+	// Unregister removes a client without closing its connection, which
+	// may register again. Callers that end the connection close it.
 	Unregister(clientID string) error
 
 	// Broadcast sends a message to all connected clients
 	Broadcast(message []byte) error
 
-	// SendTo sends a message to a specific client
+	// SendTo sends a message to a specific client. Hubs with a mailbox hold
+	// messages for clients that have not registered yet.
 	SendTo(clientID string, message []byte) error
 
 	// SendToMultiple sends a message to multiple clients
@@ -36,4 +50,25 @@ type Hub interface {
 
 	// GetClients returns all connected clients
 	GetClients() []Client
+
+	// JoinRoom adds a registered client to a room, creating the room if needed
+	JoinRoom(roomID, clientID string) error
+
+	// LeaveRoom removes a client from a room
+	LeaveRoom(roomID, clientID string) error
+
+	// SendToRoom sends a message to all members of a room
+	SendToRoom(roomID string, message []byte) error
+
+	// BroadcastToRoom sends a message to all members of a room except the sender
+	BroadcastToRoom(roomID, senderID string, message []byte) error
+
+	// GetRoomMembers returns the IDs of the clients in a room
+	GetRoomMembers(roomID string) []string
+
+	// GetClientRooms returns the IDs of the rooms a client belongs to
+	GetClientRooms(clientID string) []string
+
+	// GetStats returns a snapshot of the hub statistics
+	GetStats() HubStats
 }
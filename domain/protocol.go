@@ -0,0 +1,101 @@
+package domain
+
+import "slices"
+
+const (
+	// ProtocolVersion is the newest protocol version this module speaks
+	ProtocolVersion = 1
+
+	// MinProtocolVersion is the oldest protocol version this module still
+	// speaks
+	MinProtocolVersion = 1
+)
+
+// Feature is an optional part of the protocol a peer may support. Peers
+// agree on features in the hello/welcome exchange.
+type Feature string
+
+const (
+	// FeaturePresence is peer_joined and peer_left notifications
+	FeaturePresence Feature = "presence"
+	// FeatureResume is resume tokens in register responses
+	FeatureResume Feature = "resume"
+	// FeatureNotice is notice messages from the operators
+	FeatureNotice Feature = "notice"
+	// FeatureServerShutdown is server_shutdown messages before the server
+	// closes the connection
+	FeatureServerShutdown Feature = "server_shutdown"
+	// FeatureMailbox is message_expired notifications for held messages
+	FeatureMailbox Feature = "mailbox"
+)
+
+// Features returns every feature this module knows
+func Features() []Feature {
+	return []Feature{
+		FeaturePresence,
+		FeatureResume,
+		FeatureNotice,
+		FeatureServerShutdown,
+		FeatureMailbox,
+	}
+}
+
+// Hello is the first message a client sends, before registering, to agree
+// on a protocol version and features with the server
+type Hello struct {
+	// Version is the newest protocol version the client speaks
+	Version int `json:"version"`
+	// MinVersion is the oldest protocol version the client speaks. Zero
+	// means only Version.
+	MinVersion int `json:"min_version,omitempty"`
+	// Features are the features the client supports
+	Features []Feature `json:"features,omitempty"`
+}
+
+// Welcome answers a hello with the agreed protocol version and the features
+// both sides support
+type Welcome struct {
+	Version  int       `json:"version"`
+	Features []Feature `json:"features"`
+}
+
+// Capabilities are what a peer agreed on in the hello/welcome exchange
+type Capabilities struct {
+	Version  int
+	Features []Feature
+}
+
+// Has reports whether feature was agreed on
+func (c Capabilities) Has(feature Feature) bool {
+	return slices.Contains(c.Features, feature)
+}
+
+// NegotiateVersion returns the newest protocol version spoken both by this
+// module and by a peer speaking minVersion through version. It reports false
+// when there is none.
+func NegotiateVersion(version, minVersion int) (int, bool) {
+	if minVersion == 0 {
+		minVersion = version
+	}
+	if version < 1 || minVersion > version {
+		return 0, false
+	}
+
+	negotiated := min(version, ProtocolVersion)
+	if negotiated < max(minVersion, MinProtocolVersion) {
+		return 0, false
+	}
+
+	return negotiated, true
+}
+
+// CommonFeatures returns the features of ours that theirs also lists
+func CommonFeatures(ours, theirs []Feature) []Feature {
+	common := []Feature{}
+	for _, feature := range ours {
+		if slices.Contains(theirs, feature) {
+			common = append(common, feature)
+		}
+	}
+	return common
+}
@@ -0,0 +1,76 @@
+package hub
+
+import (
+	"context"
+	"encoding/json"
+)
+
+// BackplaneEventType identifies what a backplane event asks other nodes to do
+type BackplaneEventType string
+
+const (
+	// BackplaneSend delivers Message to ClientID on the Target node
+	BackplaneSend BackplaneEventType = "send"
+	// BackplaneBroadcast delivers Message to every client of every node
+	BackplaneBroadcast BackplaneEventType = "broadcast"
+	// BackplaneRegister announces that ClientID connected to NodeID
+	BackplaneRegister BackplaneEventType = "register"
+	// BackplaneUnregister announces that ClientID left NodeID
+	BackplaneUnregister BackplaneEventType = "unregister"
+	// BackplaneJoinRoom announces that ClientID joined RoomID
+	BackplaneJoinRoom BackplaneEventType = "join_room"
+	// BackplaneLeaveRoom announces that ClientID left RoomID
+	BackplaneLeaveRoom BackplaneEventType = "leave_room"
+	// BackplaneClose asks the Target node to close the connection of ClientID
+	BackplaneClose BackplaneEventType = "close"
+	// BackplaneSync asks every node to republish the room memberships of its
+	// clients to NodeID
+	BackplaneSync BackplaneEventType = "sync"
+	// BackplaneRoomMember reports an existing membership of ClientID in
+	// RoomID in reply to BackplaneSync
+	BackplaneRoomMember BackplaneEventType = "room_member"
+	// BackplaneRejoined is never published. A backplane hands it to its own
+	// node after reconnecting, once the other nodes have seen the clients of
+	// the node leave, so that the node can claim them again.
+	BackplaneRejoined BackplaneEventType = "rejoined"
+)
+
+// BackplaneEvent is published by one node and delivered to the others
+type BackplaneEvent struct {
+	Type BackplaneEventType `json:"type"`
+	// NodeID is the node that published the event
+	NodeID string `json:"node_id"`
+	// Target restricts delivery to a single node. Empty delivers to all.
+	Target   string          `json:"target,omitempty"`
+	ClientID string          `json:"client_id,omitempty"`
+	RoomID   string          `json:"room_id,omitempty"`
+	Message  json.RawMessage `json:"message,omitempty"`
+}
+
+// Backplane connects the hubs of several signaling nodes. It relays events
+// between them and keeps a directory of which node each client is on.
+type Backplane interface {
+	// Join connects nodeID to the backplane. handler receives the events
+	// published by other nodes, in the order they were published.
+	Join(ctx context.Context, nodeID string, handler func(BackplaneEvent)) error
+
+	// Leave disconnects nodeID. Its clients are released from the directory
+	// and announced to the remaining nodes as unregistered.
+	Leave(ctx context.Context, nodeID string) error
+
+	// Publish delivers event to the other nodes, or only to event.Target
+	Publish(ctx context.Context, event BackplaneEvent) error
+
+	// Claim records clientID as connected to nodeID. It fails with an
+	// already_registered error when another node holds the client ID.
+	Claim(ctx context.Context, clientID, nodeID string) error
+
+	// Release removes clientID from the directory if nodeID holds it
+	Release(ctx context.Context, clientID, nodeID string) error
+
+	// Locate returns the node clientID is connected to
+	Locate(ctx context.Context, clientID string) (string, bool, error)
+
+	// Clients returns the directory as a map of client ID to node ID
+	Clients(ctx context.Context) (map[string]string, error)
+}
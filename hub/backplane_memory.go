@@ -0,0 +1,156 @@
+package hub
+
+import (
+	"context"
+	"maps"
+	"sync"
+
+	"github.com/HMasataka/conic/domain"
+)
+
+// MemoryBackplane connects hubs running in the same process. It is meant for
+// tests and for trying out multi-node setups without a broker.
+type MemoryBackplane struct {
+	mu      sync.Mutex
+	nodes   map[string]*memoryNode
+	clients map[string]string // clientID -> nodeID
+}
+
+// memoryNode delivers the events for one node in order on its own goroutine
+type memoryNode struct {
+	events chan BackplaneEvent
+	done   chan struct{}
+}
+
+// NewMemoryBackplane creates an empty in-process backplane
+func NewMemoryBackplane() *MemoryBackplane {
+	return &MemoryBackplane{
+		nodes:   make(map[string]*memoryNode),
+		clients: make(map[string]string),
+	}
+}
+
+// Join implements Backplane
+func (b *MemoryBackplane) Join(ctx context.Context, nodeID string, handler func(BackplaneEvent)) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, exists := b.nodes[nodeID]; exists {
+		return domain.NewError(domain.ErrorCodeAlreadyRegistered, "node already joined: "+nodeID)
+	}
+
+	node := &memoryNode{
+		events: make(chan BackplaneEvent, 4096),
+		done:   make(chan struct{}),
+	}
+	b.nodes[nodeID] = node
+
+	go func() {
+		for {
+			select {
+			case <-node.done:
+				return
+			case event := <-node.events:
+				handler(event)
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Leave implements Backplane
+func (b *MemoryBackplane) Leave(ctx context.Context, nodeID string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	node, ok := b.nodes[nodeID]
+	if !ok {
+		return nil
+	}
+	delete(b.nodes, nodeID)
+	close(node.done)
+
+	for clientID, owner := range b.clients {
+		if owner != nodeID {
+			continue
+		}
+		delete(b.clients, clientID)
+
+		b.publishLocked(BackplaneEvent{
+			Type:     BackplaneUnregister,
+			NodeID:   nodeID,
+			ClientID: clientID,
+		})
+	}
+
+	return nil
+}
+
+// Publish implements Backplane
+func (b *MemoryBackplane) Publish(ctx context.Context, event BackplaneEvent) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.publishLocked(event)
+}
+
+func (b *MemoryBackplane) publishLocked(event BackplaneEvent) error {
+	var err error
+
+	for nodeID, node := range b.nodes {
+		if nodeID == event.NodeID || (event.Target != "" && nodeID != event.Target) {
+			continue
+		}
+
+		select {
+		case node.events <- event:
+		default:
+			err = domain.NewError(domain.ErrorCodeUnavailable, "backplane queue of node "+nodeID+" is full")
+		}
+	}
+
+	return err
+}
+
+// Claim implements Backplane
+func (b *MemoryBackplane) Claim(ctx context.Context, clientID, nodeID string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if owner, ok := b.clients[clientID]; ok && owner != nodeID {
+		return domain.NewError(domain.ErrorCodeAlreadyRegistered, "client already registered on node "+owner+": "+clientID)
+	}
+	b.clients[clientID] = nodeID
+
+	return nil
+}
+
+// Release implements Backplane
+func (b *MemoryBackplane) Release(ctx context.Context, clientID, nodeID string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.clients[clientID] == nodeID {
+		delete(b.clients, clientID)
+	}
+
+	return nil
+}
+
+// Locate implements Backplane
+func (b *MemoryBackplane) Locate(ctx context.Context, clientID string) (string, bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	nodeID, ok := b.clients[clientID]
+	return nodeID, ok, nil
+}
+
+// Clients implements Backplane
+func (b *MemoryBackplane) Clients(ctx context.Context) (map[string]string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return maps.Clone(b.clients), nil
+}
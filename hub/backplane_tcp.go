@@ -0,0 +1,670 @@
+package hub
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"maps"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/HMasataka/conic/domain"
+	"github.com/HMasataka/conic/logging"
+)
+
+// backplaneFrame is a line of the JSON protocol spoken between TCPBackplane
+// and BackplaneBroker. Requests carry a Seq that the broker echoes in its
+// reply; publish requests and pushed events have none.
+type backplaneFrame struct {
+	Op       string            `json:"op"`
+	Seq      uint64            `json:"seq,omitempty"`
+	NodeID   string            `json:"node_id,omitempty"`
+	Secret   string            `json:"secret,omitempty"`
+	ClientID string            `json:"client_id,omitempty"`
+	Event    *BackplaneEvent   `json:"event,omitempty"`
+	Found    bool              `json:"found,omitempty"`
+	Clients  map[string]string `json:"clients,omitempty"`
+	Code     domain.ErrorCode  `json:"code,omitempty"`
+	Error    string            `json:"error,omitempty"`
+}
+
+const (
+	opJoin    = "join"
+	opLeave   = "leave"
+	opPublish = "publish"
+	opClaim   = "claim"
+	opRelease = "release"
+	opLocate  = "locate"
+	opClients = "clients"
+	opReply   = "reply"
+	opEvent   = "event"
+)
+
+// BackplaneBrokerOptions configures a BackplaneBroker
+type BackplaneBrokerOptions struct {
+	Logger *logging.Logger
+
+	// Secret must be presented by nodes when they join. Empty lets any node
+	// join.
+	Secret string
+}
+
+// BackplaneBroker relays events between TCPBackplane nodes and owns the
+// client directory. Nodes that disconnect are treated as having left.
+//
+// Joined nodes are trusted: they can claim any client ID and close clients
+// of other nodes. The protocol is not encrypted, so the broker must only be
+// reachable from the nodes, over a trusted network or a tunnel.
+type BackplaneBroker struct {
+	options  BackplaneBrokerOptions
+	logger   *logging.Logger
+	mu       sync.Mutex
+	listener net.Listener
+	conns    map[*brokerConn]struct{}
+	nodes    map[string]*brokerConn
+	clients  map[string]string // clientID -> nodeID
+}
+
+type brokerConn struct {
+	conn   net.Conn
+	nodeID string
+	out    chan backplaneFrame
+}
+
+// NewBackplaneBroker creates a broker that lets any node join. Call Serve to
+// accept nodes.
+func NewBackplaneBroker(logger *logging.Logger) *BackplaneBroker {
+	return NewBackplaneBrokerWithOptions(BackplaneBrokerOptions{Logger: logger})
+}
+
+func NewBackplaneBrokerWithOptions(options BackplaneBrokerOptions) *BackplaneBroker {
+	return &BackplaneBroker{
+		options: options,
+		logger:  options.Logger,
+		conns:   make(map[*brokerConn]struct{}),
+		nodes:   make(map[string]*brokerConn),
+		clients: make(map[string]string),
+	}
+}
+
+// Serve accepts nodes on listener until Close is called
+func (b *BackplaneBroker) Serve(listener net.Listener) error {
+	b.mu.Lock()
+	b.listener = listener
+	b.mu.Unlock()
+
+	b.logger.Info("backplane broker listening", "addr", listener.Addr().String())
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+
+		c := &brokerConn{
+			conn: conn,
+			out:  make(chan backplaneFrame, 4096),
+		}
+
+		b.mu.Lock()
+		b.conns[c] = struct{}{}
+		b.mu.Unlock()
+
+		go b.write(c)
+		go b.read(c)
+	}
+}
+
+// Close stops accepting nodes and disconnects the connected ones
+func (b *BackplaneBroker) Close() error {
+	b.mu.Lock()
+	listener := b.listener
+	conns := make([]*brokerConn, 0, len(b.conns))
+	for c := range b.conns {
+		conns = append(conns, c)
+	}
+	b.mu.Unlock()
+
+	for _, c := range conns {
+		c.conn.Close()
+	}
+
+	if listener == nil {
+		return nil
+	}
+	return listener.Close()
+}
+
+func (b *BackplaneBroker) write(c *brokerConn) {
+	encoder := json.NewEncoder(c.conn)
+	for frame := range c.out {
+		if err := encoder.Encode(frame); err != nil {
+			c.conn.Close()
+			for range c.out {
+			}
+			return
+		}
+	}
+}
+
+func (b *BackplaneBroker) read(c *brokerConn) {
+	defer b.disconnect(c)
+
+	scanner := bufio.NewScanner(c.conn)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	for scanner.Scan() {
+		var frame backplaneFrame
+		if err := json.Unmarshal(scanner.Bytes(), &frame); err != nil {
+			b.logger.Error("invalid backplane frame", "error", err)
+			return
+		}
+
+		if reply, ok := b.handle(c, frame); ok {
+			reply.Op = opReply
+			reply.Seq = frame.Seq
+			b.enqueue(c, reply)
+		}
+	}
+}
+
+// handle applies a request from c and returns the reply, if it needs one
+func (b *BackplaneBroker) handle(c *brokerConn, frame backplaneFrame) (backplaneFrame, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if frame.Op != opJoin && c.nodeID == "" {
+		return errorFrame(domain.NewError(domain.ErrorCodeNotRegistered, "join before "+frame.Op)), frame.Op != opPublish
+	}
+
+	switch frame.Op {
+	case opJoin:
+		if c.nodeID != "" {
+			return errorFrame(domain.NewError(domain.ErrorCodeAlreadyRegistered, "connection already joined as "+c.nodeID)), true
+		}
+		if subtle.ConstantTimeCompare([]byte(frame.Secret), []byte(b.options.Secret)) != 1 {
+			b.logger.Warn("backplane node presented a wrong secret", "node_id", frame.NodeID, "addr", c.conn.RemoteAddr().String())
+			return errorFrame(domain.NewError(domain.ErrorCodeUnauthorized, "invalid backplane secret")), true
+		}
+		if _, exists := b.nodes[frame.NodeID]; exists || frame.NodeID == "" {
+			return errorFrame(domain.NewError(domain.ErrorCodeAlreadyRegistered, "node already joined: "+frame.NodeID)), true
+		}
+		c.nodeID = frame.NodeID
+		b.nodes[c.nodeID] = c
+		b.logger.Info("backplane node joined", "node_id", c.nodeID)
+		return backplaneFrame{}, true
+
+	case opLeave:
+		b.leaveLocked(c)
+		return backplaneFrame{}, true
+
+	case opPublish:
+		if frame.Event != nil {
+			// Nodes cannot publish on behalf of each other
+			frame.Event.NodeID = c.nodeID
+			b.publishLocked(*frame.Event)
+		}
+		return backplaneFrame{}, false
+
+	case opClaim:
+		if owner, ok := b.clients[frame.ClientID]; ok && owner != c.nodeID {
+			return errorFrame(domain.NewError(domain.ErrorCodeAlreadyRegistered, "client already registered on node "+owner+": "+frame.ClientID)), true
+		}
+		b.clients[frame.ClientID] = c.nodeID
+		return backplaneFrame{}, true
+
+	case opRelease:
+		if b.clients[frame.ClientID] == c.nodeID {
+			delete(b.clients, frame.ClientID)
+		}
+		return backplaneFrame{}, true
+
+	case opLocate:
+		nodeID, ok := b.clients[frame.ClientID]
+		return backplaneFrame{NodeID: nodeID, Found: ok}, true
+
+	case opClients:
+		return backplaneFrame{Clients: maps.Clone(b.clients)}, true
+
+	default:
+		return errorFrame(domain.NewError(domain.ErrorCodeUnknownType, "unknown backplane operation: "+frame.Op)), true
+	}
+}
+
+func (b *BackplaneBroker) publishLocked(event BackplaneEvent) {
+	for nodeID, c := range b.nodes {
+		if nodeID == event.NodeID || (event.Target != "" && nodeID != event.Target) {
+			continue
+		}
+		b.enqueue(c, backplaneFrame{Op: opEvent, Event: &event})
+	}
+}
+
+// leaveLocked releases the clients of c and announces them as unregistered
+func (b *BackplaneBroker) leaveLocked(c *brokerConn) {
+	if c.nodeID == "" {
+		return
+	}
+
+	nodeID := c.nodeID
+	delete(b.nodes, nodeID)
+	c.nodeID = ""
+
+	for clientID, owner := range b.clients {
+		if owner != nodeID {
+			continue
+		}
+		delete(b.clients, clientID)
+
+		b.publishLocked(BackplaneEvent{
+			Type:     BackplaneUnregister,
+			NodeID:   nodeID,
+			ClientID: clientID,
+		})
+	}
+
+	b.logger.Info("backplane node left", "node_id", nodeID)
+}
+
+func (b *BackplaneBroker) disconnect(c *brokerConn) {
+	b.mu.Lock()
+	b.leaveLocked(c)
+	delete(b.conns, c)
+	close(c.out)
+	b.mu.Unlock()
+
+	c.conn.Close()
+}
+
+// enqueue queues frame for c without blocking the broker. Frames for a node
+// that cannot keep up are dropped.
+func (b *BackplaneBroker) enqueue(c *brokerConn, frame backplaneFrame) {
+	select {
+	case c.out <- frame:
+	default:
+		b.logger.Error("backplane node queue full, dropping frame", "node_id", c.nodeID, "op", frame.Op)
+	}
+}
+
+func errorFrame(err *domain.Error) backplaneFrame {
+	return backplaneFrame{Code: err.Code, Error: err.Message}
+}
+
+// TCPBackplaneOptions configures a TCPBackplane
+type TCPBackplaneOptions struct {
+	Logger *logging.Logger
+
+	// Secret is presented to the broker when joining
+	Secret string
+
+	// MinBackoff and MaxBackoff bound the delay between attempts to
+	// reconnect after the connection to the broker dropped
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+func DefaultTCPBackplaneOptions() TCPBackplaneOptions {
+	return TCPBackplaneOptions{
+		MinBackoff: 100 * time.Millisecond,
+		MaxBackoff: 10 * time.Second,
+	}
+}
+
+// TCPBackplane is a Backplane that connects to a BackplaneBroker. When the
+// connection drops it reconnects with backoff, and once it joined again it
+// hands its node a BackplaneRejoined event. Requests fail with an
+// unavailable error until then.
+type TCPBackplane struct {
+	addr    string
+	options TCPBackplaneOptions
+	logger  *logging.Logger
+	nodeID  string
+	mu      sync.Mutex
+	writeMu sync.Mutex
+	conn    net.Conn
+	encoder *json.Encoder
+	seq     uint64
+	pending map[uint64]chan backplaneFrame
+	events  chan BackplaneEvent
+	closed  chan struct{} // closed when the current connection drops
+	done    chan struct{} // closed when the node leaves
+
+	leaving      bool
+	reconnecting bool
+}
+
+// NewTCPBackplane creates a backplane that connects to the broker at addr
+// when the node joins
+func NewTCPBackplane(addr string, logger *logging.Logger) *TCPBackplane {
+	options := DefaultTCPBackplaneOptions()
+	options.Logger = logger
+	return NewTCPBackplaneWithOptions(addr, options)
+}
+
+func NewTCPBackplaneWithOptions(addr string, options TCPBackplaneOptions) *TCPBackplane {
+	defaults := DefaultTCPBackplaneOptions()
+	if options.MinBackoff <= 0 {
+		options.MinBackoff = defaults.MinBackoff
+	}
+	if options.MaxBackoff < options.MinBackoff {
+		options.MaxBackoff = max(defaults.MaxBackoff, options.MinBackoff)
+	}
+
+	return &TCPBackplane{
+		addr:    addr,
+		options: options,
+		logger:  options.Logger,
+		pending: make(map[uint64]chan backplaneFrame),
+		closed:  make(chan struct{}),
+	}
+}
+
+// Join implements Backplane
+func (b *TCPBackplane) Join(ctx context.Context, nodeID string, handler func(BackplaneEvent)) error {
+	b.mu.Lock()
+	b.nodeID = nodeID
+	b.events = make(chan BackplaneEvent, 4096)
+	b.done = make(chan struct{})
+	b.leaving = false
+	b.reconnecting = true
+	b.mu.Unlock()
+
+	// Events are handled on their own goroutine so that handlers can make
+	// requests, whose replies arrive on the read loop
+	go func(events chan BackplaneEvent, done chan struct{}) {
+		for {
+			select {
+			case <-done:
+				return
+			case event := <-events:
+				handler(event)
+			}
+		}
+	}(b.events, b.done)
+
+	closed, err := b.connect(ctx)
+	if err != nil {
+		b.mu.Lock()
+		b.leaving = true
+		close(b.done)
+		b.mu.Unlock()
+		return err
+	}
+
+	if !b.connected(closed) {
+		go b.reconnect()
+	}
+	return nil
+}
+
+// connect dials the broker and joins it. It returns the channel closed when
+// the connection drops.
+func (b *TCPBackplane) connect(ctx context.Context) (chan struct{}, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", b.addr)
+	if err != nil {
+		return nil, domain.NewError(domain.ErrorCodeUnavailable, "failed to connect to backplane broker: "+err.Error())
+	}
+
+	closed := make(chan struct{})
+
+	b.mu.Lock()
+	b.conn = conn
+	b.encoder = json.NewEncoder(conn)
+	b.closed = closed
+	nodeID := b.nodeID
+	b.mu.Unlock()
+
+	go b.read(conn, closed)
+
+	if _, err := b.request(ctx, backplaneFrame{Op: opJoin, NodeID: nodeID, Secret: b.options.Secret}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return closed, nil
+}
+
+// connected hands the connection that closed belongs to over to the read
+// loop, which reconnects when it drops. It reports false when the connection
+// already dropped, in which case the caller keeps reconnecting.
+func (b *TCPBackplane) connected(closed chan struct{}) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	select {
+	case <-closed:
+		return false
+	default:
+		b.reconnecting = false
+		return true
+	}
+}
+
+// reconnect joins the broker again after the connection dropped, backing off
+// between attempts, until it succeeds or the node leaves
+func (b *TCPBackplane) reconnect() {
+	backoff := b.options.MinBackoff
+
+	for {
+		b.mu.Lock()
+		done := b.done
+		b.mu.Unlock()
+
+		select {
+		case <-done:
+			return
+		case <-time.After(backoff):
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		closed, err := b.connect(ctx)
+		cancel()
+
+		if err == nil && !b.connected(closed) {
+			err = domain.NewError(domain.ErrorCodeUnavailable, "backplane connection closed")
+		}
+
+		if err == nil {
+			b.mu.Lock()
+			events := b.events
+			b.mu.Unlock()
+
+			b.logger.Info("reconnected to backplane broker", "addr", b.addr)
+
+			select {
+			case events <- BackplaneEvent{Type: BackplaneRejoined, NodeID: b.nodeID}:
+			case <-done:
+			}
+			return
+		}
+
+		b.logger.Warn("failed to reconnect to backplane broker", "addr", b.addr, "error", err, "retry_in", backoff)
+		backoff = min(backoff*2, b.options.MaxBackoff)
+	}
+}
+
+// Leave implements Backplane
+func (b *TCPBackplane) Leave(ctx context.Context, nodeID string) error {
+	b.mu.Lock()
+	if !b.leaving {
+		b.leaving = true
+		close(b.done)
+	}
+	b.mu.Unlock()
+
+	_, err := b.request(ctx, backplaneFrame{Op: opLeave})
+
+	b.mu.Lock()
+	conn := b.conn
+	b.mu.Unlock()
+
+	if conn != nil {
+		conn.Close()
+	}
+
+	return err
+}
+
+// Publish implements Backplane. Events are written in order without waiting
+// for the broker.
+func (b *TCPBackplane) Publish(ctx context.Context, event BackplaneEvent) error {
+	return b.write(backplaneFrame{Op: opPublish, Event: &event})
+}
+
+// Claim implements Backplane
+func (b *TCPBackplane) Claim(ctx context.Context, clientID, nodeID string) error {
+	_, err := b.request(ctx, backplaneFrame{Op: opClaim, ClientID: clientID})
+	return err
+}
+
+// Release implements Backplane
+func (b *TCPBackplane) Release(ctx context.Context, clientID, nodeID string) error {
+	_, err := b.request(ctx, backplaneFrame{Op: opRelease, ClientID: clientID})
+	return err
+}
+
+// Locate implements Backplane
+func (b *TCPBackplane) Locate(ctx context.Context, clientID string) (string, bool, error) {
+	reply, err := b.request(ctx, backplaneFrame{Op: opLocate, ClientID: clientID})
+	if err != nil {
+		return "", false, err
+	}
+
+	return reply.NodeID, reply.Found, nil
+}
+
+// Clients implements Backplane
+func (b *TCPBackplane) Clients(ctx context.Context) (map[string]string, error) {
+	reply, err := b.request(ctx, backplaneFrame{Op: opClients})
+	if err != nil {
+		return nil, err
+	}
+
+	if reply.Clients == nil {
+		return map[string]string{}, nil
+	}
+	return reply.Clients, nil
+}
+
+func (b *TCPBackplane) request(ctx context.Context, frame backplaneFrame) (backplaneFrame, error) {
+	reply := make(chan backplaneFrame, 1)
+
+	b.mu.Lock()
+	b.seq++
+	frame.Seq = b.seq
+	b.pending[frame.Seq] = reply
+	closed := b.closed
+	b.mu.Unlock()
+
+	defer func() {
+		b.mu.Lock()
+		delete(b.pending, frame.Seq)
+		b.mu.Unlock()
+	}()
+
+	if err := b.write(frame); err != nil {
+		return backplaneFrame{}, err
+	}
+
+	select {
+	case <-ctx.Done():
+		return backplaneFrame{}, ctx.Err()
+	case <-closed:
+		return backplaneFrame{}, domain.NewError(domain.ErrorCodeUnavailable, "backplane connection closed")
+	case response, ok := <-reply:
+		if !ok {
+			return backplaneFrame{}, domain.NewError(domain.ErrorCodeUnavailable, "backplane connection closed")
+		}
+		if response.Code != "" {
+			return response, domain.NewError(response.Code, response.Error)
+		}
+		return response, nil
+	}
+}
+
+func (b *TCPBackplane) write(frame backplaneFrame) error {
+	b.mu.Lock()
+	encoder := b.encoder
+	b.mu.Unlock()
+
+	if encoder == nil {
+		return domain.NewError(domain.ErrorCodeUnavailable, "backplane not joined")
+	}
+
+	b.writeMu.Lock()
+	defer b.writeMu.Unlock()
+
+	if err := encoder.Encode(frame); err != nil {
+		return domain.NewError(domain.ErrorCodeUnavailable, "failed to write to backplane broker: "+err.Error())
+	}
+
+	return nil
+}
+
+func (b *TCPBackplane) read(conn net.Conn, closed chan struct{}) {
+	defer func() {
+		b.mu.Lock()
+		for seq, reply := range b.pending {
+			close(reply)
+			delete(b.pending, seq)
+		}
+		if b.conn == conn {
+			b.conn = nil
+			b.encoder = nil
+		}
+		close(closed)
+
+		// While joining, the connection is retried by whoever is connecting
+		retry := !b.leaving && !b.reconnecting
+		if retry {
+			b.reconnecting = true
+		}
+		b.mu.Unlock()
+
+		if retry {
+			go b.reconnect()
+		}
+	}()
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	for scanner.Scan() {
+		var frame backplaneFrame
+		if err := json.Unmarshal(scanner.Bytes(), &frame); err != nil {
+			b.logger.Error("invalid backplane frame", "error", err)
+			continue
+		}
+
+		switch frame.Op {
+		case opReply:
+			b.mu.Lock()
+			reply, ok := b.pending[frame.Seq]
+			b.mu.Unlock()
+
+			if ok {
+				reply <- frame
+			}
+
+		case opEvent:
+			if frame.Event == nil {
+				continue
+			}
+
+			select {
+			case b.events <- *frame.Event:
+			default:
+				b.logger.Error("backplane event queue full, dropping event", "type", frame.Event.Type)
+			}
+		}
+	}
+
+	b.logger.Warn("backplane broker connection closed", "addr", b.addr, "error", scanner.Err())
+}
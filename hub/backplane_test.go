@@ -0,0 +1,155 @@
+package hub
+
+import (
+	"context"
+	"net"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/HMasataka/conic/domain"
+)
+
+// startBroker serves a broker on addr until the test ends and returns the
+// address it listens on
+func startBroker(t *testing.T, addr, secret string) (*BackplaneBroker, string) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+
+	broker := NewBackplaneBrokerWithOptions(BackplaneBrokerOptions{Logger: testLogger(), Secret: secret})
+	go broker.Serve(listener)
+	t.Cleanup(func() { broker.Close() })
+
+	return broker, listener.Addr().String()
+}
+
+func newTestTCPBackplane(addr, secret string) *TCPBackplane {
+	options := DefaultTCPBackplaneOptions()
+	options.Logger = testLogger()
+	options.Secret = secret
+	options.MinBackoff = 10 * time.Millisecond
+	options.MaxBackoff = 50 * time.Millisecond
+	return NewTCPBackplaneWithOptions(addr, options)
+}
+
+// twoNodes starts two hubs joined over the backplanes that newBackplane
+// returns
+func twoNodes(t *testing.T, newBackplane func() Backplane) (*Hub, *Hub) {
+	t.Helper()
+
+	n1 := startHub(t, HubOptions{NodeID: "n1", Backplane: newBackplane()})
+	n2 := startHub(t, HubOptions{NodeID: "n2", Backplane: newBackplane()})
+	return n1, n2
+}
+
+func backplanes(t *testing.T) map[string]func() Backplane {
+	return map[string]func() Backplane{
+		"memory": func() func() Backplane {
+			backplane := NewMemoryBackplane()
+			return func() Backplane { return backplane }
+		}(),
+		"tcp": func() func() Backplane {
+			_, addr := startBroker(t, "127.0.0.1:0", "secret")
+			return func() Backplane { return newTestTCPBackplane(addr, "secret") }
+		}(),
+	}
+}
+
+func TestBackplaneTwoNodes(t *testing.T) {
+	for name, newBackplane := range backplanes(t) {
+		t.Run(name, func(t *testing.T) {
+			n1, n2 := twoNodes(t, newBackplane)
+
+			a := newRecordingClient("a")
+			b := newRecordingClient("b")
+			if err := n1.Register(a); err != nil {
+				t.Fatalf("register a: %v", err)
+			}
+			if err := n2.Register(b); err != nil {
+				t.Fatalf("register b: %v", err)
+			}
+
+			if err := n1.Register(newRecordingClient("b")); err == nil {
+				t.Fatal("registering a client ID claimed by the other node succeeded")
+			}
+
+			if err := n1.SendTo("b", []byte(`"hello b"`)); err != nil {
+				t.Fatalf("send to b: %v", err)
+			}
+			eventually(t, "b to receive the relayed message", func() bool { return b.hasReceived(`"hello b"`) })
+
+			if err := n2.Broadcast([]byte(`"everyone"`)); err != nil {
+				t.Fatalf("broadcast: %v", err)
+			}
+			eventually(t, "a to receive the broadcast", func() bool { return a.hasReceived(`"everyone"`) })
+			eventually(t, "b to receive the broadcast", func() bool { return b.hasReceived(`"everyone"`) })
+
+			if err := n1.JoinRoom("r", "a"); err != nil {
+				t.Fatalf("join room: %v", err)
+			}
+			eventually(t, "n2 to see a in the room", func() bool {
+				return slices.Contains(n2.GetRoomMembers("r"), "a")
+			})
+		})
+	}
+}
+
+func TestTCPBackplaneRejectsWrongSecret(t *testing.T) {
+	_, addr := startBroker(t, "127.0.0.1:0", "secret")
+
+	backplane := newTestTCPBackplane(addr, "wrong")
+	err := backplane.Join(context.Background(), "n1", func(BackplaneEvent) {})
+	if err == nil {
+		t.Fatal("joining with a wrong secret succeeded")
+	}
+	if code := domain.ErrorFrom(err).Code; code != domain.ErrorCodeUnauthorized {
+		t.Fatalf("error code = %s, want %s", code, domain.ErrorCodeUnauthorized)
+	}
+}
+
+func TestTCPBackplaneReconnects(t *testing.T) {
+	broker, addr := startBroker(t, "127.0.0.1:0", "secret")
+
+	n1, n2 := twoNodes(t, func() Backplane { return newTestTCPBackplane(addr, "secret") })
+
+	a := newRecordingClient("a")
+	b := newRecordingClient("b")
+	if err := n1.Register(a); err != nil {
+		t.Fatalf("register a: %v", err)
+	}
+	if err := n2.Register(b); err != nil {
+		t.Fatalf("register b: %v", err)
+	}
+	if err := n1.JoinRoom("r", "a"); err != nil {
+		t.Fatalf("join room: %v", err)
+	}
+	eventually(t, "n2 to see a in the room", func() bool {
+		return slices.Contains(n2.GetRoomMembers("r"), "a")
+	})
+
+	broker.Close()
+
+	// Clients that connect while the broker is away are kept locally
+	late := newRecordingClient("late")
+	eventually(t, "n1 to register a client without the broker", func() bool {
+		return n1.Register(late) == nil
+	})
+
+	startBroker(t, addr, "secret")
+
+	eventually(t, "b to be reachable from n1 again", func() bool {
+		n1.SendTo("b", []byte(`"after restart"`))
+		return b.hasReceived(`"after restart"`)
+	})
+	eventually(t, "the late client to be reachable from n2", func() bool {
+		n2.SendTo("late", []byte(`"hello late"`))
+		return late.hasReceived(`"hello late"`)
+	})
+	eventually(t, "n2 to see a in the room again", func() bool {
+		return slices.Contains(n2.GetRoomMembers("r"), "a")
+	})
+}
@@ -0,0 +1,248 @@
+package hub
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/HMasataka/conic/domain"
+	"github.com/HMasataka/conic/internal/protocol"
+	"github.com/HMasataka/conic/internal/transport"
+	ws "github.com/gorilla/websocket"
+)
+
+// plainConnection hides SendPrepared from the hub, so that the connection
+// frames every broadcast itself
+type plainConnection struct {
+	domain.Client
+}
+
+// preparedRecorder keeps the prepared messages the hub hands to a
+// connection
+type preparedRecorder struct {
+	*transport.Connection
+
+	mu       sync.Mutex
+	prepared []*domain.PreparedMessage
+}
+
+func (r *preparedRecorder) SendPrepared(ctx context.Context, message *domain.PreparedMessage) error {
+	r.mu.Lock()
+	r.prepared = append(r.prepared, message)
+	r.mu.Unlock()
+
+	return r.Connection.SendPrepared(ctx, message)
+}
+
+// wsPeers is a hub whose clients are websocket connections to peers in the
+// same process. The peers count the messages they read.
+type wsPeers struct {
+	hub       *Hub
+	server    *httptest.Server
+	peers     []*ws.Conn
+	delivered atomic.Int64
+
+	mu      sync.Mutex
+	clients map[string]domain.Client
+}
+
+// newWSPeers connects a peer for each of subprotocols. wrap chooses the
+// client the hub is given for each server side connection.
+func newWSPeers(tb testing.TB, subprotocols []string, compress bool, wrap func(*transport.Connection) domain.Client) *wsPeers {
+	tb.Helper()
+
+	logger := testLogger()
+	h := NewWithOptions(HubOptions{Logger: logger, SendTimeout: 10 * time.Second})
+	if err := h.Start(context.Background()); err != nil {
+		tb.Fatal(err)
+	}
+
+	options := transport.DefaultConnectionOptions()
+	options.EnableCompression = compress
+	router := protocol.NewRouter(logger)
+	upgrader := ws.Upgrader{
+		EnableCompression: compress,
+		Subprotocols:      transport.CodecSubprotocols(options.Codecs),
+	}
+
+	p := &wsPeers{hub: h, clients: make(map[string]domain.Client)}
+
+	var registered sync.WaitGroup
+	registered.Add(len(subprotocols))
+
+	p.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+
+		connection := transport.NewConnection(conn, router, logger, options)
+		connection.SetID(r.URL.Query().Get("id"))
+
+		client := wrap(connection)
+		if err := h.Register(client); err != nil {
+			tb.Error(err)
+		}
+		p.mu.Lock()
+		p.clients[client.ID()] = client
+		p.mu.Unlock()
+		registered.Done()
+
+		connection.Start(context.Background())
+	}))
+
+	tb.Cleanup(p.close)
+
+	serverURL := "ws" + strings.TrimPrefix(p.server.URL, "http") + "/ws?id=peer-"
+	for i, subprotocol := range subprotocols {
+		dialOptions := transport.DefaultDialOptions()
+		dialOptions.EnableCompression = compress
+		dialOptions.Subprotocols = []string{subprotocol}
+
+		peer, err := transport.Dial(context.Background(), serverURL+strconv.Itoa(i), dialOptions)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		p.peers = append(p.peers, peer)
+
+		go func() {
+			for {
+				_, r, err := peer.NextReader()
+				if err != nil {
+					return
+				}
+				io.Copy(io.Discard, r)
+				p.delivered.Add(1)
+			}
+		}()
+	}
+
+	registered.Wait()
+	return p
+}
+
+func (p *wsPeers) close() {
+	for _, peer := range p.peers {
+		peer.Close()
+	}
+	p.hub.Stop()
+	p.server.Close()
+}
+
+// waitDelivered waits until the peers read want messages in total
+func (p *wsPeers) waitDelivered(want int64) {
+	waitFor(&p.delivered, want)
+}
+
+// presenceMessage is a broadcast about the size of a presence notification
+func presenceMessage() []byte {
+	return []byte(`{"type":"peer_joined","data":{"client_id":"` + strings.Repeat("x", 20) +
+		`","metadata":{"name":"` + strings.Repeat("n", 200) + `"}}}`)
+}
+
+func TestBroadcastFramesOncePerCodec(t *testing.T) {
+	subprotocols := []string{
+		transport.JSONSubprotocol, transport.JSONSubprotocol,
+		transport.MessagePackSubprotocol, transport.MessagePackSubprotocol,
+	}
+	peers := newWSPeers(t, subprotocols, false, func(connection *transport.Connection) domain.Client {
+		return &preparedRecorder{Connection: connection}
+	})
+
+	if err := peers.hub.Broadcast(presenceMessage()); err != nil {
+		t.Fatalf("broadcast: %v", err)
+	}
+	peers.waitDelivered(int64(len(subprotocols)))
+
+	var shared *domain.PreparedMessage
+	for id, client := range peers.clients {
+		recorder := client.(*preparedRecorder)
+		recorder.mu.Lock()
+		prepared := recorder.prepared
+		recorder.mu.Unlock()
+
+		if len(prepared) != 1 {
+			t.Fatalf("%s was sent %d prepared messages, want 1", id, len(prepared))
+		}
+		if shared == nil {
+			shared = prepared[0]
+		}
+		if prepared[0] != shared {
+			t.Fatalf("%s was sent its own prepared message", id)
+		}
+	}
+
+	// Each codec built its frame once and cached it for the other
+	// connections
+	for _, subprotocol := range []string{transport.JSONSubprotocol, transport.MessagePackSubprotocol} {
+		if _, err := shared.Frame(subprotocol, func([]byte) (any, error) {
+			t.Errorf("no frame was built for %s", subprotocol)
+			return nil, nil
+		}); err != nil {
+			t.Fatalf("frame for %s: %v", subprotocol, err)
+		}
+	}
+}
+
+// broadcastCodecs are the client setups the websocket broadcast benchmarks
+// run with
+var broadcastCodecs = []struct {
+	name        string
+	subprotocol string
+	compress    bool
+}{
+	{"json", transport.JSONSubprotocol, false},
+	{"json+deflate", transport.JSONSubprotocol, true},
+	{"msgpack", transport.MessagePackSubprotocol, false},
+}
+
+// benchmarkWebsocketBroadcast measures broadcasting a presence sized message
+// to websocket clients until every peer has read it
+func benchmarkWebsocketBroadcast(b *testing.B, wrap func(*transport.Connection) domain.Client) {
+	for _, codec := range broadcastCodecs {
+		for _, count := range []int{100, 500} {
+			b.Run(codec.name+"/conns="+strconv.Itoa(count), func(b *testing.B) {
+				subprotocols := make([]string, count)
+				for i := range subprotocols {
+					subprotocols[i] = codec.subprotocol
+				}
+				peers := newWSPeers(b, subprotocols, codec.compress, wrap)
+				message := presenceMessage()
+
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if err := peers.hub.Broadcast(message); err != nil {
+						b.Fatal(err)
+					}
+					peers.waitDelivered(int64(i+1) * int64(count))
+				}
+				b.StopTimer()
+
+				reportThroughput(b, peers.delivered.Load())
+			})
+		}
+	}
+}
+
+// BenchmarkBroadcastPrepared shares one frame per codec between the clients
+func BenchmarkBroadcastPrepared(b *testing.B) {
+	benchmarkWebsocketBroadcast(b, func(connection *transport.Connection) domain.Client {
+		return connection
+	})
+}
+
+// BenchmarkBroadcastRaw has every client encode and frame the broadcast
+// itself
+func BenchmarkBroadcastRaw(b *testing.B) {
+	benchmarkWebsocketBroadcast(b, func(connection *transport.Connection) domain.Client {
+		return plainConnection{connection}
+	})
+}
@@ -2,129 +2,329 @@ package hub
 
 import (
 	"context"
-	"errors"
+	"encoding/json"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/HMasataka/conic/domain"
 	"github.com/HMasataka/conic/logging"
+	"github.com/rs/xid"
 )
 
 type HubOptions struct {
 	Logger *logging.Logger
+
+	// Backplane connects the hub to the hubs of other nodes. Nil keeps all
+	// clients in this process.
+	Backplane Backplane
+
+	// NodeID identifies this hub on the backplane. A random ID is used when
+	// empty.
+	NodeID string
+
+	// Mailbox holds messages for clients that have not registered yet. A
+	// zero TTL drops them instead.
+	Mailbox MailboxOptions
+
+	// Shards is the number of independently locked maps the local clients
+	// are spread over. Zero uses 32.
+	Shards int
+
+	// ClientQueueSize is how many messages may wait for each local client.
+	// A client whose queue is full is a slow consumer. Zero uses 256.
+	ClientQueueSize int
+
+	// SendTimeout bounds each send to a client. A client that cannot take a
+	// message in time is a slow consumer. Zero uses 5 seconds.
+	SendTimeout time.Duration
+
+	// SlowConsumer decides what happens to slow consumers. Empty evicts
+	// them.
+	SlowConsumer SlowConsumerAction
 }
 
 type Hub struct {
-	clients    sync.Map // map[string]domain.Client
-	register   chan domain.Client
-	unregister chan string
-	broadcast  chan []byte
-	sendTo     chan sendMessage
-	logger     *logging.Logger
-	ctx        context.Context
-	cancel     context.CancelFunc
-	wg         sync.WaitGroup
+	clients   *clientShards // local clients only
+	rooms     *roomRegistry
+	backplane Backplane
+	nodeID    string
+	mailbox   *mailbox
+	options   HubOptions
+	logger    *logging.Logger
+	ctx       context.Context
+	cancel    context.CancelFunc
+	wg        sync.WaitGroup
 
 	messagesSent     int64
 	messagesReceived int64
+	forwardFailures  int64
+	messagesDropped  int64
+	slowConsumers    int64
+	throttled        throttleCounter
 	startTime        time.Time
 }
 
-type sendMessage struct {
-	clientID string
-	message  []byte
+func New(logger *logging.Logger) *Hub {
+	return NewWithOptions(HubOptions{Logger: logger})
 }
 
-func New(logger *logging.Logger) *Hub {
-	return &Hub{
-		register:   make(chan domain.Client, 100),
-		unregister: make(chan string, 100),
-		broadcast:  make(chan []byte, 1000),
-		sendTo:     make(chan sendMessage, 1000),
-		logger:     logger,
-		startTime:  time.Now(),
+func NewWithOptions(options HubOptions) *Hub {
+	nodeID := options.NodeID
+	if nodeID == "" {
+		nodeID = xid.New().String()
+	}
+
+	if options.Shards <= 0 {
+		options.Shards = 32
+	}
+	if options.ClientQueueSize <= 0 {
+		options.ClientQueueSize = 256
 	}
+	if options.SendTimeout <= 0 {
+		options.SendTimeout = 5 * time.Second
+	}
+	if options.SlowConsumer == "" {
+		options.SlowConsumer = SlowConsumerEvict
+	}
+
+	hub := &Hub{
+		clients:   newClientShards(options.Shards),
+		rooms:     newRoomRegistry(),
+		options:   options,
+		backplane: options.Backplane,
+		nodeID:    nodeID,
+		logger:    options.Logger,
+		startTime: time.Now(),
+	}
+
+	if options.Mailbox.TTL > 0 {
+		hub.mailbox = newMailbox(options.Mailbox, func(clientID string) bool {
+			_, ok := hub.clients.load(clientID)
+			return ok
+		})
+	}
+
+	return hub
 }
 
 func (h *Hub) Start(ctx context.Context) error {
 	h.ctx, h.cancel = context.WithCancel(ctx)
+
+	if h.backplane != nil {
+		if err := h.backplane.Join(h.ctx, h.nodeID, h.handleBackplaneEvent); err != nil {
+			h.cancel()
+			return err
+		}
+
+		// Catch up on the rooms of clients on the other nodes
+		h.publish(BackplaneEvent{Type: BackplaneSync})
+	}
+
 	h.wg.Add(1)
 	go h.run()
-	h.logger.Info("hub started")
+	h.logger.Info("hub started", "node_id", h.nodeID)
 	return nil
 }
 
+// NodeID returns the ID of the hub on the backplane
+func (h *Hub) NodeID() string {
+	return h.nodeID
+}
+
 func (h *Hub) Stop() error {
 	h.logger.Info("stopping hub")
 	h.cancel()
 	h.wg.Wait()
 
-	h.clients.Range(func(key, value any) bool {
-		if client, ok := value.(domain.Client); ok {
-			client.Close()
-		}
+	h.clients.each(func(client *queuedClient) bool {
+		client.current().Close()
 		return true
 	})
 
-	close(h.register)
-	close(h.unregister)
-	close(h.broadcast)
-	close(h.sendTo)
+	if h.backplane != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		if err := h.backplane.Leave(ctx, h.nodeID); err != nil {
+			h.logger.Error("failed to leave backplane", "error", err)
+		}
+		cancel()
+	}
 
 	h.logger.Info("hub stopped")
 	return nil
 }
 
+// Register stores the client synchronously so that a client ID can only be
+// claimed by one connection at a time
 func (h *Hub) Register(client domain.Client) error {
-	select {
-	case h.register <- client:
-		return nil
-	case <-h.ctx.Done():
-		return errors.New("hub context cancelled during registration")
-	default:
-		return errors.New("registration channel is full")
+	if h.ctx.Err() != nil {
+		return domain.NewError(domain.ErrorCodeUnavailable, "hub context cancelled during registration")
+	}
+
+	clientID := client.ID()
+	queued := newQueuedClient(client, h.options.ClientQueueSize)
+	held, stored := h.storeClient(queued)
+	if !stored {
+		h.logger.Warn("client already registered", "client_id", clientID)
+		return domain.NewError(domain.ErrorCodeAlreadyRegistered, "client already registered: "+clientID)
+	}
+
+	if h.backplane != nil {
+		err := h.backplane.Claim(h.ctx, clientID, h.nodeID)
+		switch {
+		case err == nil:
+			h.publish(BackplaneEvent{Type: BackplaneRegister, ClientID: clientID})
+		case domain.ErrorFrom(err).Code == domain.ErrorCodeUnavailable:
+			// The client is claimed once the backplane is back
+			h.logger.Warn("backplane unavailable, registering client locally", "client_id", clientID, "error", err)
+		default:
+			h.clients.delete(clientID)
+			if h.mailbox != nil {
+				h.mailbox.restore(clientID, held)
+			}
+			h.logger.Warn("client ID claimed by another node", "client_id", clientID, "error", err)
+			return err
+		}
 	}
+
+	h.wg.Add(1)
+	go h.write(queued)
+
+	h.logger.Info("client registered",
+		"client_id", clientID,
+		"total_clients", h.getClientCount(),
+		"held_messages", len(held),
+	)
+	return nil
 }
 
+// Replace swaps the connection registered under client.ID() for client
+// without unregistering, so rooms, presence, the backplane claim and the
+// queued messages are kept
+func (h *Hub) Replace(client domain.Client) error {
+	clientID := client.ID()
+	queued, ok := h.clients.load(clientID)
+	if !ok {
+		return domain.NewError(domain.ErrorCodeNotRegistered, "client not registered: "+clientID)
+	}
+	queued.replace(client)
+
+	h.logger.Debug("client connection replaced", "client_id", clientID)
+	return nil
+}
+
+// Unregister removes clientID from the hub, its rooms and the backplane. The
+// connection is left open so that it can register again; the hub closes
+// clients only when it stops or evicts them.
 func (h *Hub) Unregister(clientID string) error {
-	select {
-	case h.unregister <- clientID:
-		return nil
-	case <-h.ctx.Done():
-		return errors.New("hub context cancelled during unregistration")
-	default:
-		return errors.New("unregistration channel is full")
+	if h.ctx.Err() != nil {
+		return domain.NewError(domain.ErrorCodeUnavailable, "hub context cancelled during unregistration")
 	}
+
+	h.handleUnregister(clientID)
+	return nil
 }
 
 func (h *Hub) Broadcast(message []byte) error {
-	select {
-	case h.broadcast <- message:
-		atomic.AddInt64(&h.messagesReceived, 1)
-		return nil
-	case <-h.ctx.Done():
-		return errors.New("hub context cancelled during broadcast")
-	default:
-		return errors.New("broadcast channel is full")
+	h.publish(BackplaneEvent{Type: BackplaneBroadcast, Message: message})
+
+	if err := h.broadcastLocal(message); err != nil {
+		return err
+	}
+
+	atomic.AddInt64(&h.messagesReceived, 1)
+	return nil
+}
+
+// broadcastLocal queues message for every local client. The clients share
+// one prepared message. Clients that are not keeping up miss it without
+// holding up the others.
+func (h *Hub) broadcastLocal(message []byte) error {
+	if h.ctx.Err() != nil {
+		return domain.NewError(domain.ErrorCodeUnavailable, "hub context cancelled during broadcast")
 	}
+
+	prepared := outbound{prepared: domain.NewPreparedMessage(message)}
+
+	var queuedCount, errorCount int
+	h.clients.each(func(client *queuedClient) bool {
+		if err := h.deliver(client, prepared); err != nil {
+			errorCount++
+			atomic.AddInt64(&h.forwardFailures, 1)
+		} else {
+			queuedCount++
+		}
+		return true
+	})
+
+	h.logger.Debug("broadcast queued",
+		"queued_count", queuedCount,
+		"error_count", errorCount,
+	)
+	return nil
 }
 
+// SendTo queues message for a local client, or publishes it to the node
+// the client is connected to. Messages for unknown clients are held in the
+// mailbox when it is enabled.
 func (h *Hub) SendTo(clientID string, message []byte) error {
-	select {
-	case h.sendTo <- sendMessage{clientID: clientID, message: message}:
-		atomic.AddInt64(&h.messagesReceived, 1)
-		return nil
-	case <-h.ctx.Done():
-		return errors.New("hub context cancelled during send")
-	default:
-		return errors.New("send channel is full")
+	return h.sendTo(clientID, outbound{data: message})
+}
+
+func (h *Hub) sendTo(clientID string, message outbound) error {
+	if err := h.route(clientID, message, true); err != nil {
+		atomic.AddInt64(&h.forwardFailures, 1)
+		return err
 	}
+
+	atomic.AddInt64(&h.messagesReceived, 1)
+	return nil
 }
 
+// route delivers message to clientID wherever it is connected. hold allows
+// the message to wait in the mailbox when the client is unknown.
+func (h *Hub) route(clientID string, message outbound, hold bool) error {
+	if client, local := h.clients.load(clientID); local {
+		return h.deliver(client, message)
+	}
+
+	if h.backplane != nil {
+		if client, ok := h.remoteClient(clientID); ok {
+			return client.Send(h.ctx, message.bytes())
+		}
+	}
+
+	if hold && h.mailbox != nil {
+		return h.hold(clientID, message)
+	}
+
+	return domain.NewError(domain.ErrorCodeNotFound, "client not found: "+clientID)
+}
+
+// sendToLocal queues message for a local client. Messages for clients that
+// already left are held in the mailbox when it is enabled.
+func (h *Hub) sendToLocal(clientID string, message []byte) error {
+	client, ok := h.clients.load(clientID)
+	if !ok {
+		if h.mailbox != nil {
+			return h.hold(clientID, outbound{data: message})
+		}
+		return domain.NewError(domain.ErrorCodeNotFound, "client not found: "+clientID)
+	}
+
+	return h.deliver(client, outbound{data: message})
+}
+
+// SendToMultiple sends message to each of clientIDs. The local clients share
+// one prepared message.
 func (h *Hub) SendToMultiple(clientIDs []string, message []byte) error {
+	prepared := outbound{data: message}
+	if len(clientIDs) > 1 {
+		prepared = outbound{prepared: domain.NewPreparedMessage(message)}
+	}
+
 	for _, clientID := range clientIDs {
-		if err := h.SendTo(clientID, message); err != nil {
+		if err := h.sendTo(clientID, prepared); err != nil {
 			h.logger.Error("failed to send to client",
 				"client_id", clientID,
 				"error", err,
@@ -134,143 +334,228 @@ func (h *Hub) SendToMultiple(clientIDs []string, message []byte) error {
 	return nil
 }
 
+// GetClient returns a local client, or a stand-in for a client connected to
+// another node
 func (h *Hub) GetClient(clientID string) (domain.Client, bool) {
-	if value, ok := h.clients.Load(clientID); ok {
-		return value.(domain.Client), true
+	if client, ok := h.clients.load(clientID); ok {
+		return client.current(), true
 	}
+
+	if h.backplane != nil {
+		return h.remoteClient(clientID)
+	}
+
 	return nil, false
 }
 
+// GetClients returns the local clients followed by stand-ins for the clients
+// of other nodes
 func (h *Hub) GetClients() []domain.Client {
 	var clients []domain.Client
-	h.clients.Range(func(key, value interface{}) bool {
-		if client, ok := value.(domain.Client); ok {
-			clients = append(clients, client)
-		}
+	h.clients.each(func(client *queuedClient) bool {
+		clients = append(clients, client.current())
 		return true
 	})
+
+	if h.backplane != nil {
+		clients = append(clients, h.remoteClients()...)
+	}
+
 	return clients
 }
 
-func (h *Hub) run() {
-	defer h.wg.Done()
+func (h *Hub) JoinRoom(roomID, clientID string) error {
+	if roomID == "" {
+		return domain.NewError(domain.ErrorCodeInvalidMessage, "room ID is empty")
+	}
 
-	for {
-		select {
-		case <-h.ctx.Done():
-			return
+	if _, ok := h.GetClient(clientID); !ok {
+		return domain.NewError(domain.ErrorCodeNotRegistered, "client not registered: "+clientID)
+	}
 
-		case client := <-h.register:
-			h.handleRegister(client)
+	if !h.rooms.join(roomID, clientID) {
+		return nil
+	}
 
-		case clientID := <-h.unregister:
-			h.handleUnregister(clientID)
+	h.logger.Info("client joined room",
+		"room_id", roomID,
+		"client_id", clientID,
+	)
 
-		case message := <-h.broadcast:
-			h.handleBroadcast(message)
+	h.publish(BackplaneEvent{Type: BackplaneJoinRoom, ClientID: clientID, RoomID: roomID})
 
-		case msg := <-h.sendTo:
-			h.handleSendTo(msg.clientID, msg.message)
-		}
-	}
+	h.notifyRoom(domain.MessageTypeRoomMemberJoined, roomID, clientID)
+	return nil
 }
 
-func (h *Hub) handleRegister(client domain.Client) {
-	clientID := client.ID()
-
-	// Check if client already exists
-	if _, exists := h.clients.Load(clientID); exists {
-		h.logger.Warn("client already registered", "client_id", clientID)
-		return
+func (h *Hub) LeaveRoom(roomID, clientID string) error {
+	if !h.rooms.leave(roomID, clientID) {
+		return domain.NewError(domain.ErrorCodeNotFound, "client is not a member of room: "+roomID)
 	}
 
-	// Store client
-	h.clients.Store(clientID, client)
-
-	h.logger.Info("client registered",
+	h.logger.Info("client left room",
+		"room_id", roomID,
 		"client_id", clientID,
-		"total_clients", h.getClientCount(),
 	)
+
+	h.publish(BackplaneEvent{Type: BackplaneLeaveRoom, ClientID: clientID, RoomID: roomID})
+
+	h.notifyRoom(domain.MessageTypeRoomMemberLeft, roomID, clientID)
+	return nil
 }
 
-func (h *Hub) handleUnregister(clientID string) {
-	if client, ok := h.clients.LoadAndDelete(clientID); ok {
-		// Close client connection
-		if c, ok := client.(domain.Client); ok {
-			c.Close()
-		}
+func (h *Hub) SendToRoom(roomID string, message []byte) error {
+	members := h.rooms.members(roomID)
+	if len(members) == 0 {
+		return domain.NewError(domain.ErrorCodeNotFound, "room not found: "+roomID)
+	}
 
-		h.logger.Info("client unregistered",
-			"client_id", clientID,
-			"total_clients", h.getClientCount(),
-		)
+	return h.SendToMultiple(members, message)
+}
+
+func (h *Hub) BroadcastToRoom(roomID, senderID string, message []byte) error {
+	members := h.rooms.members(roomID)
+	if len(members) == 0 {
+		return domain.NewError(domain.ErrorCodeNotFound, "room not found: "+roomID)
 	}
+
+	return h.SendToMultiple(without(members, senderID), message)
 }
 
-func (h *Hub) handleBroadcast(message []byte) {
-	var successCount, errorCount int
+func (h *Hub) GetRoomMembers(roomID string) []string {
+	return h.rooms.members(roomID)
+}
 
-	h.clients.Range(func(key, value interface{}) bool {
-		if client, ok := value.(domain.Client); ok {
-			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-			err := client.Send(ctx, message)
-			cancel()
+func (h *Hub) GetClientRooms(clientID string) []string {
+	return h.rooms.roomsOf(clientID)
+}
 
-			if err != nil {
-				errorCount++
-				h.logger.Error("failed to send to client",
-					"client_id", client.ID(),
-					"error", err,
-				)
-			} else {
-				successCount++
-				atomic.AddInt64(&h.messagesSent, 1)
-			}
+// notifyRoom tells the remaining local members of a room that clientID joined
+// or left. Every node notifies its own clients, so that room events reach
+// each member once even when they are relayed over the backplane.
+func (h *Hub) notifyRoom(eventType domain.MessageType, roomID, clientID string) {
+	var recipients []string
+	for _, memberID := range without(h.rooms.members(roomID), clientID) {
+		if _, local := h.clients.load(memberID); local {
+			recipients = append(recipients, memberID)
 		}
-		return true
+	}
+
+	if len(recipients) == 0 {
+		return
+	}
+
+	msg, err := domain.NewMessage(eventType, domain.RoomMemberEvent{
+		RoomID:   roomID,
+		ClientID: clientID,
 	})
+	if err != nil {
+		h.logger.Error("failed to create room event", "room_id", roomID, "error", err)
+		return
+	}
 
-	h.logger.Debug("broadcast complete",
-		"success_count", successCount,
-		"error_count", errorCount,
-	)
+	data, err := json.Marshal(msg)
+	if err != nil {
+		h.logger.Error("failed to marshal room event", "room_id", roomID, "error", err)
+		return
+	}
+
+	h.SendToMultiple(recipients, data)
 }
 
-func (h *Hub) handleSendTo(clientID string, message []byte) {
-	client, ok := h.GetClient(clientID)
-	if !ok {
-		h.logger.Warn("client not found", "client_id", clientID)
-		return
+func without(ids []string, excluded string) []string {
+	result := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if id != excluded {
+			result = append(result, id)
+		}
 	}
+	return result
+}
+
+// run expires held messages. Messages are sent by the writer of each client.
+func (h *Hub) run() {
+	defer h.wg.Done()
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	err := client.Send(ctx, message)
-	cancel()
+	// A nil channel never fires, which disables expiry without a mailbox
+	var expire <-chan time.Time
+	if h.mailbox != nil {
+		ticker := time.NewTicker(min(h.mailbox.options.TTL, time.Second))
+		defer ticker.Stop()
+		expire = ticker.C
+	}
 
-	if err != nil {
-		h.logger.Error("failed to send to client",
+	for {
+		select {
+		case <-h.ctx.Done():
+			return
+
+		case now := <-expire:
+			h.expireMail(now)
+		}
+	}
+}
+
+func (h *Hub) handleUnregister(clientID string) {
+	if client, ok := h.clients.delete(clientID); ok {
+		client.close()
+
+		for _, roomID := range h.rooms.leaveAll(clientID) {
+			h.notifyRoom(domain.MessageTypeRoomMemberLeft, roomID, clientID)
+		}
+
+		if h.backplane != nil {
+			if err := h.backplane.Release(context.Background(), clientID, h.nodeID); err != nil {
+				h.logger.Error("failed to release client on backplane", "client_id", clientID, "error", err)
+			}
+			h.publish(BackplaneEvent{Type: BackplaneUnregister, ClientID: clientID})
+		}
+
+		h.logger.Info("client unregistered",
 			"client_id", clientID,
-			"error", err,
+			"total_clients", h.getClientCount(),
 		)
-	} else {
-		atomic.AddInt64(&h.messagesSent, 1)
 	}
 }
 
 func (h *Hub) getClientCount() int {
-	count := 0
-	h.clients.Range(func(key, value interface{}) bool {
-		count++
+	return h.clients.count()
+}
+
+// queuedMessages returns how many messages wait in the client queues
+func (h *Hub) queuedMessages() int {
+	total := 0
+	h.clients.each(func(client *queuedClient) bool {
+		total += len(client.queue)
 		return true
 	})
-	return count
+	return total
 }
 
 func (h *Hub) GetStats() domain.HubStats {
-	return domain.HubStats{
+	stats := domain.HubStats{
 		ConnectedClients: h.getClientCount(),
+		Rooms:            h.rooms.count(),
 		MessagesSent:     atomic.LoadInt64(&h.messagesSent),
 		MessagesReceived: atomic.LoadInt64(&h.messagesReceived),
+		ForwardFailures:  atomic.LoadInt64(&h.forwardFailures),
+		MessagesDropped:  atomic.LoadInt64(&h.messagesDropped),
+		SlowConsumers:    atomic.LoadInt64(&h.slowConsumers),
+		SendQueue:        h.queuedMessages(),
 		Uptime:           time.Since(h.startTime).Seconds(),
 	}
+
+	stats.MessagesThrottled, stats.ThrottledByType = h.throttled.snapshot()
+
+	if h.mailbox != nil {
+		stats.MessagesHeld = h.mailbox.count()
+	}
+
+	return stats
+}
+
+// RecordThrottled counts a message that a connection dropped for exceeding
+// its rate limit. It can be used as transport.ConnectionOptions.OnThrottled.
+func (h *Hub) RecordThrottled(messageType domain.MessageType) {
+	h.throttled.add(messageType)
 }
@@ -0,0 +1,143 @@
+package hub
+
+import (
+	"context"
+	"math/rand/v2"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// benchClientCounts are the numbers of clients the hub benchmarks run with
+var benchClientCounts = []int{100, 1000, 5000}
+
+// benchClient counts the messages it is sent. A slow client takes delay for
+// each message, like a peer on a congested link.
+type benchClient struct {
+	id        string
+	delay     time.Duration
+	delivered *atomic.Int64
+}
+
+func (c *benchClient) ID() string {
+	return c.id
+}
+
+func (c *benchClient) Send(ctx context.Context, message []byte) error {
+	if c.delay > 0 {
+		select {
+		case <-time.After(c.delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	c.delivered.Add(1)
+	return nil
+}
+
+func (c *benchClient) Close() error {
+	return nil
+}
+
+// benchHub starts a hub with count fast clients, and a slow one when slow is
+// set. It returns the hub and the counter of messages the fast clients got.
+func benchHub(b *testing.B, count int, slow bool, action SlowConsumerAction) (*Hub, *atomic.Int64) {
+	b.Helper()
+
+	h := NewWithOptions(HubOptions{
+		Logger:       testLogger(),
+		SendTimeout:  time.Second,
+		SlowConsumer: action,
+	})
+	if err := h.Start(context.Background()); err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { h.Stop() })
+
+	delivered := &atomic.Int64{}
+	for i := 0; i < count; i++ {
+		if err := h.Register(&benchClient{id: "client-" + strconv.Itoa(i), delivered: delivered}); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	if slow {
+		slowClient := &benchClient{id: "slow", delay: 100 * time.Millisecond, delivered: &atomic.Int64{}}
+		if err := h.Register(slowClient); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	return h, delivered
+}
+
+// waitFor spins until delivered reaches want
+func waitFor(delivered *atomic.Int64, want int64) {
+	for delivered.Load() < want {
+		time.Sleep(50 * time.Microsecond)
+	}
+}
+
+// reportThroughput reports the messages delivered per second
+func reportThroughput(b *testing.B, delivered int64) {
+	b.ReportMetric(float64(delivered)/b.Elapsed().Seconds(), "msgs/s")
+}
+
+// BenchmarkBroadcast measures broadcasting one message and waiting until
+// every fast client has it, with and without a slow client being evicted
+func BenchmarkBroadcast(b *testing.B) {
+	message := []byte(`{"type":"notice","data":{"text":"benchmark"}}`)
+
+	for _, count := range benchClientCounts {
+		for _, slow := range []bool{false, true} {
+			name := "clients=" + strconv.Itoa(count)
+			if slow {
+				name += "/slow"
+			}
+
+			b.Run(name, func(b *testing.B) {
+				h, delivered := benchHub(b, count, slow, SlowConsumerEvict)
+
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if err := h.Broadcast(message); err != nil {
+						b.Fatal(err)
+					}
+					waitFor(delivered, int64(i+1)*int64(count))
+				}
+				b.StopTimer()
+
+				reportThroughput(b, delivered.Load())
+				b.ReportMetric(float64(h.GetStats().SlowConsumers), "evicted")
+			})
+		}
+	}
+}
+
+// BenchmarkSendTo measures addressed messages to random clients sent from
+// parallel goroutines, including their delivery
+func BenchmarkSendTo(b *testing.B) {
+	message := []byte(`{"type":"sdp","from_id":"a","to_id":"b","data":{}}`)
+
+	for _, count := range benchClientCounts {
+		b.Run("clients="+strconv.Itoa(count), func(b *testing.B) {
+			h, delivered := benchHub(b, count, false, SlowConsumerDrop)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					h.SendTo("client-"+strconv.Itoa(rand.IntN(count)), message)
+				}
+			})
+			// Messages dropped for a full queue are not waited for
+			stats := h.GetStats()
+			waitFor(delivered, int64(b.N)-stats.ForwardFailures-stats.MessagesDropped)
+			b.StopTimer()
+
+			reportThroughput(b, delivered.Load())
+		})
+	}
+}
@@ -0,0 +1,131 @@
+package hub
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/HMasataka/conic/logging"
+)
+
+// recordingClient is a client that keeps every message it is sent
+type recordingClient struct {
+	id string
+
+	mu       sync.Mutex
+	messages []string
+	closed   bool
+}
+
+func newRecordingClient(id string) *recordingClient {
+	return &recordingClient{id: id}
+}
+
+func (c *recordingClient) ID() string {
+	return c.id
+}
+
+func (c *recordingClient) Send(ctx context.Context, message []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.messages = append(c.messages, string(message))
+	return nil
+}
+
+func (c *recordingClient) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.closed = true
+	return nil
+}
+
+func (c *recordingClient) received() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return append([]string(nil), c.messages...)
+}
+
+func (c *recordingClient) isClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.closed
+}
+
+func (c *recordingClient) hasReceived(message string) bool {
+	for _, received := range c.received() {
+		if received == message {
+			return true
+		}
+	}
+	return false
+}
+
+func testLogger() *logging.Logger {
+	return logging.New(logging.Config{Level: "error"})
+}
+
+// startHub starts a hub with options and stops it when the test ends
+func startHub(t *testing.T, options HubOptions) *Hub {
+	t.Helper()
+
+	if options.Logger == nil {
+		options.Logger = testLogger()
+	}
+
+	h := NewWithOptions(options)
+	if err := h.Start(context.Background()); err != nil {
+		t.Fatalf("failed to start hub: %v", err)
+	}
+	t.Cleanup(func() { h.Stop() })
+
+	return h
+}
+
+// eventually fails the test unless condition holds within a few seconds
+func eventually(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestUnregisterKeepsConnectionOpen(t *testing.T) {
+	h := NewWithOptions(HubOptions{Logger: testLogger()})
+	if err := h.Start(context.Background()); err != nil {
+		t.Fatalf("failed to start hub: %v", err)
+	}
+
+	client := newRecordingClient("a")
+	if err := h.Register(client); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	if err := h.Unregister("a"); err != nil {
+		t.Fatalf("unregister: %v", err)
+	}
+	if _, ok := h.GetClient("a"); ok {
+		t.Fatal("the client is still registered")
+	}
+	if client.isClosed() {
+		t.Fatal("Unregister closed the connection")
+	}
+
+	// The same connection may register again, and is closed when the hub
+	// stops
+	if err := h.Register(client); err != nil {
+		t.Fatalf("register again: %v", err)
+	}
+	h.Stop()
+	if !client.isClosed() {
+		t.Fatal("Stop left the connection open")
+	}
+}
@@ -0,0 +1,302 @@
+package hub
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/HMasataka/conic/domain"
+)
+
+// MailboxOptions configures how messages for clients that are not connected
+// are held until they register
+type MailboxOptions struct {
+	// TTL is how long a message waits for its recipient. Zero disables the
+	// mailbox.
+	TTL time.Duration
+
+	// MaxMessages limits the messages waiting for a single recipient
+	MaxMessages int
+
+	// MaxBytes limits the total size of the messages waiting for a single
+	// recipient
+	MaxBytes int
+
+	// MaxRecipients limits how many recipients may have messages waiting
+	MaxRecipients int
+}
+
+func DefaultMailboxOptions() MailboxOptions {
+	return MailboxOptions{
+		TTL:           30 * time.Second,
+		MaxMessages:   64,
+		MaxBytes:      256 * 1024, // 256KB
+		MaxRecipients: 10000,
+	}
+}
+
+// mail is a message waiting for its recipient
+type mail struct {
+	data        []byte
+	messageID   string
+	messageType domain.MessageType
+	fromID      string
+	toID        string
+	expires     time.Time
+}
+
+// errRecipientRegistered is returned by put for a recipient that registered
+// after it was looked up
+var errRecipientRegistered = errors.New("recipient registered")
+
+// mailbox holds addressed messages for recipients that have not registered
+// yet, in the order they were sent
+type mailbox struct {
+	options MailboxOptions
+	mu      sync.Mutex
+	boxes   map[string][]mail
+	sizes   map[string]int
+
+	// registered reports whether a client is registered. put checks it under
+	// the lock claim registers clients with, so that no message is held for
+	// a registered client.
+	registered func(clientID string) bool
+}
+
+func newMailbox(options MailboxOptions, registered func(clientID string) bool) *mailbox {
+	return &mailbox{
+		options:    options,
+		boxes:      make(map[string][]mail),
+		sizes:      make(map[string]int),
+		registered: registered,
+	}
+}
+
+// envelope is the part of a message the mailbox needs to hold it
+type envelope struct {
+	ID     string             `json:"id"`
+	Type   domain.MessageType `json:"type"`
+	FromID string             `json:"from_id"`
+}
+
+// put holds data for clientID. Only messages with a sender are held, so that
+// the sender can be told if they expire.
+func (m *mailbox) put(clientID string, data []byte, now time.Time) error {
+	var env envelope
+	if err := json.Unmarshal(data, &env); err != nil || env.FromID == "" {
+		return domain.NewError(domain.ErrorCodeNotFound, "client not found: "+clientID)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.registered(clientID) {
+		return errRecipientRegistered
+	}
+
+	box, exists := m.boxes[clientID]
+	if !exists && m.options.MaxRecipients > 0 && len(m.boxes) >= m.options.MaxRecipients {
+		return domain.NewError(domain.ErrorCodeUnavailable, "too many offline recipients")
+	}
+
+	if m.options.MaxMessages > 0 && len(box) >= m.options.MaxMessages {
+		return domain.NewError(domain.ErrorCodeUnavailable, "mailbox of "+clientID+" is full ("+strconv.Itoa(len(box))+" messages)")
+	}
+
+	if m.options.MaxBytes > 0 && m.sizes[clientID]+len(data) > m.options.MaxBytes {
+		return domain.NewError(domain.ErrorCodeUnavailable, "mailbox of "+clientID+" is full")
+	}
+
+	m.boxes[clientID] = append(box, mail{
+		data:        data,
+		messageID:   env.ID,
+		messageType: env.Type,
+		fromID:      env.FromID,
+		toID:        clientID,
+		expires:     now.Add(m.options.TTL),
+	})
+	m.sizes[clientID] += len(data)
+
+	return nil
+}
+
+// take removes and returns the messages waiting for clientID
+func (m *mailbox) take(clientID string) []mail {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	box := m.boxes[clientID]
+	delete(m.boxes, clientID)
+	delete(m.sizes, clientID)
+
+	return box
+}
+
+// claim hands the messages waiting for clientID to register, which queues
+// them and registers the client. They are removed and returned when it
+// succeeds.
+func (m *mailbox) claim(clientID string, register func(held []mail) bool) ([]mail, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	box := m.boxes[clientID]
+	if !register(box) {
+		return nil, false
+	}
+	delete(m.boxes, clientID)
+	delete(m.sizes, clientID)
+
+	return box, true
+}
+
+// restore holds the messages claim returned again, ahead of any held since,
+// for a client whose registration was undone
+func (m *mailbox) restore(clientID string, held []mail) {
+	if len(held) == 0 {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.boxes[clientID] = append(held, m.boxes[clientID]...)
+	for _, held := range held {
+		m.sizes[clientID] += len(held.data)
+	}
+}
+
+// expire removes and returns the messages whose TTL has passed
+func (m *mailbox) expire(now time.Time) []mail {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var expired []mail
+	for clientID, box := range m.boxes {
+		// Messages are held in order, so the expired ones are a prefix
+		n := 0
+		for n < len(box) && !now.Before(box[n].expires) {
+			m.sizes[clientID] -= len(box[n].data)
+			n++
+		}
+
+		if n == 0 {
+			continue
+		}
+
+		expired = append(expired, box[:n]...)
+		if n == len(box) {
+			delete(m.boxes, clientID)
+			delete(m.sizes, clientID)
+		} else {
+			m.boxes[clientID] = box[n:]
+		}
+	}
+
+	return expired
+}
+
+func (m *mailbox) count() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	total := 0
+	for _, box := range m.boxes {
+		total += len(box)
+	}
+	return total
+}
+
+// storeClient adds client to the local clients unless its ID is taken. The
+// messages held for it are queued first, so that they are sent ahead of any
+// message routed to it once it can be found.
+func (h *Hub) storeClient(client *queuedClient) ([]mail, bool) {
+	if h.mailbox == nil {
+		return nil, h.clients.store(client)
+	}
+
+	return h.mailbox.claim(client.id, func(held []mail) bool {
+		if _, exists := h.clients.load(client.id); exists {
+			return false
+		}
+
+		for _, m := range held {
+			if err := h.deliver(client, outbound{data: m.data}); err != nil {
+				h.logger.Error("failed to deliver held message", "client_id", client.id, "message_id", m.messageID, "error", err)
+			}
+		}
+		return h.clients.store(client)
+	})
+}
+
+// deliverMail forwards the messages held for a client that registered on
+// another node, in the order they were sent
+func (h *Hub) deliverMail(clientID string) {
+	if h.mailbox == nil {
+		return
+	}
+
+	held := h.mailbox.take(clientID)
+	for _, m := range held {
+		if err := h.route(clientID, outbound{data: m.data}, false); err != nil {
+			h.logger.Error("failed to deliver held message", "client_id", clientID, "message_id", m.messageID, "error", err)
+		}
+	}
+
+	if len(held) > 0 {
+		h.logger.Info("delivered held messages", "client_id", clientID, "count", len(held))
+	}
+}
+
+// hold keeps message in the mailbox until clientID registers. A client that
+// registered since it was looked up is sent the message instead.
+func (h *Hub) hold(clientID string, message outbound) error {
+	err := h.mailbox.put(clientID, message.bytes(), time.Now())
+	if !errors.Is(err, errRecipientRegistered) {
+		return err
+	}
+
+	if client, ok := h.clients.load(clientID); ok {
+		return h.deliver(client, message)
+	}
+	return domain.NewError(domain.ErrorCodeNotFound, "client not found: "+clientID)
+}
+
+// expireMail drops the held messages whose TTL has passed and tells their
+// senders
+func (h *Hub) expireMail(now time.Time) {
+	for _, m := range h.mailbox.expire(now) {
+		h.logger.Info("held message expired",
+			"message_id", m.messageID,
+			"from", m.fromID,
+			"to", m.toID,
+		)
+
+		if sender, ok := h.GetClient(m.fromID); ok && !domain.ClientSupports(sender, domain.FeatureMailbox) {
+			continue
+		}
+
+		notice, err := domain.NewMessage(domain.MessageTypeMessageExpired, domain.MessageExpired{
+			MessageID: m.messageID,
+			Type:      m.messageType,
+			ToID:      m.toID,
+		})
+		if err != nil {
+			h.logger.Error("failed to create expiry notice", "error", err)
+			continue
+		}
+		notice.ReplyTo = m.messageID
+
+		data, err := json.Marshal(notice)
+		if err != nil {
+			h.logger.Error("failed to marshal expiry notice", "error", err)
+			continue
+		}
+
+		// Notices are not held themselves, so they are lost if the sender left
+		if err := h.route(m.fromID, outbound{data: data}, false); err != nil {
+			h.logger.Debug("failed to send expiry notice", "client_id", m.fromID, "error", err)
+		}
+	}
+}
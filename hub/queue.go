@@ -0,0 +1,248 @@
+package hub
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/HMasataka/conic/domain"
+)
+
+// SlowConsumerAction decides what happens to a client that does not keep up
+// with the messages sent to it
+type SlowConsumerAction string
+
+const (
+	// SlowConsumerEvict closes the client, which then leaves like any other
+	// disconnected client
+	SlowConsumerEvict SlowConsumerAction = "evict"
+	// SlowConsumerDrop drops the oldest queued messages to make room for
+	// new ones, so the client catches up with the latest messages
+	SlowConsumerDrop SlowConsumerAction = "drop"
+)
+
+// busyRetryInterval is how often a writer retries a client that reported
+// domain.ErrClientBusy
+const busyRetryInterval = 10 * time.Millisecond
+
+// outbound is a message queued for a client. Messages fanned out to many
+// clients share one prepared message, so that each wire format is framed
+// once.
+type outbound struct {
+	data     []byte
+	prepared *domain.PreparedMessage
+}
+
+// bytes returns the JSON message
+func (o outbound) bytes() []byte {
+	if o.prepared != nil {
+		return o.prepared.Data()
+	}
+	return o.data
+}
+
+// sendTo sends the message to client
+func (o outbound) sendTo(ctx context.Context, client domain.Client) error {
+	if o.prepared != nil {
+		return domain.SendPrepared(ctx, client, o.prepared)
+	}
+	return client.Send(ctx, o.data)
+}
+
+// queuedClient is a local client with its own outbound queue. A writer
+// goroutine per client drains the queue, so a client that is slow to send
+// holds up only its own messages.
+type queuedClient struct {
+	id    string
+	queue chan outbound
+	stop  chan struct{}
+
+	mu     sync.RWMutex
+	client domain.Client
+
+	stopOnce sync.Once
+	evicted  atomic.Bool
+
+	// fullSince is when the queue was first found full, in Unix
+	// nanoseconds, or zero while messages fit
+	fullSince atomic.Int64
+}
+
+func newQueuedClient(client domain.Client, size int) *queuedClient {
+	return &queuedClient{
+		id:     client.ID(),
+		queue:  make(chan outbound, size),
+		stop:   make(chan struct{}),
+		client: client,
+	}
+}
+
+// current returns the client messages are sent to
+func (q *queuedClient) current() domain.Client {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	return q.client
+}
+
+// replace sends the queued and future messages to client instead. A client
+// evicted as a slow consumer gets a fresh start with its replacement.
+func (q *queuedClient) replace(client domain.Client) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.client = client
+	q.evicted.Store(false)
+}
+
+// enqueue queues message without blocking. It reports false when the queue
+// is full.
+func (q *queuedClient) enqueue(message outbound) bool {
+	select {
+	case q.queue <- message:
+		return true
+	default:
+		return false
+	}
+}
+
+// overflowing reports whether the queue has been full for at least timeout.
+// A queue that fills up in a burst but drains is not overflowing.
+func (q *queuedClient) overflowing(timeout time.Duration) bool {
+	now := time.Now().UnixNano()
+	if q.fullSince.CompareAndSwap(0, now) {
+		return false
+	}
+	return time.Duration(now-q.fullSince.Load()) >= timeout
+}
+
+// close stops the writer. Messages still queued are dropped.
+func (q *queuedClient) close() {
+	q.stopOnce.Do(func() {
+		close(q.stop)
+	})
+}
+
+// deliver queues message for a local client. When the queue is full, the
+// oldest message makes room for it with SlowConsumerDrop. Otherwise it is
+// dropped, and a client whose queue stays full for the send timeout is a
+// slow consumer.
+func (h *Hub) deliver(client *queuedClient, message outbound) error {
+	if client.evicted.Load() {
+		return domain.NewError(domain.ErrorCodeUnavailable, "client is being evicted: "+client.id)
+	}
+
+	if h.options.SlowConsumer == SlowConsumerDrop {
+		h.dropOldest(client, message)
+		return nil
+	}
+
+	if !client.enqueue(message) {
+		if client.overflowing(h.options.SendTimeout) {
+			h.slowConsumer(client, "queue full")
+		}
+		return domain.NewError(domain.ErrorCodeUnavailable, "client is not keeping up: "+client.id)
+	}
+	client.fullSince.Store(0)
+
+	return nil
+}
+
+// dropOldest queues message, dropping the oldest queued messages until it
+// fits
+func (h *Hub) dropOldest(client *queuedClient, message outbound) {
+	for !client.enqueue(message) {
+		select {
+		case <-client.queue:
+			atomic.AddInt64(&h.messagesDropped, 1)
+			h.logger.Debug("dropped oldest message for slow consumer", "client_id", client.id)
+		default:
+		}
+	}
+}
+
+// write sends the queued messages of client until it is unregistered or the
+// hub stops
+func (h *Hub) write(client *queuedClient) {
+	defer h.wg.Done()
+
+	for {
+		select {
+		case <-h.ctx.Done():
+			return
+		case <-client.stop:
+			return
+		case message := <-client.queue:
+			if client.evicted.Load() {
+				atomic.AddInt64(&h.forwardFailures, 1)
+				continue
+			}
+			h.send(client, message)
+		}
+	}
+}
+
+// send writes one message, retrying clients that are busy until the send
+// timeout passes
+func (h *Hub) send(client *queuedClient, message outbound) {
+	ctx, cancel := context.WithTimeout(h.ctx, h.options.SendTimeout)
+	defer cancel()
+
+	for {
+		err := message.sendTo(ctx, client.current())
+		if err == nil {
+			atomic.AddInt64(&h.messagesSent, 1)
+			return
+		}
+
+		if errors.Is(err, domain.ErrClientBusy) {
+			select {
+			case <-time.After(busyRetryInterval):
+				continue
+			case <-ctx.Done():
+			}
+		}
+
+		if h.ctx.Err() != nil {
+			return
+		}
+		atomic.AddInt64(&h.forwardFailures, 1)
+		if ctx.Err() != nil {
+			h.slowConsumer(client, "send timed out")
+			return
+		}
+
+		h.logger.Error("failed to send to client",
+			"client_id", client.id,
+			"error", err,
+		)
+		return
+	}
+}
+
+// slowConsumer applies the slow consumer action to client. Evicted clients
+// are closed once; their messages are dropped until they are unregistered.
+func (h *Hub) slowConsumer(client *queuedClient, reason string) {
+	if h.options.SlowConsumer != SlowConsumerEvict {
+		h.logger.Debug("dropped message for slow consumer", "client_id", client.id, "reason", reason)
+		return
+	}
+
+	if !client.evicted.CompareAndSwap(false, true) {
+		return
+	}
+
+	atomic.AddInt64(&h.slowConsumers, 1)
+	h.logger.Warn("evicting slow consumer",
+		"client_id", client.id,
+		"reason", reason,
+		"queued", len(client.queue),
+	)
+
+	// Close may block on the connection, which must not hold up the sender
+	go func() {
+		if err := client.current().Close(); err != nil {
+			h.logger.Debug("failed to close slow consumer", "client_id", client.id, "error", err)
+		}
+	}()
+}
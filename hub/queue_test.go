@@ -0,0 +1,203 @@
+package hub
+
+import (
+	"context"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// blockingClient blocks in Send until release is closed
+type blockingClient struct {
+	*recordingClient
+	entered chan struct{}
+	release chan struct{}
+}
+
+func newBlockingClient(id string) *blockingClient {
+	return &blockingClient{
+		recordingClient: newRecordingClient(id),
+		entered:         make(chan struct{}, 1),
+		release:         make(chan struct{}),
+	}
+}
+
+func (c *blockingClient) Send(ctx context.Context, message []byte) error {
+	select {
+	case c.entered <- struct{}{}:
+	default:
+	}
+
+	select {
+	case <-c.release:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	return c.recordingClient.Send(ctx, message)
+}
+
+func TestSlowConsumerEvicted(t *testing.T) {
+	h := startHub(t, HubOptions{
+		ClientQueueSize: 2,
+		SendTimeout:     50 * time.Millisecond,
+		SlowConsumer:    SlowConsumerEvict,
+	})
+
+	slow := newBlockingClient("slow")
+	fast := newRecordingClient("fast")
+	if err := h.Register(slow); err != nil {
+		t.Fatalf("register slow: %v", err)
+	}
+	if err := h.Register(fast); err != nil {
+		t.Fatalf("register fast: %v", err)
+	}
+
+	// The fast client keeps up with every message while the slow one falls
+	// behind
+	for i := 0; i < 4; i++ {
+		h.Broadcast([]byte(strconv.Itoa(i)))
+		eventually(t, "the fast client to receive the broadcast", func() bool {
+			return len(fast.received()) == i+1
+		})
+	}
+
+	eventually(t, "the slow client to be evicted", slow.isClosed)
+	if got := h.GetStats().SlowConsumers; got != 1 {
+		t.Fatalf("SlowConsumers = %d, want 1", got)
+	}
+	if err := h.SendTo("slow", []byte("after")); err == nil {
+		t.Fatal("sending to an evicted client succeeded")
+	}
+	if fast.isClosed() {
+		t.Fatal("the fast client was evicted")
+	}
+}
+
+func TestSlowConsumerDropsOldest(t *testing.T) {
+	h := startHub(t, HubOptions{
+		ClientQueueSize: 2,
+		SendTimeout:     5 * time.Second,
+		SlowConsumer:    SlowConsumerDrop,
+	})
+
+	slow := newBlockingClient("slow")
+	if err := h.Register(slow); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+
+	// The first message is being sent while the others queue up
+	if err := h.SendTo("slow", []byte("0")); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	<-slow.entered
+
+	for i := 1; i <= 4; i++ {
+		if err := h.SendTo("slow", []byte(strconv.Itoa(i))); err != nil {
+			t.Fatalf("send %d: %v", i, err)
+		}
+	}
+	close(slow.release)
+
+	want := []string{"0", "3", "4"}
+	eventually(t, "the newest messages to arrive", func() bool {
+		return len(slow.received()) == len(want)
+	})
+	if got := slow.received(); !slices.Equal(got, want) {
+		t.Fatalf("received %v, want %v", got, want)
+	}
+
+	stats := h.GetStats()
+	if stats.MessagesDropped != 2 || stats.ForwardFailures != 0 {
+		t.Fatalf("MessagesDropped = %d, ForwardFailures = %d, want 2 and 0", stats.MessagesDropped, stats.ForwardFailures)
+	}
+	if stats.SlowConsumers != 0 || slow.isClosed() {
+		t.Fatal("the slow client was evicted")
+	}
+}
+
+func TestStatsCountAcceptedMessages(t *testing.T) {
+	h := startHub(t, HubOptions{})
+
+	clients := []*recordingClient{newRecordingClient("a"), newRecordingClient("b"), newRecordingClient("c")}
+	for _, client := range clients {
+		if err := h.Register(client); err != nil {
+			t.Fatalf("register %s: %v", client.id, err)
+		}
+	}
+
+	h.Broadcast([]byte("everyone"))
+	h.SendTo("a", []byte("a"))
+	h.SendToMultiple([]string{"b", "c"}, []byte("b and c"))
+
+	if got := h.GetStats().MessagesReceived; got != 4 {
+		t.Fatalf("MessagesReceived = %d, want 4", got)
+	}
+	eventually(t, "every message to be sent", func() bool {
+		return h.GetStats().MessagesSent == 6
+	})
+}
+
+func TestRegisterQueuesHeldMessagesFirst(t *testing.T) {
+	h := startHub(t, HubOptions{
+		Mailbox:         MailboxOptions{TTL: time.Minute},
+		ClientQueueSize: 100000,
+	})
+
+	message := func(i int) string {
+		return `{"id":"` + strconv.Itoa(i) + `","type":"sdp","from_id":"a","to_id":"b"}`
+	}
+
+	var want []string
+	for i := 0; i < 10; i++ {
+		want = append(want, message(i))
+		if err := h.SendTo("b", []byte(message(i))); err != nil {
+			t.Fatalf("hold %d: %v", i, err)
+		}
+	}
+
+	// Messages sent while b registers are held or queued behind the held
+	// ones, never ahead of them or left in the mailbox. The queue takes
+	// everything the sender manages to send.
+	registered := make(chan struct{})
+	started := make(chan struct{})
+	sent := make(chan int)
+	first := len(want)
+	go func() {
+		i := first
+		for ; i < 100000; i++ {
+			if i == first+1 {
+				close(started)
+			}
+			select {
+			case <-registered:
+				sent <- i
+				return
+			default:
+			}
+			h.SendTo("b", []byte(message(i)))
+		}
+		<-registered
+		sent <- i
+	}()
+	<-started
+
+	client := newRecordingClient("b")
+	if err := h.Register(client); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	close(registered)
+	for i, n := first, <-sent; i < n; i++ {
+		want = append(want, message(i))
+	}
+
+	eventually(t, "every message to arrive", func() bool {
+		return len(client.received()) == len(want)
+	})
+	for i, got := range client.received() {
+		if got != want[i] {
+			t.Fatalf("message %d is %s, want %s", i, got, want[i])
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package hub
+
+import (
+	"context"
+	"time"
+
+	"github.com/HMasataka/conic/domain"
+)
+
+// remoteClient stands in for a client connected to another node. Messages
+// sent to it are relayed over the backplane.
+type remoteClient struct {
+	id     string
+	nodeID string
+	hub    *Hub
+}
+
+func (c *remoteClient) ID() string {
+	return c.id
+}
+
+func (c *remoteClient) Send(ctx context.Context, message []byte) error {
+	return c.hub.backplane.Publish(ctx, BackplaneEvent{
+		Type:     BackplaneSend,
+		NodeID:   c.hub.nodeID,
+		Target:   c.nodeID,
+		ClientID: c.id,
+		Message:  message,
+	})
+}
+
+// Close asks the node the client is connected to to close its connection
+func (c *remoteClient) Close() error {
+	return c.hub.backplane.Publish(c.hub.ctx, BackplaneEvent{
+		Type:     BackplaneClose,
+		NodeID:   c.hub.nodeID,
+		Target:   c.nodeID,
+		ClientID: c.id,
+	})
+}
+
+// backplaneContext bounds a backplane request
+func (h *Hub) backplaneContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(h.ctx, 5*time.Second)
+}
+
+func (h *Hub) remoteClient(clientID string) (domain.Client, bool) {
+	ctx, cancel := h.backplaneContext()
+	defer cancel()
+
+	nodeID, ok, err := h.backplane.Locate(ctx, clientID)
+	if err != nil {
+		h.logger.Error("failed to locate client on backplane", "client_id", clientID, "error", err)
+		return nil, false
+	}
+
+	if !ok || nodeID == h.nodeID {
+		return nil, false
+	}
+
+	return &remoteClient{id: clientID, nodeID: nodeID, hub: h}, true
+}
+
+func (h *Hub) remoteClients() []domain.Client {
+	ctx, cancel := h.backplaneContext()
+	defer cancel()
+
+	directory, err := h.backplane.Clients(ctx)
+	if err != nil {
+		h.logger.Error("failed to list backplane clients", "error", err)
+		return nil
+	}
+
+	var clients []domain.Client
+	for clientID, nodeID := range directory {
+		if nodeID == h.nodeID {
+			continue
+		}
+		clients = append(clients, &remoteClient{id: clientID, nodeID: nodeID, hub: h})
+	}
+
+	return clients
+}
+
+// publish relays event to the other nodes, if there are any
+func (h *Hub) publish(event BackplaneEvent) {
+	if h.backplane == nil {
+		return
+	}
+
+	event.NodeID = h.nodeID
+	if err := h.backplane.Publish(h.ctx, event); err != nil {
+		h.logger.Error("failed to publish backplane event", "type", event.Type, "error", err)
+	}
+}
+
+// rejoin claims the local clients again after the backplane reconnected.
+// The other nodes dropped them while this node was away, and the room
+// memberships of their clients may have changed, so those are fetched anew.
+func (h *Hub) rejoin() {
+	for _, clientID := range h.rooms.clientIDs() {
+		if _, ok := h.clients.load(clientID); !ok {
+			h.rooms.leaveAll(clientID)
+		}
+	}
+
+	h.clients.each(func(client *queuedClient) bool {
+		clientID := client.id
+		if err := h.backplane.Claim(h.ctx, clientID, h.nodeID); err != nil {
+			h.logger.Warn("failed to claim client after rejoining backplane", "client_id", clientID, "error", err)
+			client.current().Close()
+			return true
+		}
+
+		h.publish(BackplaneEvent{Type: BackplaneRegister, ClientID: clientID})
+		for _, roomID := range h.rooms.roomsOf(clientID) {
+			h.publish(BackplaneEvent{Type: BackplaneJoinRoom, ClientID: clientID, RoomID: roomID})
+		}
+		return true
+	})
+
+	h.publish(BackplaneEvent{Type: BackplaneSync})
+	h.logger.Info("rejoined backplane", "node_id", h.nodeID)
+}
+
+// handleBackplaneEvent applies an event published by another node
+func (h *Hub) handleBackplaneEvent(event BackplaneEvent) {
+	switch event.Type {
+	case BackplaneSend:
+		if err := h.sendToLocal(event.ClientID, event.Message); err != nil {
+			h.logger.Error("failed to deliver relayed message", "client_id", event.ClientID, "error", err)
+		}
+
+	case BackplaneBroadcast:
+		if err := h.broadcastLocal(event.Message); err != nil {
+			h.logger.Error("failed to deliver relayed broadcast", "error", err)
+		}
+
+	case BackplaneRegister:
+		h.logger.Debug("client registered on another node", "client_id", event.ClientID, "node_id", event.NodeID)
+		h.deliverMail(event.ClientID)
+
+	case BackplaneUnregister:
+		for _, roomID := range h.rooms.leaveAll(event.ClientID) {
+			h.notifyRoom(domain.MessageTypeRoomMemberLeft, roomID, event.ClientID)
+		}
+		h.logger.Debug("client unregistered on another node", "client_id", event.ClientID, "node_id", event.NodeID)
+
+	case BackplaneJoinRoom:
+		if h.rooms.join(event.RoomID, event.ClientID) {
+			h.notifyRoom(domain.MessageTypeRoomMemberJoined, event.RoomID, event.ClientID)
+		}
+
+	case BackplaneLeaveRoom:
+		if h.rooms.leave(event.RoomID, event.ClientID) {
+			h.notifyRoom(domain.MessageTypeRoomMemberLeft, event.RoomID, event.ClientID)
+		}
+
+	case BackplaneRoomMember:
+		h.rooms.join(event.RoomID, event.ClientID)
+
+	case BackplaneClose:
+		if client, ok := h.clients.load(event.ClientID); ok {
+			client.current().Close()
+		}
+
+	case BackplaneRejoined:
+		h.rejoin()
+
+	case BackplaneSync:
+		h.clients.each(func(client *queuedClient) bool {
+			clientID := client.id
+			for _, roomID := range h.rooms.roomsOf(clientID) {
+				h.publish(BackplaneEvent{
+					Type:     BackplaneRoomMember,
+					Target:   event.NodeID,
+					ClientID: clientID,
+					RoomID:   roomID,
+				})
+			}
+			return true
+		})
+	}
+}
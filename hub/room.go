@@ -0,0 +1,131 @@
+package hub
+
+import (
+	"sort"
+	"sync"
+)
+
+// roomRegistry tracks room membership in both directions so that a client
+// can be removed from all of its rooms when it unregisters.
+type roomRegistry struct {
+	mu      sync.RWMutex
+	rooms   map[string]map[string]struct{} // roomID -> clientIDs
+	clients map[string]map[string]struct{} // clientID -> roomIDs
+}
+
+func newRoomRegistry() *roomRegistry {
+	return &roomRegistry{
+		rooms:   make(map[string]map[string]struct{}),
+		clients: make(map[string]map[string]struct{}),
+	}
+}
+
+// join adds clientID to roomID and reports whether it was not already a member
+func (r *roomRegistry) join(roomID, clientID string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	members, ok := r.rooms[roomID]
+	if !ok {
+		members = make(map[string]struct{})
+		r.rooms[roomID] = members
+	}
+
+	if _, exists := members[clientID]; exists {
+		return false
+	}
+	members[clientID] = struct{}{}
+
+	rooms, ok := r.clients[clientID]
+	if !ok {
+		rooms = make(map[string]struct{})
+		r.clients[clientID] = rooms
+	}
+	rooms[roomID] = struct{}{}
+
+	return true
+}
+
+// leave removes clientID from roomID and reports whether it was a member
+func (r *roomRegistry) leave(roomID, clientID string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.removeLocked(roomID, clientID)
+}
+
+// leaveAll removes clientID from every room and returns the rooms it left
+func (r *roomRegistry) leaveAll(clientID string) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	roomIDs := sortedKeys(r.clients[clientID])
+	for _, roomID := range roomIDs {
+		r.removeLocked(roomID, clientID)
+	}
+
+	return roomIDs
+}
+
+func (r *roomRegistry) removeLocked(roomID, clientID string) bool {
+	members, ok := r.rooms[roomID]
+	if !ok {
+		return false
+	}
+
+	if _, exists := members[clientID]; !exists {
+		return false
+	}
+
+	delete(members, clientID)
+	if len(members) == 0 {
+		delete(r.rooms, roomID)
+	}
+
+	if rooms, ok := r.clients[clientID]; ok {
+		delete(rooms, roomID)
+		if len(rooms) == 0 {
+			delete(r.clients, clientID)
+		}
+	}
+
+	return true
+}
+
+func (r *roomRegistry) members(roomID string) []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return sortedKeys(r.rooms[roomID])
+}
+
+func (r *roomRegistry) roomsOf(clientID string) []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return sortedKeys(r.clients[clientID])
+}
+
+// clientIDs returns the clients that are in at least one room
+func (r *roomRegistry) clientIDs() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return sortedKeys(r.clients)
+}
+
+func (r *roomRegistry) count() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return len(r.rooms)
+}
+
+func sortedKeys[V any](set map[string]V) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,98 @@
+package hub
+
+import "sync"
+
+// clientShards spreads the local clients over independently locked maps, so
+// that registering and looking up clients does not contend on one lock
+type clientShards struct {
+	shards []clientShard
+}
+
+type clientShard struct {
+	mu      sync.RWMutex
+	clients map[string]*queuedClient
+}
+
+func newClientShards(count int) *clientShards {
+	s := &clientShards{shards: make([]clientShard, count)}
+	for i := range s.shards {
+		s.shards[i].clients = make(map[string]*queuedClient)
+	}
+	return s
+}
+
+// shard returns the shard of clientID by its FNV-1a hash
+func (s *clientShards) shard(clientID string) *clientShard {
+	hash := uint32(2166136261)
+	for i := 0; i < len(clientID); i++ {
+		hash ^= uint32(clientID[i])
+		hash *= 16777619
+	}
+	return &s.shards[hash%uint32(len(s.shards))]
+}
+
+func (s *clientShards) load(clientID string) (*queuedClient, bool) {
+	shard := s.shard(clientID)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+
+	client, ok := shard.clients[clientID]
+	return client, ok
+}
+
+// store adds client unless its ID is taken, reporting whether it was added
+func (s *clientShards) store(client *queuedClient) bool {
+	shard := s.shard(client.id)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	if _, ok := shard.clients[client.id]; ok {
+		return false
+	}
+	shard.clients[client.id] = client
+	return true
+}
+
+func (s *clientShards) delete(clientID string) (*queuedClient, bool) {
+	shard := s.shard(clientID)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	client, ok := shard.clients[clientID]
+	if ok {
+		delete(shard.clients, clientID)
+	}
+	return client, ok
+}
+
+// each calls fn for every client until it returns false. Shards are locked
+// one at a time, so clients registering meanwhile may or may not be seen.
+func (s *clientShards) each(fn func(client *queuedClient) bool) {
+	for i := range s.shards {
+		shard := &s.shards[i]
+
+		shard.mu.RLock()
+		clients := make([]*queuedClient, 0, len(shard.clients))
+		for _, client := range shard.clients {
+			clients = append(clients, client)
+		}
+		shard.mu.RUnlock()
+
+		for _, client := range clients {
+			if !fn(client) {
+				return
+			}
+		}
+	}
+}
+
+func (s *clientShards) count() int {
+	total := 0
+	for i := range s.shards {
+		shard := &s.shards[i]
+		shard.mu.RLock()
+		total += len(shard.clients)
+		shard.mu.RUnlock()
+	}
+	return total
+}
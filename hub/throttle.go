@@ -0,0 +1,36 @@
+package hub
+
+import (
+	"maps"
+	"sync"
+
+	"github.com/HMasataka/conic/domain"
+)
+
+// throttleCounter counts messages dropped by connection rate limits
+type throttleCounter struct {
+	mu     sync.Mutex
+	total  int64
+	byType map[domain.MessageType]int64
+}
+
+func (c *throttleCounter) add(messageType domain.MessageType) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.byType == nil {
+		c.byType = make(map[domain.MessageType]int64)
+	}
+
+	c.total++
+	if messageType != "" {
+		c.byType[messageType]++
+	}
+}
+
+func (c *throttleCounter) snapshot() (int64, map[domain.MessageType]int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.total, maps.Clone(c.byType)
+}
@@ -0,0 +1,163 @@
+// Package config loads configuration structs from JSON or YAML files and
+// environment variables.
+package config
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Duration is a time.Duration written as a string such as "30s" in
+// configuration files and environment variables
+type Duration time.Duration
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	parsed, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// LoadFile decodes the JSON or YAML file at path into v, which should hold
+// the defaults. The format is chosen by the extension. Keys that do not
+// match a field of v are rejected.
+func LoadFile(path string, v any) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+	case ".yaml", ".yml":
+		parsed, err := parseYAML(data)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+
+		data, err = json.Marshal(parsed)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	default:
+		return fmt.Errorf("%s: unsupported config format, use .json, .yaml or .yml", path)
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	return nil
+}
+
+// ApplyEnv overrides the fields of the struct v points to with environment
+// variables. A field is named by prefix and the JSON names of the fields
+// leading to it, upper-cased and joined by underscores, such as
+// CONIC_SERVER_ADDR for Server.Addr with the prefix CONIC. Slices of
+// strings are comma separated; other slices and maps are given as JSON.
+func ApplyEnv(prefix string, v any) error {
+	return applyEnv(prefix, reflect.ValueOf(v).Elem(), os.LookupEnv)
+}
+
+var textUnmarshalerType = reflect.TypeFor[encoding.TextUnmarshaler]()
+
+func applyEnv(name string, v reflect.Value, lookup func(string) (string, bool)) error {
+	if v.Kind() == reflect.Struct && !reflect.PointerTo(v.Type()).Implements(textUnmarshalerType) {
+		for i := range v.NumField() {
+			field := v.Type().Field(i)
+			if !field.IsExported() {
+				continue
+			}
+
+			tag, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+			if tag == "-" {
+				continue
+			}
+			if tag == "" {
+				tag = field.Name
+			}
+
+			if err := applyEnv(name+"_"+strings.ToUpper(tag), v.Field(i), lookup); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	value, ok := lookup(name)
+	if !ok {
+		return nil
+	}
+
+	if err := setFromString(v, value); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	return nil
+}
+
+func setFromString(v reflect.Value, value string) error {
+	if unmarshaler, ok := v.Addr().Interface().(encoding.TextUnmarshaler); ok {
+		return unmarshaler.UnmarshalText([]byte(value))
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(value, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		u, err := strconv.ParseUint(value, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(u)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(value, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.String && !strings.HasPrefix(strings.TrimSpace(value), "[") {
+			var items []string
+			for item := range strings.SplitSeq(value, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					items = append(items, item)
+				}
+			}
+			v.Set(reflect.ValueOf(items).Convert(v.Type()))
+			return nil
+		}
+		fallthrough
+	default:
+		return json.Unmarshal([]byte(value), v.Addr().Interface())
+	}
+
+	return nil
+}
@@ -0,0 +1,61 @@
+package config
+
+import (
+	"fmt"
+
+	"gopkg.in/yaml.v3"
+)
+
+// parseYAML parses a YAML document into maps, slices and scalars that can be
+// re-encoded as JSON. An empty document is an empty mapping.
+func parseYAML(data []byte) (any, error) {
+	var value any
+	if err := yaml.Unmarshal(data, &value); err != nil {
+		return nil, err
+	}
+
+	if value == nil {
+		return map[string]any{}, nil
+	}
+
+	return jsonCompatible(value)
+}
+
+// jsonCompatible rejects mappings with keys that are not strings, which YAML
+// allows but JSON cannot hold
+func jsonCompatible(value any) (any, error) {
+	switch value := value.(type) {
+	case map[string]any:
+		for key, item := range value {
+			converted, err := jsonCompatible(item)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", key, err)
+			}
+			value[key] = converted
+		}
+		return value, nil
+
+	case map[any]any:
+		// yaml.v3 only decodes into map[any]any when a key is not a string
+		var key any
+		for key = range value {
+			if _, ok := key.(string); !ok {
+				break
+			}
+		}
+		return nil, fmt.Errorf("yaml: mapping key %v is not a string", key)
+
+	case []any:
+		for i, item := range value {
+			converted, err := jsonCompatible(item)
+			if err != nil {
+				return nil, fmt.Errorf("[%d]: %w", i, err)
+			}
+			value[i] = converted
+		}
+		return value, nil
+
+	default:
+		return value, nil
+	}
+}
@@ -0,0 +1,147 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseYAML(t *testing.T) {
+	tests := []struct {
+		name string
+		yaml string
+		want any
+	}{
+		{
+			name: "empty",
+			yaml: "",
+			want: map[string]any{},
+		},
+		{
+			name: "nested mappings",
+			yaml: "server:\n  addr: \":3000\"\n  tls:\n    cert_file: cert.pem\n",
+			want: map[string]any{
+				"server": map[string]any{
+					"addr": ":3000",
+					"tls":  map[string]any{"cert_file": "cert.pem"},
+				},
+			},
+		},
+		{
+			name: "sequences",
+			yaml: "origins: [a, \"b\"]\nice_servers:\n  - urls: [\"stun:x\"]\n    username: user\n",
+			want: map[string]any{
+				"origins": []any{"a", "b"},
+				"ice_servers": []any{
+					map[string]any{"urls": []any{"stun:x"}, "username": "user"},
+				},
+			},
+		},
+		{
+			name: "quoting",
+			yaml: "plain: a b\nsingle: 'it''s # not a comment'\ndouble: \"tab\\there\"\nnumber: \"50\"\n",
+			want: map[string]any{
+				"plain":  "a b",
+				"single": "it's # not a comment",
+				"double": "tab\there",
+				"number": "50",
+			},
+		},
+		{
+			name: "scalars",
+			yaml: "rate: 50\nratio: 0.5\nenabled: true\nmissing: null\n",
+			want: map[string]any{
+				"rate":    50,
+				"ratio":   0.5,
+				"enabled": true,
+				"missing": nil,
+			},
+		},
+		{
+			name: "comments",
+			yaml: "# leading\nlevel: info # trailing\n\n  # indented\nformat: text\n",
+			want: map[string]any{"level": "info", "format": "text"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseYAML([]byte(tt.yaml))
+			if err != nil {
+				t.Fatalf("parseYAML() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("parseYAML() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseYAMLErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		yaml string
+		// want is part of the error message, when it is checked
+		want string
+	}{
+		{name: "bad indentation", yaml: "a:\n  b: 1\n c: 2\n"},
+		{name: "unclosed quote", yaml: "a: \"open\n"},
+		{name: "unclosed flow sequence", yaml: "a: [1, 2\n"},
+		{name: "tab indentation", yaml: "a:\n\tb: 1\n"},
+		{name: "non-string key", yaml: "name: x\n1: one\n", want: "mapping key 1 is not a string"},
+		{name: "nested non-string key", yaml: "a:\n  b: 1\n  true: yes\n", want: "a: yaml: mapping key true is not a string"},
+		{name: "unhashable key", yaml: "a:\n  [x]: one\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseYAML([]byte(tt.yaml))
+			if err == nil {
+				t.Fatal("parseYAML() succeeded, want an error")
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("parseYAML() error = %q, want it to contain %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadFileYAML(t *testing.T) {
+	type server struct {
+		Addr    string   `json:"addr"`
+		Timeout Duration `json:"timeout"`
+	}
+	type config struct {
+		Server server   `json:"server"`
+		Tags   []string `json:"tags"`
+	}
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	data := "server:\n  timeout: 30s # overrides the default\ntags: [a, b]\n"
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := config{Server: server{Addr: ":3000"}}
+	if err := LoadFile(path, &cfg); err != nil {
+		t.Fatalf("LoadFile() error = %v", err)
+	}
+
+	want := config{
+		Server: server{Addr: ":3000", Timeout: Duration(30 * time.Second)},
+		Tags:   []string{"a", "b"},
+	}
+	if !reflect.DeepEqual(cfg, want) {
+		t.Fatalf("LoadFile() = %+v, want %+v", cfg, want)
+	}
+
+	if err := os.WriteFile(path, []byte("unknown: 1\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := LoadFile(path, &cfg); err == nil {
+		t.Fatal("LoadFile() accepted an unknown key")
+	}
+}
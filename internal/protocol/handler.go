@@ -3,13 +3,11 @@ package protocol
 import (
 	"context"
 	"encoding/json"
-	"time"
 
 	"github.com/HMasataka/conic/domain"
 	webrtcinternal "github.com/HMasataka/conic/internal/webrtc"
 	"github.com/HMasataka/conic/logging"
 	"github.com/pion/webrtc/v4"
-	"github.com/rs/xid"
 )
 
 type RegisterResponseHandler struct {
@@ -50,6 +48,137 @@ func (h *UnregisterResponseHandler) CanHandle(messageType domain.MessageType) bo
 	return messageType == domain.MessageTypeUnregisterResponse
 }
 
+type RoomEventHandler struct {
+	logger *logging.Logger
+}
+
+func NewRoomEventHandler(logger *logging.Logger) *RoomEventHandler {
+	return &RoomEventHandler{
+		logger: logger,
+	}
+}
+
+func (h *RoomEventHandler) Handle(ctx context.Context, msg *domain.Message) (*domain.Message, error) {
+	h.logger.Debug("room event", "type", msg.Type, "data", string(msg.Data))
+	return nil, nil
+}
+
+func (h *RoomEventHandler) CanHandle(messageType domain.MessageType) bool {
+	switch messageType {
+	case domain.MessageTypeJoinRoomResponse,
+		domain.MessageTypeLeaveRoomResponse,
+		domain.MessageTypeRoomMemberJoined,
+		domain.MessageTypeRoomMemberLeft:
+		return true
+	default:
+		return false
+	}
+}
+
+type PeerEventHandler struct {
+	logger *logging.Logger
+}
+
+func NewPeerEventHandler(logger *logging.Logger) *PeerEventHandler {
+	return &PeerEventHandler{
+		logger: logger,
+	}
+}
+
+func (h *PeerEventHandler) Handle(ctx context.Context, msg *domain.Message) (*domain.Message, error) {
+	h.logger.Debug("peer event", "type", msg.Type, "data", string(msg.Data))
+	return nil, nil
+}
+
+func (h *PeerEventHandler) CanHandle(messageType domain.MessageType) bool {
+	switch messageType {
+	case domain.MessageTypePeerJoined,
+		domain.MessageTypePeerLeft,
+		domain.MessageTypeListPeersResponse,
+		domain.MessageTypeMessageExpired:
+		return true
+	default:
+		return false
+	}
+}
+
+type NoticeHandler struct {
+	logger *logging.Logger
+}
+
+func NewNoticeHandler(logger *logging.Logger) *NoticeHandler {
+	return &NoticeHandler{
+		logger: logger,
+	}
+}
+
+func (h *NoticeHandler) Handle(ctx context.Context, msg *domain.Message) (*domain.Message, error) {
+	if msg.Type == domain.MessageTypeServerShutdown {
+		var shutdown domain.ServerShutdown
+		if err := json.Unmarshal(msg.Data, &shutdown); err != nil {
+			return nil, err
+		}
+
+		h.logger.Warn("server shutting down", "reason", shutdown.Reason, "reconnect_after_ms", shutdown.ReconnectAfterMs)
+		return nil, nil
+	}
+
+	var notice domain.Notice
+	if err := json.Unmarshal(msg.Data, &notice); err != nil {
+		return nil, err
+	}
+
+	h.logger.Warn("server notice", "text", notice.Text)
+	return nil, nil
+}
+
+func (h *NoticeHandler) CanHandle(messageType domain.MessageType) bool {
+	switch messageType {
+	case domain.MessageTypeNotice, domain.MessageTypeServerShutdown:
+		return true
+	default:
+		return false
+	}
+}
+
+// ErrorCallback receives error messages reported by the server
+type ErrorCallback func(ctx context.Context, errMsg domain.ErrorMessage)
+
+type ErrorHandler struct {
+	callback ErrorCallback
+	logger   *logging.Logger
+}
+
+func NewErrorHandler(callback ErrorCallback, logger *logging.Logger) *ErrorHandler {
+	return &ErrorHandler{
+		callback: callback,
+		logger:   logger,
+	}
+}
+
+func (h *ErrorHandler) Handle(ctx context.Context, msg *domain.Message) (*domain.Message, error) {
+	var errMsg domain.ErrorMessage
+	if err := json.Unmarshal(msg.Data, &errMsg); err != nil {
+		return nil, err
+	}
+
+	h.logger.Warn("server reported error",
+		"code", errMsg.Code,
+		"message", errMsg.Message,
+		"message_id", errMsg.MessageID,
+	)
+
+	if h.callback != nil {
+		h.callback(ctx, errMsg)
+	}
+
+	return nil, nil
+}
+
+func (h *ErrorHandler) CanHandle(messageType domain.MessageType) bool {
+	return messageType == domain.MessageTypeError
+}
+
 type SessionDescriptionHandler struct {
 	pc     *webrtcinternal.PeerConnection
 	logger *logging.Logger
@@ -73,7 +202,13 @@ func (h *SessionDescriptionHandler) Handle(ctx context.Context, msg *domain.Mess
 		return nil, err
 	}
 
-	h.pc.SetTargetID(sdpMsg.FromID)
+	// Prefer the envelope sender and fall back to the payload for older peers
+	fromID := msg.FromID
+	if fromID == "" {
+		fromID = sdpMsg.FromID
+	}
+
+	h.pc.SetTargetID(fromID)
 
 	if sdpMsg.SessionDescription.Type == webrtc.SDPTypeAnswer {
 		return nil, nil
@@ -84,22 +219,15 @@ func (h *SessionDescriptionHandler) Handle(ctx context.Context, msg *domain.Mess
 		return nil, err
 	}
 
-	data, err := json.Marshal(domain.SDPMessage{
+	response, err := domain.NewAddressedMessage(domain.MessageTypeSDP, h.pc.ID(), fromID, domain.SDPMessage{
 		FromID:             h.pc.ID(),
-		ToID:               sdpMsg.FromID,
+		ToID:               fromID,
 		SessionDescription: answer,
 	})
 	if err != nil {
 		return nil, err
 	}
 
-	response := &domain.Message{
-		ID:        xid.New().String(),
-		Type:      domain.MessageTypeSDP,
-		Timestamp: time.Now(),
-		Data:      data,
-	}
-
 	h.logger.Debug("message data", "data", string(msg.Data))
 
 	return response, nil
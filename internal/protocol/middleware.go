@@ -0,0 +1,157 @@
+package protocol
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"time"
+
+	"github.com/HMasataka/conic/domain"
+	"github.com/HMasataka/conic/logging"
+	"github.com/HMasataka/conic/registry"
+)
+
+// Recover turns a panicking handler into an internal error reply, so one bad
+// message does not take the connection down
+func Recover(logger *logging.Logger) registry.Middleware {
+	return func(next registry.Handler) registry.Handler {
+		return registry.Wrap(next, func(ctx context.Context, msg *domain.Message) (response *domain.Message, err error) {
+			defer func() {
+				if recovered := recover(); recovered != nil {
+					stack := debug.Stack()
+					if p, ok := recovered.(*handlerPanic); ok {
+						recovered, stack = p.value, p.stack
+					}
+
+					logger.Error("handler panicked",
+						"panic", fmt.Sprint(recovered),
+						"message_type", msg.Type,
+						"message_id", msg.ID,
+						"stack", string(stack),
+					)
+					response, err = nil, domain.NewError(domain.ErrorCodeInternal, "failed to handle message")
+				}
+			}()
+
+			return next.Handle(ctx, msg)
+		})
+	}
+}
+
+// Logger puts a logger carrying the message type, ID and sender into the
+// context, for handlers to log with logging.FromContext
+func Logger(logger *logging.Logger) registry.Middleware {
+	return func(next registry.Handler) registry.Handler {
+		return registry.Wrap(next, func(ctx context.Context, msg *domain.Message) (*domain.Message, error) {
+			fields := []any{"message_type", msg.Type, "message_id", msg.ID}
+			if msg.FromID != "" {
+				fields = append(fields, "from", msg.FromID)
+			}
+
+			ctx = logging.AddFields(logging.WithLogger(ctx, logger), fields...)
+			return next.Handle(ctx, msg)
+		})
+	}
+}
+
+// Timing calls observe with how long each message took to handle and the
+// error its handler returned
+func Timing(observe func(messageType domain.MessageType, elapsed time.Duration, err error)) registry.Middleware {
+	return func(next registry.Handler) registry.Handler {
+		return registry.Wrap(next, func(ctx context.Context, msg *domain.Message) (*domain.Message, error) {
+			started := time.Now()
+			response, err := next.Handle(ctx, msg)
+			observe(msg.Type, time.Since(started), err)
+			return response, err
+		})
+	}
+}
+
+// handlerPanic carries a panic from the goroutine Timeout runs a handler on
+// to the caller, with the stack it happened on
+type handlerPanic struct {
+	value any
+	stack []byte
+}
+
+// handled is what a handler run by Timeout returned
+type handled struct {
+	response *domain.Message
+	err      error
+	panicked *handlerPanic
+}
+
+// Timeout replies with a timeout error when handling a message takes longer
+// than the timeout for its type, or fallback for types without one. Zero
+// means no timeout. The handler runs on its own goroutine with a context
+// that is cancelled at the timeout. A handler that ignores the context keeps
+// running after the reply, and what it returns is discarded.
+func Timeout(timeouts map[domain.MessageType]time.Duration, fallback time.Duration) registry.Middleware {
+	return func(next registry.Handler) registry.Handler {
+		return registry.Wrap(next, func(ctx context.Context, msg *domain.Message) (*domain.Message, error) {
+			timeout, ok := timeouts[msg.Type]
+			if !ok {
+				timeout = fallback
+			}
+			if timeout <= 0 {
+				return next.Handle(ctx, msg)
+			}
+
+			ctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+
+			done := make(chan handled, 1)
+			go func() {
+				var result handled
+				defer func() {
+					if recovered := recover(); recovered != nil {
+						result = handled{panicked: &handlerPanic{value: recovered, stack: debug.Stack()}}
+					}
+					done <- result
+				}()
+
+				result.response, result.err = next.Handle(ctx, msg)
+			}()
+
+			select {
+			case result := <-done:
+				if result.panicked != nil {
+					panic(result.panicked)
+				}
+				if result.err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+					return nil, timeoutError(msg.Type, timeout)
+				}
+				return result.response, result.err
+
+			case <-ctx.Done():
+				go logAbandoned(ctx, msg, done)
+
+				if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+					return nil, timeoutError(msg.Type, timeout)
+				}
+				return nil, ctx.Err()
+			}
+		})
+	}
+}
+
+func timeoutError(messageType domain.MessageType, timeout time.Duration) error {
+	return domain.NewError(domain.ErrorCodeTimeout, fmt.Sprintf("handling %s took longer than %s", messageType, timeout))
+}
+
+// logAbandoned waits for a handler Timeout stopped waiting for and logs it
+// if it panicked, since Recover can no longer see the panic
+func logAbandoned(ctx context.Context, msg *domain.Message, done <-chan handled) {
+	result := <-done
+	if result.panicked == nil {
+		return
+	}
+
+	logging.FromContext(ctx).Error("handler panicked after timing out",
+		"panic", fmt.Sprint(result.panicked.value),
+		"message_type", msg.Type,
+		"message_id", msg.ID,
+		"stack", string(result.panicked.stack),
+	)
+}
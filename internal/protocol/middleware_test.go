@@ -0,0 +1,97 @@
+package protocol
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/HMasataka/conic/domain"
+	"github.com/HMasataka/conic/logging"
+	"github.com/HMasataka/conic/registry"
+)
+
+func TestTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+
+	tests := []struct {
+		name    string
+		handler registry.HandlerFunc
+		want    domain.ErrorCode
+	}{
+		{
+			name: "in time",
+			handler: func(ctx context.Context, msg *domain.Message) (*domain.Message, error) {
+				return msg, nil
+			},
+		},
+		{
+			name: "handler error",
+			handler: func(ctx context.Context, msg *domain.Message) (*domain.Message, error) {
+				return nil, domain.NewError(domain.ErrorCodeInvalidMessage, "bad")
+			},
+			want: domain.ErrorCodeInvalidMessage,
+		},
+		{
+			name: "honours the context",
+			handler: func(ctx context.Context, msg *domain.Message) (*domain.Message, error) {
+				<-ctx.Done()
+				return nil, ctx.Err()
+			},
+			want: domain.ErrorCodeTimeout,
+		},
+		{
+			name: "ignores the context",
+			handler: func(ctx context.Context, msg *domain.Message) (*domain.Message, error) {
+				<-release
+				return msg, nil
+			},
+			want: domain.ErrorCodeTimeout,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := Timeout(nil, 20*time.Millisecond)(tt.handler)
+			msg := &domain.Message{Type: domain.MessageTypeSDP}
+
+			done := make(chan error, 1)
+			go func() {
+				_, err := handler.Handle(context.Background(), msg)
+				done <- err
+			}()
+
+			select {
+			case err := <-done:
+				if tt.want == "" {
+					if err != nil {
+						t.Fatalf("Handle() error = %v", err)
+					}
+					return
+				}
+				var domainErr *domain.Error
+				if !errors.As(err, &domainErr) || domainErr.Code != tt.want {
+					t.Fatalf("Handle() error = %v, want code %s", err, tt.want)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("Handle() did not return after the timeout")
+			}
+		})
+	}
+}
+
+func TestTimeoutPanicReachesRecover(t *testing.T) {
+	panicking := registry.HandlerFunc(func(ctx context.Context, msg *domain.Message) (*domain.Message, error) {
+		panic("boom")
+	})
+	handler := registry.Chain(panicking,
+		Recover(logging.New(logging.Config{Level: "error"})),
+		Timeout(nil, time.Second),
+	)
+
+	_, err := handler.Handle(context.Background(), &domain.Message{Type: domain.MessageTypeSDP})
+	if got := domain.ErrorFrom(err).Code; got != domain.ErrorCodeInternal {
+		t.Fatalf("Handle() error code = %s, want %s", got, domain.ErrorCodeInternal)
+	}
+}
@@ -11,31 +11,88 @@ import (
 
 type Router struct {
 	handlerRegistry registry.HandlerRegistry
+	fallback        registry.Handler
+	middlewares     []registry.Middleware
+	handler         registry.Handler
 	logger          *logging.Logger
 }
 
 func NewRouter(logger *logging.Logger) *Router {
-	return &Router{
+	r := &Router{
 		handlerRegistry: registry.NewHandlerRegistry(),
 		logger:          logger,
 	}
+	r.handler = registry.HandlerFunc(r.dispatch)
+	return r
+}
+
+// Use adds middlewares around every message the router handles, including
+// messages without a handler. Middlewares added first run first. Use is not
+// safe to call while messages are being handled.
+func (r *Router) Use(middlewares ...registry.Middleware) {
+	r.middlewares = append(r.middlewares, middlewares...)
+	r.handler = registry.Chain(registry.HandlerFunc(r.dispatch), r.middlewares...)
 }
 
 func (r *Router) Register(messageType domain.MessageType, handler registry.Handler) {
 	r.handlerRegistry.Register(messageType, handler)
 }
 
+// SetFallback sets the handler used for message types without a registered handler
+func (r *Router) SetFallback(handler registry.Handler) {
+	r.fallback = handler
+}
+
+// OnError registers a callback for error messages reported by the server,
+// replacing any previously registered one
+func (r *Router) OnError(callback ErrorCallback) {
+	r.Register(domain.MessageTypeError, NewErrorHandler(callback, r.logger))
+}
+
 func (r *Router) Handle(ctx context.Context, msg *domain.Message) (*domain.Message, error) {
+	if msg == nil {
+		return nil, domain.NewError(domain.ErrorCodeInvalidMessage, "message is nil")
+	}
+
+	return r.handler.Handle(ctx, msg)
+}
+
+// dispatch passes msg to the handler registered for its type
+func (r *Router) dispatch(ctx context.Context, msg *domain.Message) (*domain.Message, error) {
+	if r.fallback != nil {
+		if _, ok := r.handlerRegistry.Get(msg.Type); !ok && r.fallback.CanHandle(msg.Type) {
+			return r.fallback.Handle(ctx, msg)
+		}
+	}
+
 	return r.handlerRegistry.Handle(ctx, msg)
 }
 
 func NewPeerRouter(pc *webrtcinternal.PeerConnection, logger *logging.Logger) *Router {
 	router := NewRouter(logger)
+	router.Use(Recover(logger))
 
 	router.Register(domain.MessageTypeRegisterResponse, NewRegisterHandler(logger))
 	router.Register(domain.MessageTypeUnregisterResponse, NewUnregisterHandler(logger))
 	router.Register(domain.MessageTypeSDP, NewSessionDescriptionHandler(pc, logger))
 	router.Register(domain.MessageTypeCandidate, NewCandidateHandler(pc, logger))
 
+	roomEventHandler := NewRoomEventHandler(logger)
+	router.Register(domain.MessageTypeJoinRoomResponse, roomEventHandler)
+	router.Register(domain.MessageTypeLeaveRoomResponse, roomEventHandler)
+	router.Register(domain.MessageTypeRoomMemberJoined, roomEventHandler)
+	router.Register(domain.MessageTypeRoomMemberLeft, roomEventHandler)
+
+	peerEventHandler := NewPeerEventHandler(logger)
+	router.Register(domain.MessageTypePeerJoined, peerEventHandler)
+	router.Register(domain.MessageTypePeerLeft, peerEventHandler)
+	router.Register(domain.MessageTypeListPeersResponse, peerEventHandler)
+	router.Register(domain.MessageTypeMessageExpired, peerEventHandler)
+	noticeHandler := NewNoticeHandler(logger)
+	router.Register(domain.MessageTypeNotice, noticeHandler)
+	router.Register(domain.MessageTypeServerShutdown, noticeHandler)
+
+	router.OnError(nil)
+
 	return router
 }
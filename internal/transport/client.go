@@ -2,7 +2,9 @@ package transport
 
 import (
 	"context"
+	"encoding/json"
 
+	"github.com/HMasataka/conic/domain"
 	"github.com/HMasataka/conic/internal/protocol"
 	"github.com/HMasataka/conic/logging"
 	ws "github.com/gorilla/websocket"
@@ -35,6 +37,7 @@ func NewClient(conn *ws.Conn, router *protocol.Router, logger *logging.Logger, o
 
 	clientLogger := logger.WithFields(map[string]any{"client_id": id})
 	connection := NewConnection(conn, router, clientLogger, options.ConnectionOptions)
+	connection.SetID(id)
 
 	return &Client{
 		id:         id,
@@ -51,6 +54,43 @@ func (c *Client) Send(ctx context.Context, message []byte) error {
 	return c.connection.Send(ctx, message)
 }
 
+// Request sends msg and waits for the server's reply
+func (c *Client) Request(ctx context.Context, msg *domain.Message) (*domain.Message, error) {
+	return c.connection.Request(ctx, msg)
+}
+
+// Hello agrees on a protocol version and features with the server. It is
+// sent before registering; the agreed capabilities are returned and recorded
+// on the connection.
+func (c *Client) Hello(ctx context.Context, features ...domain.Feature) (domain.Capabilities, error) {
+	msg, err := domain.NewMessage(domain.MessageTypeHello, domain.Hello{
+		Version:    domain.ProtocolVersion,
+		MinVersion: domain.MinProtocolVersion,
+		Features:   features,
+	})
+	if err != nil {
+		return domain.Capabilities{}, err
+	}
+
+	response, err := c.Request(ctx, msg)
+	if err != nil {
+		return domain.Capabilities{}, err
+	}
+
+	var welcome domain.Welcome
+	if err := json.Unmarshal(response.Data, &welcome); err != nil {
+		return domain.Capabilities{}, err
+	}
+
+	capabilities := domain.Capabilities{
+		Version:  welcome.Version,
+		Features: welcome.Features,
+	}
+	c.connection.SetCapabilities(capabilities)
+
+	return capabilities, nil
+}
+
 func (c *Client) Close() error {
 	return c.connection.Close()
 }
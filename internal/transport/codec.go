@@ -0,0 +1,79 @@
+package transport
+
+import (
+	"encoding/json"
+
+	"github.com/HMasataka/conic/domain"
+	ws "github.com/gorilla/websocket"
+)
+
+// Websocket subprotocols that select a codec
+const (
+	JSONSubprotocol        = "conic.json"
+	MessagePackSubprotocol = "conic.msgpack"
+)
+
+// Codec encodes messages into websocket frames and decodes them. A
+// connection picks its codec by the negotiated websocket subprotocol.
+//
+// Messages travel through the hub and the backplane as JSON; a connection
+// using another codec converts them when it writes and reads frames.
+type Codec interface {
+	// Subprotocol is the websocket subprotocol that selects the codec
+	Subprotocol() string
+
+	// FrameType is the websocket message type of encoded frames, either
+	// websocket.TextMessage or websocket.BinaryMessage
+	FrameType() int
+
+	Encode(msg *domain.Message) ([]byte, error)
+	Decode(data []byte, msg *domain.Message) error
+}
+
+// DefaultCodecs returns the codecs connections support by default, in order
+// of preference
+func DefaultCodecs() []Codec {
+	return []Codec{NewMessagePackCodec(), JSONCodec{}}
+}
+
+// selectCodec returns the codec for the negotiated subprotocol. Connections
+// without a matching subprotocol use JSON.
+func selectCodec(subprotocol string, codecs []Codec) Codec {
+	if subprotocol != "" {
+		for _, codec := range codecs {
+			if codec.Subprotocol() == subprotocol {
+				return codec
+			}
+		}
+	}
+	return JSONCodec{}
+}
+
+// CodecSubprotocols returns the subprotocols of codecs
+func CodecSubprotocols(codecs []Codec) []string {
+	subprotocols := make([]string, 0, len(codecs))
+	for _, codec := range codecs {
+		subprotocols = append(subprotocols, codec.Subprotocol())
+	}
+	return subprotocols
+}
+
+// JSONCodec sends messages as JSON text frames. It is used when no
+// subprotocol was negotiated.
+type JSONCodec struct{}
+
+func (JSONCodec) Subprotocol() string {
+	return JSONSubprotocol
+}
+
+func (JSONCodec) FrameType() int {
+	return ws.TextMessage
+}
+
+func (JSONCodec) Encode(msg *domain.Message) ([]byte, error) {
+	return json.Marshal(msg)
+}
+
+func (JSONCodec) Decode(data []byte, msg *domain.Message) error {
+	return json.Unmarshal(data, msg)
+}
@@ -0,0 +1,22 @@
+package transport
+
+import "context"
+
+type contextKey string
+
+const connectionKey contextKey = "transport_connection"
+
+// WithConnection adds the connection a message arrived on to the context
+func WithConnection(ctx context.Context, conn *Connection) context.Context {
+	return context.WithValue(ctx, connectionKey, conn)
+}
+
+// ConnectionFromContext returns the connection a message arrived on
+func ConnectionFromContext(ctx context.Context) (*Connection, bool) {
+	conn, ok := ctx.Value(connectionKey).(*Connection)
+	if !ok || conn == nil {
+		return nil, false
+	}
+
+	return conn, true
+}
@@ -0,0 +1,100 @@
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	ws "github.com/gorilla/websocket"
+)
+
+type DialOptions struct {
+	// RootCAs verifies the certificate of wss:// servers. Nil uses the
+	// system roots.
+	RootCAs *x509.CertPool
+
+	// InsecureSkipVerify accepts any server certificate. It is only meant
+	// for testing.
+	InsecureSkipVerify bool
+
+	HandshakeTimeout time.Duration
+
+	// Header is sent with the upgrade request, such as an Authorization
+	// header
+	Header http.Header
+
+	// Subprotocols are offered to the server, such as
+	// MessagePackSubprotocol to use the binary codec
+	Subprotocols []string
+
+	// EnableCompression offers permessage-deflate to the server
+	EnableCompression bool
+}
+
+func DefaultDialOptions() DialOptions {
+	return DialOptions{
+		HandshakeTimeout: 45 * time.Second,
+	}
+}
+
+// ServerURL returns the websocket URL of the signal server at addr, using
+// wss:// when secure is set
+func ServerURL(addr string, secure bool) string {
+	u := url.URL{
+		Scheme: "ws",
+		Host:   addr,
+		Path:   "/ws",
+	}
+	if secure {
+		u.Scheme = "wss"
+	}
+	return u.String()
+}
+
+// Dial opens a websocket connection to a ws:// or wss:// URL
+func Dial(ctx context.Context, rawURL string, options DialOptions) (*ws.Conn, error) {
+	dialer := ws.Dialer{
+		Proxy:             http.ProxyFromEnvironment,
+		HandshakeTimeout:  options.HandshakeTimeout,
+		Subprotocols:      options.Subprotocols,
+		EnableCompression: options.EnableCompression,
+		TLSClientConfig: &tls.Config{
+			MinVersion:         tls.VersionTLS12,
+			RootCAs:            options.RootCAs,
+			InsecureSkipVerify: options.InsecureSkipVerify,
+		},
+	}
+
+	conn, _, err := dialer.DialContext(ctx, rawURL, options.Header)
+	if err != nil {
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// LoadCertPool returns the system roots together with the PEM certificates
+// in files, for servers with private or self-signed certificates
+func LoadCertPool(files ...string) (*x509.CertPool, error) {
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no PEM certificates found in %s", file)
+		}
+	}
+
+	return pool, nil
+}
@@ -0,0 +1,563 @@
+package transport
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"time"
+
+	"github.com/HMasataka/conic/domain"
+	ws "github.com/gorilla/websocket"
+)
+
+// msgpackMaxDepth limits the nesting of decoded MessagePack values
+const msgpackMaxDepth = 64
+
+// msgpackTimestamp is the MessagePack extension type of timestamps
+const msgpackTimestamp = -1
+
+// MessagePackCodec sends messages as MessagePack binary frames. The envelope
+// is a map with the same keys as the JSON encoding, and the data is
+// converted from JSON value by value. Timestamps use the MessagePack
+// timestamp extension.
+//
+// Byte fields, such as the payload of data_channel messages, are sent as
+// MessagePack binary instead of base64 strings. Binary values received from
+// the peer become base64 strings, so they can be sent for any []byte field.
+type MessagePackCodec struct {
+	binaryFields map[domain.MessageType][]string
+}
+
+func NewMessagePackCodec() *MessagePackCodec {
+	return &MessagePackCodec{
+		binaryFields: map[domain.MessageType][]string{
+			domain.MessageTypeDataChannel: {"payload"},
+		},
+	}
+}
+
+// SetBinaryFields sends the named top-level data fields of messageType as
+// binary. The fields must hold base64 strings in JSON, as []byte fields do.
+// It must be called before the codec is used.
+func (c *MessagePackCodec) SetBinaryFields(messageType domain.MessageType, fields ...string) {
+	c.binaryFields[messageType] = fields
+}
+
+func (c *MessagePackCodec) Subprotocol() string {
+	return MessagePackSubprotocol
+}
+
+func (c *MessagePackCodec) FrameType() int {
+	return ws.BinaryMessage
+}
+
+func (c *MessagePackCodec) Encode(msg *domain.Message) ([]byte, error) {
+	var data any
+	if len(msg.Data) > 0 {
+		decoder := json.NewDecoder(bytes.NewReader(msg.Data))
+		decoder.UseNumber()
+		if err := decoder.Decode(&data); err != nil {
+			return nil, fmt.Errorf("msgpack: invalid message data: %w", err)
+		}
+	}
+
+	if object, ok := data.(map[string]any); ok {
+		for _, field := range c.binaryFields[msg.Type] {
+			if s, ok := object[field].(string); ok {
+				if b, err := base64.StdEncoding.DecodeString(s); err == nil {
+					object[field] = b
+				}
+			}
+		}
+	}
+
+	optional := [][2]string{
+		{"from_id", msg.FromID},
+		{"to_id", msg.ToID},
+		{"reply_to", msg.ReplyTo},
+	}
+
+	fields := 4
+	for _, field := range optional {
+		if field[1] != "" {
+			fields++
+		}
+	}
+
+	e := &msgpackEncoder{buf: make([]byte, 0, 64+len(msg.Data))}
+	e.mapHeader(fields)
+	e.string("id")
+	e.string(msg.ID)
+	e.string("type")
+	e.string(string(msg.Type))
+	for _, field := range optional {
+		if field[1] != "" {
+			e.string(field[0])
+			e.string(field[1])
+		}
+	}
+	e.string("timestamp")
+	e.timestamp(msg.Timestamp)
+	e.string("data")
+	if err := e.value(data); err != nil {
+		return nil, err
+	}
+
+	return e.buf, nil
+}
+
+func (c *MessagePackCodec) Decode(data []byte, msg *domain.Message) error {
+	d := &msgpackDecoder{data: data}
+	value, err := d.value()
+	if err != nil {
+		return err
+	}
+	if d.pos != len(data) {
+		return errors.New("msgpack: unexpected data after message")
+	}
+
+	envelope, ok := value.(map[string]any)
+	if !ok {
+		return errors.New("msgpack: message is not a map")
+	}
+
+	*msg = domain.Message{}
+	for key, value := range envelope {
+		switch key {
+		case "id", "type", "from_id", "to_id", "reply_to":
+			s, ok := value.(string)
+			if !ok && value != nil {
+				return fmt.Errorf("msgpack: %s is not a string", key)
+			}
+			switch key {
+			case "id":
+				msg.ID = s
+			case "type":
+				msg.Type = domain.MessageType(s)
+			case "from_id":
+				msg.FromID = s
+			case "to_id":
+				msg.ToID = s
+			case "reply_to":
+				msg.ReplyTo = s
+			}
+		case "timestamp":
+			switch t := value.(type) {
+			case time.Time:
+				msg.Timestamp = t
+			case string:
+				parsed, err := time.Parse(time.RFC3339Nano, t)
+				if err != nil {
+					return fmt.Errorf("msgpack: invalid timestamp: %w", err)
+				}
+				msg.Timestamp = parsed
+			case nil:
+			default:
+				return errors.New("msgpack: timestamp is not a timestamp or string")
+			}
+		case "data":
+			encoded, err := json.Marshal(value)
+			if err != nil {
+				return fmt.Errorf("msgpack: data cannot be converted to JSON: %w", err)
+			}
+			msg.Data = encoded
+		}
+	}
+
+	return nil
+}
+
+type msgpackEncoder struct {
+	buf []byte
+}
+
+func (e *msgpackEncoder) value(v any) error {
+	switch v := v.(type) {
+	case nil:
+		e.buf = append(e.buf, 0xc0)
+	case bool:
+		if v {
+			e.buf = append(e.buf, 0xc3)
+		} else {
+			e.buf = append(e.buf, 0xc2)
+		}
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			e.int(i)
+			return nil
+		}
+		f, err := v.Float64()
+		if err != nil {
+			return fmt.Errorf("msgpack: invalid number %s", v)
+		}
+		e.float(f)
+	case int64:
+		e.int(v)
+	case float64:
+		e.float(v)
+	case string:
+		e.string(v)
+	case []byte:
+		e.binary(v)
+	case time.Time:
+		e.timestamp(v)
+	case []any:
+		e.arrayHeader(len(v))
+		for _, item := range v {
+			if err := e.value(item); err != nil {
+				return err
+			}
+		}
+	case map[string]any:
+		// Sorted keys keep the encoding deterministic
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		slices.Sort(keys)
+
+		e.mapHeader(len(v))
+		for _, key := range keys {
+			e.string(key)
+			if err := e.value(v[key]); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("msgpack: unsupported type %T", v)
+	}
+
+	return nil
+}
+
+func (e *msgpackEncoder) int(i int64) {
+	switch {
+	case i >= 0 && i <= math.MaxInt8:
+		e.buf = append(e.buf, byte(i))
+	case i < 0 && i >= -32:
+		e.buf = append(e.buf, byte(int8(i)))
+	case i >= math.MinInt8 && i <= math.MaxInt8:
+		e.buf = append(e.buf, 0xd0, byte(int8(i)))
+	case i >= math.MinInt16 && i <= math.MaxInt16:
+		e.buf = append(e.buf, 0xd1)
+		e.buf = binary.BigEndian.AppendUint16(e.buf, uint16(int16(i)))
+	case i >= math.MinInt32 && i <= math.MaxInt32:
+		e.buf = append(e.buf, 0xd2)
+		e.buf = binary.BigEndian.AppendUint32(e.buf, uint32(int32(i)))
+	default:
+		e.buf = append(e.buf, 0xd3)
+		e.buf = binary.BigEndian.AppendUint64(e.buf, uint64(i))
+	}
+}
+
+func (e *msgpackEncoder) float(f float64) {
+	e.buf = append(e.buf, 0xcb)
+	e.buf = binary.BigEndian.AppendUint64(e.buf, math.Float64bits(f))
+}
+
+func (e *msgpackEncoder) string(s string) {
+	n := len(s)
+	switch {
+	case n < 32:
+		e.buf = append(e.buf, 0xa0|byte(n))
+	case n <= math.MaxUint8:
+		e.buf = append(e.buf, 0xd9, byte(n))
+	case n <= math.MaxUint16:
+		e.buf = append(e.buf, 0xda)
+		e.buf = binary.BigEndian.AppendUint16(e.buf, uint16(n))
+	default:
+		e.buf = append(e.buf, 0xdb)
+		e.buf = binary.BigEndian.AppendUint32(e.buf, uint32(n))
+	}
+	e.buf = append(e.buf, s...)
+}
+
+func (e *msgpackEncoder) binary(b []byte) {
+	n := len(b)
+	switch {
+	case n <= math.MaxUint8:
+		e.buf = append(e.buf, 0xc4, byte(n))
+	case n <= math.MaxUint16:
+		e.buf = append(e.buf, 0xc5)
+		e.buf = binary.BigEndian.AppendUint16(e.buf, uint16(n))
+	default:
+		e.buf = append(e.buf, 0xc6)
+		e.buf = binary.BigEndian.AppendUint32(e.buf, uint32(n))
+	}
+	e.buf = append(e.buf, b...)
+}
+
+func (e *msgpackEncoder) arrayHeader(n int) {
+	switch {
+	case n < 16:
+		e.buf = append(e.buf, 0x90|byte(n))
+	case n <= math.MaxUint16:
+		e.buf = append(e.buf, 0xdc)
+		e.buf = binary.BigEndian.AppendUint16(e.buf, uint16(n))
+	default:
+		e.buf = append(e.buf, 0xdd)
+		e.buf = binary.BigEndian.AppendUint32(e.buf, uint32(n))
+	}
+}
+
+func (e *msgpackEncoder) mapHeader(n int) {
+	switch {
+	case n < 16:
+		e.buf = append(e.buf, 0x80|byte(n))
+	case n <= math.MaxUint16:
+		e.buf = append(e.buf, 0xde)
+		e.buf = binary.BigEndian.AppendUint16(e.buf, uint16(n))
+	default:
+		e.buf = append(e.buf, 0xdf)
+		e.buf = binary.BigEndian.AppendUint32(e.buf, uint32(n))
+	}
+}
+
+// timestamp writes t in the 96-bit timestamp format, which holds any time
+func (e *msgpackEncoder) timestamp(t time.Time) {
+	e.buf = append(e.buf, 0xc7, 12, 0xff) // extension type -1
+	e.buf = binary.BigEndian.AppendUint32(e.buf, uint32(t.Nanosecond()))
+	e.buf = binary.BigEndian.AppendUint64(e.buf, uint64(t.Unix()))
+}
+
+var errMsgpackShort = errors.New("msgpack: unexpected end of data")
+
+type msgpackDecoder struct {
+	data  []byte
+	pos   int
+	depth int
+}
+
+// value decodes the next value into nil, bool, int64, uint64, float64,
+// string, []byte, time.Time, []any or map[string]any
+func (d *msgpackDecoder) value() (any, error) {
+	b, err := d.byte()
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case b <= 0x7f:
+		return int64(b), nil
+	case b >= 0xe0:
+		return int64(int8(b)), nil
+	case b >= 0xa0 && b <= 0xbf:
+		return d.string(int(b & 0x1f))
+	case b >= 0x90 && b <= 0x9f:
+		return d.array(int(b & 0x0f))
+	case b >= 0x80 && b <= 0x8f:
+		return d.mapping(int(b & 0x0f))
+	}
+
+	switch b {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		raw, err := d.uint(1 << (b - 0xcc))
+		if err != nil {
+			return nil, err
+		}
+		if raw > math.MaxInt64 {
+			return raw, nil
+		}
+		return int64(raw), nil
+	case 0xd0:
+		raw, err := d.uint(1)
+		return int64(int8(raw)), err
+	case 0xd1:
+		raw, err := d.uint(2)
+		return int64(int16(raw)), err
+	case 0xd2:
+		raw, err := d.uint(4)
+		return int64(int32(raw)), err
+	case 0xd3:
+		raw, err := d.uint(8)
+		return int64(raw), err
+	case 0xca:
+		raw, err := d.uint(4)
+		return float64(math.Float32frombits(uint32(raw))), err
+	case 0xcb:
+		raw, err := d.uint(8)
+		return math.Float64frombits(raw), err
+	case 0xd9, 0xda, 0xdb:
+		n, err := d.uint(1 << (b - 0xd9))
+		if err != nil {
+			return nil, err
+		}
+		return d.string(int(n))
+	case 0xc4, 0xc5, 0xc6:
+		n, err := d.uint(1 << (b - 0xc4))
+		if err != nil {
+			return nil, err
+		}
+		raw, err := d.bytes(int(n))
+		if err != nil {
+			return nil, err
+		}
+		return bytes.Clone(raw), nil
+	case 0xdc, 0xdd:
+		n, err := d.uint(2 << (b - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return d.array(int(n))
+	case 0xde, 0xdf:
+		n, err := d.uint(2 << (b - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return d.mapping(int(n))
+	case 0xd6:
+		return d.extension(4)
+	case 0xd7:
+		return d.extension(8)
+	case 0xc7:
+		n, err := d.uint(1)
+		if err != nil {
+			return nil, err
+		}
+		return d.extension(int(n))
+	}
+
+	return nil, fmt.Errorf("msgpack: unsupported format 0x%02x", b)
+}
+
+func (d *msgpackDecoder) byte() (byte, error) {
+	if d.pos >= len(d.data) {
+		return 0, errMsgpackShort
+	}
+	b := d.data[d.pos]
+	d.pos++
+	return b, nil
+}
+
+func (d *msgpackDecoder) bytes(n int) ([]byte, error) {
+	if n < 0 || n > len(d.data)-d.pos {
+		return nil, errMsgpackShort
+	}
+	b := d.data[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+func (d *msgpackDecoder) uint(size int) (uint64, error) {
+	b, err := d.bytes(size)
+	if err != nil {
+		return 0, err
+	}
+
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v, nil
+}
+
+func (d *msgpackDecoder) string(n int) (string, error) {
+	b, err := d.bytes(n)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func (d *msgpackDecoder) array(n int) ([]any, error) {
+	// Every element takes at least a byte, which bounds the allocation
+	if n > len(d.data)-d.pos {
+		return nil, errMsgpackShort
+	}
+	if err := d.enter(); err != nil {
+		return nil, err
+	}
+	defer d.leave()
+
+	items := make([]any, 0, n)
+	for range n {
+		item, err := d.value()
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+func (d *msgpackDecoder) mapping(n int) (map[string]any, error) {
+	if n > (len(d.data)-d.pos)/2 {
+		return nil, errMsgpackShort
+	}
+	if err := d.enter(); err != nil {
+		return nil, err
+	}
+	defer d.leave()
+
+	object := make(map[string]any, n)
+	for range n {
+		key, err := d.value()
+		if err != nil {
+			return nil, err
+		}
+		s, ok := key.(string)
+		if !ok {
+			return nil, errors.New("msgpack: map keys must be strings")
+		}
+
+		value, err := d.value()
+		if err != nil {
+			return nil, err
+		}
+		object[s] = value
+	}
+	return object, nil
+}
+
+func (d *msgpackDecoder) enter() error {
+	d.depth++
+	if d.depth > msgpackMaxDepth {
+		return errors.New("msgpack: nesting too deep")
+	}
+	return nil
+}
+
+func (d *msgpackDecoder) leave() {
+	d.depth--
+}
+
+// extension decodes an extension value of n bytes. Only timestamps are
+// supported.
+func (d *msgpackDecoder) extension(n int) (any, error) {
+	kind, err := d.byte()
+	if err != nil {
+		return nil, err
+	}
+	b, err := d.bytes(n)
+	if err != nil {
+		return nil, err
+	}
+	if int8(kind) != msgpackTimestamp {
+		return nil, fmt.Errorf("msgpack: unsupported extension type %d", int8(kind))
+	}
+
+	switch n {
+	case 4:
+		return time.Unix(int64(binary.BigEndian.Uint32(b)), 0).UTC(), nil
+	case 8:
+		v := binary.BigEndian.Uint64(b)
+		return time.Unix(int64(v&(1<<34-1)), int64(v>>34)).UTC(), nil
+	case 12:
+		nsec := binary.BigEndian.Uint32(b[:4])
+		sec := int64(binary.BigEndian.Uint64(b[4:]))
+		return time.Unix(sec, int64(nsec)).UTC(), nil
+	}
+
+	return nil, fmt.Errorf("msgpack: invalid timestamp length %d", n)
+}
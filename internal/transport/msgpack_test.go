@@ -0,0 +1,380 @@
+package transport
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/HMasataka/conic/domain"
+)
+
+// sampleMessage is a message with every envelope field set
+func sampleMessage(data string) *domain.Message {
+	return &domain.Message{
+		ID:        "msg-1",
+		Type:      domain.MessageTypeSDP,
+		FromID:    "alice",
+		ToID:      "bob",
+		ReplyTo:   "msg-0",
+		Timestamp: time.Date(2024, 5, 1, 12, 30, 45, 123456789, time.UTC),
+		Data:      json.RawMessage(data),
+	}
+}
+
+func TestMessagePackRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  *domain.Message
+		// want is the data after the round trip, when it differs from the
+		// data sent
+		want string
+	}{
+		{
+			name: "no data",
+			msg:  &domain.Message{ID: "1", Type: domain.MessageTypeListPeersRequest, Timestamp: time.Unix(0, 0).UTC()},
+			want: `null`,
+		},
+		{
+			name: "timestamp before 1970",
+			msg:  &domain.Message{ID: "1", Type: domain.MessageTypeListPeersRequest, Timestamp: time.Date(1900, 1, 1, 0, 0, 0, 1, time.UTC)},
+			want: `null`,
+		},
+		{
+			name: "timestamp after 2106",
+			msg:  &domain.Message{ID: "1", Type: domain.MessageTypeListPeersRequest, Timestamp: time.Date(2500, 12, 31, 23, 59, 59, 999999999, time.UTC)},
+			want: `null`,
+		},
+		{
+			name: "optional fields",
+			msg:  sampleMessage(`{}`),
+		},
+		{
+			name: "binary payload",
+			msg: &domain.Message{
+				ID:        "1",
+				Type:      domain.MessageTypeDataChannel,
+				Timestamp: time.Unix(1700000000, 0).UTC(),
+				Data:      json.RawMessage(`{"label":"chat","payload":"AAECA/8="}`),
+			},
+		},
+		{
+			name: "payload that is not base64",
+			msg: &domain.Message{
+				ID:        "1",
+				Type:      domain.MessageTypeDataChannel,
+				Timestamp: time.Unix(1700000000, 0).UTC(),
+				Data:      json.RawMessage(`{"payload":"not base64!"}`),
+			},
+		},
+		{
+			name: "integers",
+			msg: sampleMessage(`{"values":[0,127,128,255,256,65535,65536,4294967295,4294967296,` +
+				`-1,-32,-33,-128,-129,-32768,-32769,-2147483648,-2147483649,` +
+				`9223372036854775807,-9223372036854775808]}`),
+		},
+		{
+			name: "floats",
+			msg:  sampleMessage(`{"values":[0.5,-1.25,1e-7,1.7976931348623157e+308,3.0]}`),
+			want: `{"values":[0.5,-1.25,1e-7,1.7976931348623157e+308,3]}`,
+		},
+		{
+			name: "nested maps and arrays",
+			msg:  sampleMessage(`{"a":{"b":{"c":[1,[2,[3,{"d":null}]],{}]}},"e":[],"f":[true,false,"g"]}`),
+		},
+		{
+			name: "large containers and strings",
+			msg: sampleMessage(`{"list":[` + strings.TrimSuffix(strings.Repeat("1,", 20), ",") +
+				`],"long":"` + strings.Repeat("x", 70000) + `"}`),
+		},
+		{
+			name: "raw message data",
+			msg:  sampleMessage("{ \"sdp\" : {\"type\": \"offer\",\n \"sdp\": \"v=0\\r\\n\"},\n \"name\": \"\\u00e9\" }"),
+			want: `{"name":"é","sdp":{"sdp":"v=0\r\n","type":"offer"}}`,
+		},
+		{
+			name: "data that is not an object",
+			msg:  sampleMessage(`["a",1]`),
+		},
+	}
+
+	codec := NewMessagePackCodec()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			encoded, err := codec.Encode(tt.msg)
+			if err != nil {
+				t.Fatalf("Encode() error = %v", err)
+			}
+
+			var got domain.Message
+			if err := codec.Decode(encoded, &got); err != nil {
+				t.Fatalf("Decode() error = %v", err)
+			}
+
+			if got.ID != tt.msg.ID || got.Type != tt.msg.Type || got.FromID != tt.msg.FromID ||
+				got.ToID != tt.msg.ToID || got.ReplyTo != tt.msg.ReplyTo {
+				t.Fatalf("Decode() envelope = %+v, want %+v", got, *tt.msg)
+			}
+			if !got.Timestamp.Equal(tt.msg.Timestamp) {
+				t.Fatalf("Decode() timestamp = %v, want %v", got.Timestamp, tt.msg.Timestamp)
+			}
+
+			want := tt.want
+			if want == "" {
+				want = string(tt.msg.Data)
+			}
+			if string(got.Data) != want {
+				t.Fatalf("Decode() data = %s, want %s", got.Data, want)
+			}
+		})
+	}
+}
+
+func TestMessagePackBinaryFields(t *testing.T) {
+	codec := NewMessagePackCodec()
+	msg := &domain.Message{
+		ID:   "1",
+		Type: domain.MessageTypeDataChannel,
+		Data: json.RawMessage(`{"payload":"AAECA/8="}`),
+	}
+
+	encoded, err := codec.Encode(msg)
+	if err != nil {
+		t.Fatalf("Encode() error = %v", err)
+	}
+
+	d := &msgpackDecoder{data: encoded}
+	value, err := d.value()
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	data := value.(map[string]any)["data"].(map[string]any)
+	if got, want := data["payload"], []byte{0, 1, 2, 3, 0xff}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("payload = %#v, want binary %#v", got, want)
+	}
+}
+
+func TestMessagePackDecodeValues(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want any
+	}{
+		{"positive fixint", []byte{0x7f}, int64(127)},
+		{"negative fixint", []byte{0xe0}, int64(-32)},
+		{"uint8", []byte{0xcc, 0xff}, int64(255)},
+		{"uint16", []byte{0xcd, 0xff, 0xff}, int64(math.MaxUint16)},
+		{"uint32", []byte{0xce, 0xff, 0xff, 0xff, 0xff}, int64(math.MaxUint32)},
+		{"uint64 in int64 range", []byte{0xcf, 0x7f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, int64(math.MaxInt64)},
+		{"uint64 above int64 range", []byte{0xcf, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, uint64(math.MaxUint64)},
+		{"int8", []byte{0xd0, 0x80}, int64(math.MinInt8)},
+		{"int16", []byte{0xd1, 0x80, 0x00}, int64(math.MinInt16)},
+		{"int32", []byte{0xd2, 0x80, 0x00, 0x00, 0x00}, int64(math.MinInt32)},
+		{"int64", []byte{0xd3, 0x80, 0, 0, 0, 0, 0, 0, 0}, int64(math.MinInt64)},
+		{"float32", []byte{0xca, 0x3f, 0xc0, 0x00, 0x00}, float64(1.5)},
+		{"float64", []byte{0xcb, 0xbf, 0xf8, 0, 0, 0, 0, 0, 0}, float64(-1.5)},
+		{"str8", append([]byte{0xd9, 3}, "abc"...), "abc"},
+		{"str16", append([]byte{0xda, 0, 3}, "abc"...), "abc"},
+		{"str32", append([]byte{0xdb, 0, 0, 0, 3}, "abc"...), "abc"},
+		{"bin8", []byte{0xc4, 2, 1, 2}, []byte{1, 2}},
+		{"bin16", []byte{0xc5, 0, 2, 1, 2}, []byte{1, 2}},
+		{"bin32", []byte{0xc6, 0, 0, 0, 2, 1, 2}, []byte{1, 2}},
+		{"array16", []byte{0xdc, 0, 2, 0xc3, 0xc2}, []any{true, false}},
+		{"array32", []byte{0xdd, 0, 0, 0, 1, 0xc0}, []any{nil}},
+		{"map16", []byte{0xde, 0, 1, 0xa1, 'k', 0x01}, map[string]any{"k": int64(1)}},
+		{"map32", []byte{0xdf, 0, 0, 0, 1, 0xa1, 'k', 0x01}, map[string]any{"k": int64(1)}},
+		{"timestamp32", []byte{0xd6, 0xff, 0, 0, 0, 60}, time.Unix(60, 0).UTC()},
+		{"timestamp64", binary.BigEndian.AppendUint64([]byte{0xd7, 0xff}, 500<<34|60), time.Unix(60, 500).UTC()},
+		{
+			"timestamp96",
+			binary.BigEndian.AppendUint64(binary.BigEndian.AppendUint32([]byte{0xc7, 12, 0xff}, 7), uint64(math.MaxUint64)),
+			time.Unix(-1, 7).UTC(),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &msgpackDecoder{data: tt.data}
+			got, err := d.value()
+			if err != nil {
+				t.Fatalf("value() error = %v", err)
+			}
+			if d.pos != len(tt.data) {
+				t.Fatalf("value() read %d of %d bytes", d.pos, len(tt.data))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("value() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMessagePackDecodeTruncated(t *testing.T) {
+	codec := NewMessagePackCodec()
+	encoded, err := codec.Encode(sampleMessage(`{"a":[1,2.5,"three",{"b":null}],"payload":"AAE="}`))
+	if err != nil {
+		t.Fatalf("Encode() error = %v", err)
+	}
+
+	for n := range len(encoded) {
+		var msg domain.Message
+		if err := codec.Decode(encoded[:n], &msg); err == nil {
+			t.Fatalf("Decode() of the first %d of %d bytes succeeded", n, len(encoded))
+		}
+	}
+}
+
+func TestMessagePackDecodeOversizedLength(t *testing.T) {
+	max32 := []byte{0xff, 0xff, 0xff, 0xff}
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"str8", []byte{0xd9, 0xff, 'a'}},
+		{"str16", []byte{0xda, 0xff, 0xff, 'a'}},
+		{"str32", append([]byte{0xdb}, max32...)},
+		{"bin32", append([]byte{0xc6}, max32...)},
+		{"array16", []byte{0xdc, 0xff, 0xff, 0xc0}},
+		{"array32", append([]byte{0xdd}, max32...)},
+		{"map16", []byte{0xde, 0xff, 0xff, 0xa1, 'k', 0xc0}},
+		{"map32", append([]byte{0xdf}, max32...)},
+		{"fixarray", []byte{0x9f, 0xc0}},
+		{"fixmap", []byte{0x8f, 0xa1, 'k', 0xc0}},
+		{"ext8", []byte{0xc7, 0xff, 0xff, 0, 0, 0, 0}},
+		{"nested array32", append([]byte{0x91, 0xdd}, max32...)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var before, after runtime.MemStats
+			runtime.ReadMemStats(&before)
+
+			var msg domain.Message
+			err := NewMessagePackCodec().Decode(tt.data, &msg)
+
+			runtime.ReadMemStats(&after)
+			if err == nil {
+				t.Fatal("Decode() succeeded, want an error")
+			}
+			if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1<<20 {
+				t.Fatalf("Decode() allocated %d bytes", allocated)
+			}
+		})
+	}
+}
+
+func TestMessagePackDecodeDepth(t *testing.T) {
+	nested := func(depth int) []byte {
+		data := bytes.Repeat([]byte{0x91}, depth)
+		return append(data, 0xc0)
+	}
+
+	d := &msgpackDecoder{data: nested(msgpackMaxDepth)}
+	if _, err := d.value(); err != nil {
+		t.Fatalf("%d nested arrays were rejected: %v", msgpackMaxDepth, err)
+	}
+
+	d = &msgpackDecoder{data: nested(msgpackMaxDepth + 1)}
+	if _, err := d.value(); err == nil {
+		t.Fatalf("%d nested arrays were accepted", msgpackMaxDepth+1)
+	}
+
+	// Far deeper input fails at the limit instead of exhausting the stack
+	var msg domain.Message
+	deep := append([]byte{0x81, 0xa4, 'd', 'a', 't', 'a'}, nested(1_000_000)...)
+	if err := NewMessagePackCodec().Decode(deep, &msg); err == nil {
+		t.Fatal("Decode() accepted data nested a million deep")
+	}
+}
+
+// TestMessagePackDecodeUnsupported documents the formats the decoder rejects
+// on purpose. The encoder never writes them, and the only extension it
+// knows, the timestamp, comes as fixext4, fixext8 or ext8.
+func TestMessagePackDecodeUnsupported(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"never used", []byte{0xc1}},
+		{"fixext1", []byte{0xd4, 0xff, 0}},
+		{"fixext2", []byte{0xd5, 0xff, 0, 0}},
+		{"fixext16", append([]byte{0xd8, 0xff}, make([]byte, 16)...)},
+		{"ext16", append([]byte{0xc8, 0, 12, 0xff}, make([]byte, 12)...)},
+		{"ext32", append([]byte{0xc9, 0, 0, 0, 12, 0xff}, make([]byte, 12)...)},
+		{"other extension type", []byte{0xd6, 0x01, 0, 0, 0, 0}},
+		{"timestamp of another length", []byte{0xc7, 5, 0xff, 0, 0, 0, 0, 0}},
+		{"non-string map key", []byte{0x81, 0x01, 0xc0}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &msgpackDecoder{data: tt.data}
+			if _, err := d.value(); err == nil {
+				t.Fatal("value() succeeded, want an error")
+			}
+		})
+	}
+}
+
+func TestMessagePackDecodeInvalidEnvelope(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"not a map", []byte{0x90}},
+		{"trailing data", []byte{0x80, 0xc0}},
+		{"id is not a string", []byte{0x81, 0xa2, 'i', 'd', 0x01}},
+		{"timestamp is a number", append([]byte{0x81, 0xa9}, append([]byte("timestamp"), 0x01)...)},
+		{"timestamp is not RFC 3339", append([]byte{0x81, 0xa9}, append([]byte("timestamp"), 0xa1, 'x')...)},
+		{"data holds NaN", append([]byte{0x81, 0xa4, 'd', 'a', 't', 'a', 0xcb}, 0x7f, 0xf8, 0, 0, 0, 0, 0, 1)},
+	}
+
+	codec := NewMessagePackCodec()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var msg domain.Message
+			if err := codec.Decode(tt.data, &msg); err == nil {
+				t.Fatal("Decode() succeeded, want an error")
+			}
+		})
+	}
+}
+
+func FuzzMessagePackDecode(f *testing.F) {
+	codec := NewMessagePackCodec()
+	for _, data := range []string{`{}`, `{"a":[1,-2,3.5,"x",null,true]}`, `{"payload":"AAE="}`} {
+		encoded, err := codec.Encode(sampleMessage(data))
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(encoded)
+	}
+	f.Add([]byte{0xd7, 0xff, 0, 0, 0, 0, 0, 0, 0, 0})
+	f.Add([]byte{0xdf, 0xff, 0xff, 0xff, 0xff})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var msg domain.Message
+		if err := codec.Decode(data, &msg); err != nil {
+			return
+		}
+
+		// Whatever decodes must survive another round trip
+		encoded, err := codec.Encode(&msg)
+		if err != nil {
+			t.Fatalf("Encode() of a decoded message: %v", err)
+		}
+		var again domain.Message
+		if err := codec.Decode(encoded, &again); err != nil {
+			t.Fatalf("Decode() of a re-encoded message: %v", err)
+		}
+		if again.ID != msg.ID || again.Type != msg.Type || again.FromID != msg.FromID ||
+			again.ToID != msg.ToID || again.ReplyTo != msg.ReplyTo {
+			t.Fatalf("envelope changed from %+v to %+v", msg, again)
+		}
+	})
+}
@@ -0,0 +1,108 @@
+package transport
+
+import (
+	"time"
+
+	"github.com/HMasataka/conic/domain"
+)
+
+// RateLimit allows Rate messages per second on average with bursts of up to
+// Burst messages. A zero Rate disables the limit.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// ThrottleAction decides what happens to a message over its rate limit
+type ThrottleAction string
+
+const (
+	// ThrottleDrop silently discards the message
+	ThrottleDrop ThrottleAction = "drop"
+	// ThrottleError discards the message and replies with a rate_limited error
+	ThrottleError ThrottleAction = "error"
+	// ThrottleDisconnect closes the connection
+	ThrottleDisconnect ThrottleAction = "disconnect"
+)
+
+// tokenBucket implements a single RateLimit
+type tokenBucket struct {
+	limit  RateLimit
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(limit RateLimit) *tokenBucket {
+	return &tokenBucket{
+		limit:  limit,
+		tokens: float64(max(limit.Burst, 1)),
+	}
+}
+
+// allow takes a token if one is available
+func (b *tokenBucket) allow(now time.Time) bool {
+	burst := float64(max(b.limit.Burst, 1))
+
+	if !b.last.IsZero() {
+		b.tokens = min(burst, b.tokens+now.Sub(b.last).Seconds()*b.limit.Rate)
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+
+	b.tokens--
+	return true
+}
+
+// rateLimiter applies the connection-wide and per-type limits of a single
+// connection, and the action to take on messages over them. It is only used
+// from the read pump, so it needs no locking.
+type rateLimiter struct {
+	connection *tokenBucket
+	limits     map[domain.MessageType]RateLimit
+	types      map[domain.MessageType]*tokenBucket
+	action     ThrottleAction
+}
+
+func newRateLimiter(connection RateLimit, types map[domain.MessageType]RateLimit, action ThrottleAction) *rateLimiter {
+	limiter := &rateLimiter{
+		limits: make(map[domain.MessageType]RateLimit),
+		types:  make(map[domain.MessageType]*tokenBucket),
+		action: action,
+	}
+
+	if connection.Rate > 0 {
+		limiter.connection = newTokenBucket(connection)
+	}
+
+	for messageType, limit := range types {
+		if limit.Rate > 0 {
+			limiter.limits[messageType] = limit
+		}
+	}
+
+	return limiter
+}
+
+// allowMessage checks the connection-wide limit
+func (l *rateLimiter) allowMessage(now time.Time) bool {
+	return l.connection == nil || l.connection.allow(now)
+}
+
+// allowType checks the limit for messageType
+func (l *rateLimiter) allowType(messageType domain.MessageType, now time.Time) bool {
+	limit, ok := l.limits[messageType]
+	if !ok {
+		return true
+	}
+
+	bucket, ok := l.types[messageType]
+	if !ok {
+		bucket = newTokenBucket(limit)
+		l.types[messageType] = bucket
+	}
+
+	return bucket.allow(now)
+}
@@ -0,0 +1,140 @@
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/HMasataka/conic/logging"
+)
+
+// CertificateReloader serves a certificate and key pair from files and
+// reloads them when either file changes, so certificates can be renewed
+// without restarting the server
+type CertificateReloader struct {
+	certFile string
+	keyFile  string
+	logger   *logging.Logger
+
+	mu          sync.RWMutex
+	certificate *tls.Certificate
+	certStat    fileStat
+	keyStat     fileStat
+}
+
+type fileStat struct {
+	modTime time.Time
+	size    int64
+}
+
+// NewCertificateReloader loads the PEM certificate and key from certFile and
+// keyFile
+func NewCertificateReloader(certFile, keyFile string, logger *logging.Logger) (*CertificateReloader, error) {
+	r := &CertificateReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		logger:   logger,
+	}
+
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// TLSConfig returns a server TLS configuration serving the current
+// certificate
+func (r *CertificateReloader) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: r.GetCertificate,
+	}
+}
+
+// GetCertificate returns the current certificate. It is meant for
+// tls.Config.GetCertificate.
+func (r *CertificateReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.certificate, nil
+}
+
+// Reload reads the certificate and key files. The current certificate is
+// kept when they cannot be loaded.
+func (r *CertificateReloader) Reload() error {
+	certStat, err := statFile(r.certFile)
+	if err != nil {
+		return err
+	}
+	keyStat, err := statFile(r.keyFile)
+	if err != nil {
+		return err
+	}
+
+	certificate, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load certificate: %w", err)
+	}
+
+	r.mu.Lock()
+	r.certificate = &certificate
+	r.certStat = certStat
+	r.keyStat = keyStat
+	r.mu.Unlock()
+
+	return nil
+}
+
+// Watch checks the files every interval and reloads them when they change
+// until ctx is done. A renewal that writes the certificate and key one after
+// the other may fail to load in between; the next check picks it up.
+func (r *CertificateReloader) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if !r.changed() {
+			continue
+		}
+
+		if err := r.Reload(); err != nil {
+			r.logger.Warn("failed to reload certificate", "cert_file", r.certFile, "error", err)
+			continue
+		}
+
+		r.logger.Info("certificate reloaded", "cert_file", r.certFile)
+	}
+}
+
+func (r *CertificateReloader) changed() bool {
+	certStat, err := statFile(r.certFile)
+	if err != nil {
+		return false
+	}
+	keyStat, err := statFile(r.keyFile)
+	if err != nil {
+		return false
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return certStat != r.certStat || keyStat != r.keyStat
+}
+
+func statFile(path string) (fileStat, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fileStat{}, err
+	}
+	return fileStat{modTime: info.ModTime(), size: info.Size()}, nil
+}
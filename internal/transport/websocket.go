@@ -5,12 +5,14 @@ import (
 	"encoding/json"
 	"errors"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/HMasataka/conic/domain"
 	"github.com/HMasataka/conic/internal/protocol"
 	"github.com/HMasataka/conic/logging"
 	ws "github.com/gorilla/websocket"
+	"github.com/rs/xid"
 )
 
 type ConnectionOptions struct {
@@ -20,6 +22,41 @@ type ConnectionOptions struct {
 	MaxMessageSize  int64
 	ReadBufferSize  int
 	WriteBufferSize int
+
+	// EnableCompression negotiates permessage-deflate with peers that
+	// offer it and compresses the messages written to them
+	EnableCompression bool
+
+	// ReplyErrors sends an error message back to the peer when a message
+	// cannot be decoded or handled. Servers enable it; clients leave it off
+	// so that two peers never bounce errors at each other.
+	ReplyErrors bool
+
+	// RateLimit limits the messages the peer may send. A zero Rate disables
+	// the limit.
+	RateLimit RateLimit
+
+	// TypeRateLimits limits individual message types on top of RateLimit
+	TypeRateLimits map[domain.MessageType]RateLimit
+
+	// ThrottleAction decides what happens to messages over a limit. The
+	// default drops them.
+	ThrottleAction ThrottleAction
+
+	// OnThrottled is called for every throttled message. The message type is
+	// empty when the message was throttled before it was decoded.
+	OnThrottled func(messageType domain.MessageType)
+
+	// OnReceived is called for every message decoded from the peer
+	OnReceived func(messageType domain.MessageType)
+
+	// OnClosed is called once the connection is closed, with how long it was
+	// open
+	OnClosed func(connected time.Duration)
+
+	// Codecs are the wire codecs the connection may use. The one matching
+	// the negotiated websocket subprotocol is used, or JSON when none does.
+	Codecs []Codec
 }
 
 func DefaultConnectionOptions() ConnectionOptions {
@@ -30,55 +67,273 @@ func DefaultConnectionOptions() ConnectionOptions {
 		MaxMessageSize:  512 * 1024, // 512KB
 		ReadBufferSize:  1024,
 		WriteBufferSize: 1024,
+		Codecs:          DefaultCodecs(),
 	}
 }
 
 type Connection struct {
+	id       string
 	ctx      context.Context
 	conn     *ws.Conn
 	cancel   context.CancelFunc
 	router   *protocol.Router
 	logger   *logging.Logger
 	options  ConnectionOptions
-	sendChan chan []byte
+	codec    Codec
+	sendChan chan outbound
+	limiter  atomic.Pointer[rateLimiter]
+	onClose  []func()
+	pending  map[string]chan *domain.Message
 	mutex    sync.RWMutex
+	closing  bool
 	closed   bool
+	openedAt time.Time
+
+	capabilities *domain.Capabilities
+
+	messagesReceived atomic.Int64
+	messagesSent     atomic.Int64
+}
+
+// outbound is an item queued for the write pump. A non-zero closeCode asks
+// the write pump to send a close frame and close the connection once the
+// messages queued before it have been written.
+type outbound struct {
+	data      []byte
+	prepared  *domain.PreparedMessage
+	closeCode int
+	closeText string
 }
 
 func NewConnection(conn *ws.Conn, router *protocol.Router, logger *logging.Logger, options ConnectionOptions) *Connection {
 	ctx, cancel := context.WithCancel(context.Background())
 
-	return &Connection{
+	c := &Connection{
 		ctx:      ctx,
 		conn:     conn,
 		router:   router,
 		cancel:   cancel,
 		logger:   logger,
 		options:  options,
-		sendChan: make(chan []byte, 256),
+		codec:    selectCodec(conn.Subprotocol(), options.Codecs),
+		sendChan: make(chan outbound, 256),
+		pending:  make(map[string]chan *domain.Message),
+		openedAt: time.Now(),
 	}
+	c.limiter.Store(newRateLimiter(options.RateLimit, options.TypeRateLimits, options.ThrottleAction))
+
+	return c
 }
 
-func (c *Connection) Send(ctx context.Context, message []byte) error {
+// SetRateLimits replaces the rate limits of an open connection. Its token
+// buckets start full again.
+func (c *Connection) SetRateLimits(limit RateLimit, typeLimits map[domain.MessageType]RateLimit, action ThrottleAction) {
+	c.limiter.Store(newRateLimiter(limit, typeLimits, action))
+}
+
+// Codec returns the wire codec negotiated for the connection
+func (c *Connection) Codec() Codec {
+	return c.codec
+}
+
+// ID returns the client ID the connection is registered as, or an empty
+// string if it has not registered yet
+func (c *Connection) ID() string {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.id
+}
+
+// SetID binds the connection to a client ID
+func (c *Connection) SetID(id string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.id = id
+}
+
+// SetCapabilities records what the peer agreed on in the hello/welcome
+// exchange
+func (c *Connection) SetCapabilities(capabilities domain.Capabilities) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.capabilities = &capabilities
+}
+
+// Capabilities returns what the peer agreed on in the hello/welcome exchange.
+// It reports false until the exchange has happened.
+func (c *Connection) Capabilities() (domain.Capabilities, bool) {
 	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	if c.capabilities == nil {
+		return domain.Capabilities{}, false
+	}
+	return *c.capabilities, true
+}
+
+// Supports reports whether the peer agreed on feature. Peers that never sent
+// hello predate the exchange and were sent everything, so they are assumed
+// to support every feature.
+func (c *Connection) Supports(feature domain.Feature) bool {
+	capabilities, ok := c.Capabilities()
+	return !ok || capabilities.Has(feature)
+}
+
+// OnClose registers a function to run once the connection is closed. It
+// runs right away when the connection is already closed.
+func (c *Connection) OnClose(fn func()) {
+	c.mutex.Lock()
 	if c.closed {
-		c.mutex.RUnlock()
+		c.mutex.Unlock()
+		fn()
+		return
+	}
+	c.onClose = append(c.onClose, fn)
+	c.mutex.Unlock()
+}
+
+func (c *Connection) Send(ctx context.Context, message []byte) error {
+	return c.enqueue(ctx, outbound{data: message})
+}
+
+// SendPrepared queues a message shared with other connections. The frame
+// built for it is reused by every connection with the same codec.
+func (c *Connection) SendPrepared(ctx context.Context, message *domain.PreparedMessage) error {
+	return c.enqueue(ctx, outbound{prepared: message})
+}
+
+func (c *Connection) enqueue(ctx context.Context, item outbound) error {
+	// Hold the read lock while enqueueing so Close cannot close sendChan
+	// underneath us. The select never blocks.
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	if c.closed || c.closing {
 		return errors.New("connection is closed")
 	}
-	c.mutex.RUnlock()
 
 	select {
 	case <-ctx.Done():
 		return ctx.Err()
 	case <-c.ctx.Done():
 		return errors.New("connection context done")
-	case c.sendChan <- message:
+	case c.sendChan <- item:
 		return nil
 	default:
-		return errors.New("send channel full or blocked")
+		return domain.ErrClientBusy
 	}
 }
 
+// CloseWithReason sends a close frame with the given code and reason after
+// the messages already queued, then closes the connection. Further sends
+// are rejected.
+func (c *Connection) CloseWithReason(code int, reason string) {
+	c.mutex.Lock()
+	if c.closed || c.closing {
+		c.mutex.Unlock()
+		return
+	}
+	c.closing = true
+
+	select {
+	case c.sendChan <- outbound{closeCode: code, closeText: reason}:
+		c.mutex.Unlock()
+	default:
+		// The queue is full, so the peer would not see the reason anyway
+		c.mutex.Unlock()
+		c.Close()
+	}
+}
+
+// Stats returns when the connection was opened and how many messages it
+// received and wrote
+func (c *Connection) Stats() domain.ClientStats {
+	return domain.ClientStats{
+		ConnectedAt:      c.openedAt,
+		MessagesReceived: c.messagesReceived.Load(),
+		MessagesSent:     c.messagesSent.Load(),
+	}
+}
+
+func (c *Connection) isClosing() bool {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.closing
+}
+
+// Request sends msg and waits for the message that replies to it. An error
+// message in reply is returned as a *domain.Error.
+func (c *Connection) Request(ctx context.Context, msg *domain.Message) (*domain.Message, error) {
+	if msg.ID == "" {
+		msg.ID = xid.New().String()
+	}
+
+	if msg.Timestamp.IsZero() {
+		msg.Timestamp = time.Now()
+	}
+
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	reply := make(chan *domain.Message, 1)
+
+	c.mutex.Lock()
+	c.pending[msg.ID] = reply
+	c.mutex.Unlock()
+
+	defer func() {
+		c.mutex.Lock()
+		delete(c.pending, msg.ID)
+		c.mutex.Unlock()
+	}()
+
+	if err := c.Send(ctx, data); err != nil {
+		return nil, err
+	}
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-c.ctx.Done():
+		return nil, errors.New("connection closed while waiting for reply")
+	case response := <-reply:
+		if response.Type != domain.MessageTypeError {
+			return response, nil
+		}
+
+		var errMsg domain.ErrorMessage
+		if err := json.Unmarshal(response.Data, &errMsg); err != nil {
+			return nil, errors.New("failed to unmarshal error reply: " + err.Error())
+		}
+
+		return nil, errMsg.Err()
+	}
+}
+
+// deliverReply hands msg to the Request waiting for it and reports whether
+// there was one
+func (c *Connection) deliverReply(msg *domain.Message) bool {
+	if msg.ReplyTo == "" {
+		return false
+	}
+
+	c.mutex.RLock()
+	reply, ok := c.pending[msg.ReplyTo]
+	c.mutex.RUnlock()
+
+	if !ok {
+		return false
+	}
+
+	select {
+	case reply <- msg:
+	default:
+	}
+
+	return true
+}
+
 func (c *Connection) Close() error {
 	c.mutex.Lock()
 	if c.closed {
@@ -86,6 +341,8 @@ func (c *Connection) Close() error {
 		return nil
 	}
 	c.closed = true
+	onClose := c.onClose
+	c.onClose = nil
 	c.mutex.Unlock()
 
 	c.logger.Info("closing websocket connection")
@@ -93,12 +350,20 @@ func (c *Connection) Close() error {
 	c.cancel()
 	close(c.sendChan)
 
-	if err := c.conn.Close(); err != nil {
+	err := c.conn.Close()
+	if err != nil {
 		c.logger.Error("error closing websocket connection", "error", err)
-		return err
 	}
 
-	return nil
+	for _, fn := range onClose {
+		fn()
+	}
+
+	if c.options.OnClosed != nil {
+		c.options.OnClosed(time.Since(c.openedAt))
+	}
+
+	return err
 }
 
 func (c *Connection) Context() context.Context {
@@ -153,11 +418,37 @@ func (c *Connection) readPump(ctx context.Context) {
 				continue
 			}
 
-			c.logger.Info("Received message", "message", string(message))
+			// Keep reading until the close frame is written, but stop handling
+			// messages from a peer that is being disconnected
+			if c.isClosing() {
+				continue
+			}
+
+			now := time.Now()
+			limiter := c.limiter.Load()
+			if !limiter.allowMessage(now) {
+				c.throttle(ctx, nil, limiter.action)
+				continue
+			}
 
 			var msg domain.Message
-			if err := json.Unmarshal(message, &msg); err != nil {
-				c.logger.Error("Failed to unmarshal message", "error", err, "raw_message", string(message))
+			if err := c.codec.Decode(message, &msg); err != nil {
+				c.logger.Error("Failed to unmarshal message", "error", err, "codec", c.codec.Subprotocol())
+				c.replyError(ctx, nil, domain.NewError(domain.ErrorCodeInvalidMessage, "failed to unmarshal message"))
+				continue
+			}
+
+			// Payloads may carry credentials such as register tokens, so only
+			// their type and size are logged
+			c.logger.Info("Received message", "message_type", msg.Type, "bytes", len(message))
+
+			c.messagesReceived.Add(1)
+			if c.options.OnReceived != nil {
+				c.options.OnReceived(msg.Type)
+			}
+
+			if !limiter.allowType(msg.Type, now) {
+				c.throttle(ctx, &msg, limiter.action)
 				continue
 			}
 
@@ -166,9 +457,14 @@ func (c *Connection) readPump(ctx context.Context) {
 				msg.Timestamp = time.Now()
 			}
 
+			if c.deliverReply(&msg) {
+				continue
+			}
+
 			response, err := c.router.Handle(ctx, &msg)
 			if err != nil {
 				c.logger.Error("Failed to handle message", "error", err, "message_type", msg.Type, "message_id", msg.ID)
+				c.replyError(ctx, &msg, err)
 				continue
 			}
 
@@ -178,6 +474,10 @@ func (c *Connection) readPump(ctx context.Context) {
 					response.Timestamp = time.Now()
 				}
 
+				if response.ReplyTo == "" {
+					response.ReplyTo = msg.ID
+				}
+
 				respData, err := json.Marshal(response)
 				if err != nil {
 					c.logger.Error("Failed to marshal response", "error", err, "response_type", response.Type)
@@ -193,88 +493,192 @@ func (c *Connection) readPump(ctx context.Context) {
 	}
 }
 
+// throttle applies action to a message over its rate limit. msg is nil when
+// the message was throttled before it was decoded.
+func (c *Connection) throttle(ctx context.Context, msg *domain.Message, action ThrottleAction) {
+	var messageType domain.MessageType
+	if msg != nil {
+		messageType = msg.Type
+	}
+
+	c.logger.Warn("message throttled",
+		"client_id", c.ID(),
+		"message_type", messageType,
+		"action", action,
+	)
+
+	if c.options.OnThrottled != nil {
+		c.options.OnThrottled(messageType)
+	}
+
+	switch action {
+	case ThrottleError:
+		c.sendError(ctx, msg, domain.NewError(domain.ErrorCodeRateLimited, "rate limit exceeded"))
+	case ThrottleDisconnect:
+		c.CloseWithReason(ws.ClosePolicyViolation, "rate limit exceeded")
+	}
+}
+
+// replyError reports a failure to handle msg back to the peer when
+// ReplyErrors is enabled. msg is nil when the message could not be decoded
+// at all.
+func (c *Connection) replyError(ctx context.Context, msg *domain.Message, err error) {
+	if !c.options.ReplyErrors {
+		return
+	}
+
+	c.sendError(ctx, msg, err)
+}
+
+// sendError sends an error message in reply to msg
+func (c *Connection) sendError(ctx context.Context, msg *domain.Message, err error) {
+	var messageID string
+	if msg != nil {
+		// Never answer an error with an error
+		if msg.Type == domain.MessageTypeError {
+			return
+		}
+		messageID = msg.ID
+	}
+
+	response, err := domain.NewErrorMessage(err, messageID)
+	if err != nil {
+		c.logger.Error("Failed to create error message", "error", err)
+		return
+	}
+	response.ReplyTo = messageID
+
+	respData, err := json.Marshal(response)
+	if err != nil {
+		c.logger.Error("Failed to marshal error message", "error", err)
+		return
+	}
+
+	if err := c.Send(ctx, respData); err != nil {
+		c.logger.Error("Failed to send error message", "error", err)
+	}
+}
+
 func (c *Connection) writePump(ctx context.Context) {
 	defer func() {
 		c.logger.Debug("write pump stopped")
 	}()
 
-	var ticker *time.Ticker
+	// A nil channel never fires, which disables pings
+	var ping <-chan time.Time
 	if c.options.PingInterval > 0 {
-		ticker = time.NewTicker(c.options.PingInterval)
+		ticker := time.NewTicker(c.options.PingInterval)
 		defer ticker.Stop()
+		ping = ticker.C
 	}
 
 	for {
-		if ticker != nil {
-			select {
-			case <-c.ctx.Done():
-				return
-			case <-ctx.Done():
-				return
-			case message, ok := <-c.sendChan:
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-ctx.Done():
+			return
+		case item, ok := <-c.sendChan:
+			if !ok {
 				c.conn.SetWriteDeadline(time.Now().Add(c.options.WriteTimeout))
+				c.conn.WriteMessage(ws.CloseMessage, []byte{})
+				return
+			}
 
-				if !ok {
-					c.conn.WriteMessage(ws.CloseMessage, []byte{})
-					return
-				}
-
-				if err := c.conn.WriteMessage(ws.TextMessage, message); err != nil {
-					c.logger.Error("websocket write error", "error", err)
-					return
-				}
+			if !c.write(item) {
+				return
+			}
 
-				n := len(c.sendChan)
-				for range n {
-					select {
-					case msg := <-c.sendChan:
-						if err := c.conn.WriteMessage(ws.TextMessage, msg); err != nil {
-							c.logger.Error("websocket write error", "error", err)
-							return
-						}
-					default:
+			n := len(c.sendChan)
+			for range n {
+				select {
+				case item, ok := <-c.sendChan:
+					if !ok || !c.write(item) {
+						return
 					}
+				default:
 				}
-
-			case <-ticker.C:
-				c.conn.SetWriteDeadline(time.Now().Add(c.options.WriteTimeout))
-				if err := c.conn.WriteMessage(ws.PingMessage, nil); err != nil {
-					c.logger.Error("websocket ping error", "error", err)
-					return
-				}
-				c.logger.Debug("sent ping")
 			}
-		} else {
-			select {
-			case <-c.ctx.Done():
-				return
-			case <-ctx.Done():
+
+		case <-ping:
+			c.conn.SetWriteDeadline(time.Now().Add(c.options.WriteTimeout))
+			if err := c.conn.WriteMessage(ws.PingMessage, nil); err != nil {
+				c.logger.Error("websocket ping error", "error", err)
 				return
-			case message, ok := <-c.sendChan:
-				c.conn.SetWriteDeadline(time.Now().Add(c.options.WriteTimeout))
+			}
+			c.logger.Debug("sent ping")
+		}
+	}
+}
 
-				if !ok {
-					c.conn.WriteMessage(ws.CloseMessage, []byte{})
-					return
-				}
+// write writes a queued item and reports whether the write pump should
+// keep running
+func (c *Connection) write(item outbound) bool {
+	c.conn.SetWriteDeadline(time.Now().Add(c.options.WriteTimeout))
 
-				if err := c.conn.WriteMessage(ws.TextMessage, message); err != nil {
-					c.logger.Error("websocket write error", "error", err)
-					return
-				}
+	if item.closeCode != 0 {
+		if err := c.conn.WriteMessage(ws.CloseMessage, ws.FormatCloseMessage(item.closeCode, item.closeText)); err != nil {
+			c.logger.Error("websocket close frame error", "error", err)
+		}
+		c.Close()
+		return false
+	}
 
-				n := len(c.sendChan)
-				for range n {
-					select {
-					case msg := <-c.sendChan:
-						if err := c.conn.WriteMessage(ws.TextMessage, msg); err != nil {
-							c.logger.Error("websocket write error", "error", err)
-							return
-						}
-					default:
-					}
-				}
-			}
+	if item.prepared != nil {
+		return c.writePrepared(item.prepared)
+	}
+
+	frame, err := c.encode(item.data)
+	if err != nil {
+		c.logger.Error("Failed to encode message", "error", err, "codec", c.codec.Subprotocol())
+		return true
+	}
+
+	if err := c.conn.WriteMessage(c.codec.FrameType(), frame); err != nil {
+		c.logger.Error("websocket write error", "error", err)
+		return false
+	}
+	c.messagesSent.Add(1)
+
+	return true
+}
+
+// writePrepared writes a prepared message. The first connection of each
+// codec encodes it into a websocket prepared message, which then frames and
+// compresses it once for all of them.
+func (c *Connection) writePrepared(message *domain.PreparedMessage) bool {
+	frame, err := message.Frame(c.codec.Subprotocol(), func(data []byte) (any, error) {
+		encoded, err := c.encode(data)
+		if err != nil {
+			return nil, err
 		}
+		return ws.NewPreparedMessage(c.codec.FrameType(), encoded)
+	})
+	if err != nil {
+		c.logger.Error("Failed to encode message", "error", err, "codec", c.codec.Subprotocol())
+		return true
+	}
+
+	if err := c.conn.WritePreparedMessage(frame.(*ws.PreparedMessage)); err != nil {
+		c.logger.Error("websocket write error", "error", err)
+		return false
+	}
+	c.messagesSent.Add(1)
+
+	return true
+}
+
+// encode converts a JSON message queued by Send into a frame of the
+// connection's codec
+func (c *Connection) encode(data []byte) ([]byte, error) {
+	if _, ok := c.codec.(JSONCodec); ok {
+		return data, nil
 	}
+
+	var msg domain.Message
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return nil, err
+	}
+
+	return c.codec.Encode(&msg)
 }
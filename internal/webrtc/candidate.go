@@ -32,6 +32,8 @@ func OnIceCandidate(conn *websocket.Conn, pc *PeerConnection) func(*webrtc.ICECa
 		req := domain.Message{
 			ID:        xid.New().String(),
 			Type:      domain.MessageTypeCandidate,
+			FromID:    pc.ID(),
+			ToID:      targetID,
 			Timestamp: time.Now(),
 			Data:      data,
 		}
@@ -19,6 +19,15 @@ func FromContext(ctx context.Context) *Logger {
 	return New(Config{Level: "info", Format: "text"})
 }
 
+// FromContextOr extracts a logger from the context, or returns fallback when
+// the context has none
+func FromContextOr(ctx context.Context, fallback *Logger) *Logger {
+	if logger, ok := ctx.Value(loggerKey).(*Logger); ok {
+		return logger
+	}
+	return fallback
+}
+
 // WithLogger adds a logger to the context
 func WithLogger(ctx context.Context, logger *Logger) context.Context {
 	return context.WithValue(ctx, loggerKey, logger)
@@ -29,6 +38,7 @@ func AddFields(ctx context.Context, fields ...any) context.Context {
 	logger := FromContext(ctx)
 	newLogger := &Logger{
 		Logger: logger.With(fields...),
+		level:  logger.level,
 	}
 	return WithLogger(ctx, newLogger)
 }
@@ -15,10 +15,12 @@ type Config struct {
 
 type Logger struct {
 	*slog.Logger
+	level *slog.LevelVar
 }
 
 func New(cfg Config) *Logger {
-	level := parseLevel(cfg.Level)
+	level := new(slog.LevelVar)
+	level.Set(parseLevel(cfg.Level))
 
 	var handler slog.Handler
 	opts := &slog.HandlerOptions{
@@ -34,6 +36,24 @@ func New(cfg Config) *Logger {
 
 	return &Logger{
 		Logger: slog.New(handler),
+		level:  level,
+	}
+}
+
+// SetLevel changes the level of the logger and every logger derived from it
+func (l *Logger) SetLevel(level string) {
+	if l.level != nil {
+		l.level.Set(parseLevel(level))
+	}
+}
+
+// ValidLevel reports whether level is a level name SetLevel understands
+func ValidLevel(level string) bool {
+	switch strings.ToLower(level) {
+	case "", "debug", "info", "warn", "warning", "error":
+		return true
+	default:
+		return false
 	}
 }
 
@@ -44,6 +64,7 @@ func (l *Logger) WithFields(fields map[string]any) *Logger {
 	}
 	return &Logger{
 		Logger: l.With(attrs...),
+		level:  l.level,
 	}
 }
 
@@ -2,7 +2,6 @@ package registry
 
 import (
 	"context"
-	"errors"
 
 	"github.com/HMasataka/conic/domain"
 )
@@ -14,6 +13,45 @@ type Handler interface {
 
 type HandlerFunc func(ctx context.Context, msg *domain.Message) (*domain.Message, error)
 
+// Handle calls f
+func (f HandlerFunc) Handle(ctx context.Context, msg *domain.Message) (*domain.Message, error) {
+	return f(ctx, msg)
+}
+
+// CanHandle reports true for every message type
+func (f HandlerFunc) CanHandle(messageType domain.MessageType) bool {
+	return true
+}
+
+// Middleware wraps a handler with behaviour shared by every message type,
+// such as logging or recovery
+type Middleware func(next Handler) Handler
+
+// Chain wraps handler with middlewares. The first middleware is the
+// outermost, so it sees each message first.
+func Chain(handler Handler, middlewares ...Middleware) Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+	return handler
+}
+
+// Wrap returns a handler that handles messages with fn and otherwise
+// behaves like next. Middlewares use it to keep the CanHandle of the
+// handler they wrap.
+func Wrap(next Handler, fn HandlerFunc) Handler {
+	return &wrapped{Handler: next, fn: fn}
+}
+
+type wrapped struct {
+	Handler
+	fn HandlerFunc
+}
+
+func (w *wrapped) Handle(ctx context.Context, msg *domain.Message) (*domain.Message, error) {
+	return w.fn(ctx, msg)
+}
+
 type HandlerRegistry interface {
 	Register(messageType domain.MessageType, handler Handler)
 
@@ -43,16 +81,16 @@ func (r *DefaultHandlerRegistry) Get(messageType domain.MessageType) (Handler, b
 
 func (r *DefaultHandlerRegistry) Handle(ctx context.Context, msg *domain.Message) (*domain.Message, error) {
 	if msg == nil {
-		return nil, errors.New("message is nil")
+		return nil, domain.NewError(domain.ErrorCodeInvalidMessage, "message is nil")
 	}
 
 	handler, ok := r.Get(msg.Type)
 	if !ok {
-		return nil, errors.New("no handler found for message type: " + string(msg.Type))
+		return nil, domain.NewError(domain.ErrorCodeUnknownType, "no handler found for message type: "+string(msg.Type))
 	}
 
 	if handler == nil {
-		return nil, errors.New("handler is nil for message type: " + string(msg.Type))
+		return nil, domain.NewError(domain.ErrorCodeInternal, "handler is nil for message type: "+string(msg.Type))
 	}
 
 	return handler.Handle(ctx, msg)
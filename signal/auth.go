@@ -0,0 +1,78 @@
+package signal
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Identity is what a successful authentication proves about a client
+type Identity struct {
+	// ClientID is the only client ID the client may register as
+	ClientID string
+	// Tenant optionally groups clients for authorization decisions
+	Tenant string
+	// ExpiresAt is when the credentials stop being valid. Connections are
+	// closed when it passes, and can no longer resume their session.
+	ExpiresAt time.Time
+}
+
+// Expired reports whether the credentials are no longer valid at now
+func (i Identity) Expired(now time.Time) bool {
+	return !i.ExpiresAt.IsZero() && !now.Before(i.ExpiresAt)
+}
+
+// Authenticator verifies the token a client presents on the websocket
+// upgrade or in its register request
+type Authenticator interface {
+	Authenticate(ctx context.Context, token string) (Identity, error)
+}
+
+type identityKey struct{}
+
+// WithIdentity adds an authenticated identity to the context
+func WithIdentity(ctx context.Context, identity Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, identity)
+}
+
+// IdentityFromContext returns the identity authenticated on websocket upgrade
+func IdentityFromContext(ctx context.Context) (Identity, bool) {
+	identity, ok := ctx.Value(identityKey{}).(Identity)
+	return identity, ok
+}
+
+// tokenParam is the query parameter browsers pass their token in
+const tokenParam = "token"
+
+// tokenFromRequest reads a bearer token from the Authorization header or,
+// for browsers that cannot set headers on websockets, the token query
+// parameter
+func tokenFromRequest(r *http.Request) string {
+	if header := r.Header.Get("Authorization"); header != "" {
+		if token, ok := strings.CutPrefix(header, "Bearer "); ok {
+			return strings.TrimSpace(token)
+		}
+	}
+
+	return r.URL.Query().Get(tokenParam)
+}
+
+// RedactToken returns a copy of r with the token query parameter masked, for
+// logging requests without their credentials. Requests without one are
+// returned as is.
+func RedactToken(r *http.Request) *http.Request {
+	query := r.URL.Query()
+	if !query.Has(tokenParam) {
+		return r
+	}
+	query.Set(tokenParam, "REDACTED")
+
+	u := *r.URL
+	u.RawQuery = query.Encode()
+
+	redacted := r.WithContext(r.Context())
+	redacted.URL = &u
+	redacted.RequestURI = u.RequestURI()
+	return redacted
+}
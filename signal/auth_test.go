@@ -0,0 +1,86 @@
+package signal
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHMACAuthenticator(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	authenticator := NewHMACAuthenticator([]byte("secret"))
+	authenticator.now = func() time.Time { return now }
+
+	identity := Identity{ClientID: "alice", Tenant: "acme", ExpiresAt: now.Add(time.Hour)}
+	valid, err := authenticator.Issue(identity)
+	if err != nil {
+		t.Fatalf("Issue() error = %v", err)
+	}
+	parts := strings.Split(valid, ".")
+
+	// signed builds a correctly signed token from a header and claims
+	signed := func(header, claims string) string {
+		signingInput := base64.RawURLEncoding.EncodeToString([]byte(header)) + "." +
+			base64.RawURLEncoding.EncodeToString([]byte(claims))
+		return signingInput + "." + authenticator.sign(signingInput)
+	}
+
+	other := NewHMACAuthenticator([]byte("other secret"))
+	otherToken, err := other.Issue(identity)
+	if err != nil {
+		t.Fatalf("Issue() error = %v", err)
+	}
+
+	expired, err := authenticator.Issue(Identity{ClientID: "alice", ExpiresAt: now})
+	if err != nil {
+		t.Fatalf("Issue() error = %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		token   string
+		want    Identity
+		wantErr error
+	}{
+		{name: "valid", token: valid, want: identity},
+		{name: "signed with another secret", token: otherToken, wantErr: ErrInvalidToken},
+		{name: "tampered signature", token: parts[0] + "." + parts[1] + "." + strings.Repeat("A", len(parts[2])), wantErr: ErrInvalidToken},
+		{name: "tampered claims", token: parts[0] + "." + base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"mallory","exp":1800000000}`)) + "." + parts[2], wantErr: ErrInvalidToken},
+		{name: "expired", token: expired, wantErr: ErrTokenExpired},
+		{name: "alg none", token: signed(`{"alg":"none","typ":"JWT"}`, `{"sub":"alice","exp":1800000000}`), wantErr: ErrInvalidToken},
+		{name: "alg HS512", token: signed(`{"alg":"HS512","typ":"JWT"}`, `{"sub":"alice","exp":1800000000}`), wantErr: ErrInvalidToken},
+		{name: "unsigned", token: parts[0] + "." + parts[1] + ".", wantErr: ErrInvalidToken},
+		{name: "two segments", token: parts[0] + "." + parts[1], wantErr: ErrInvalidToken},
+		{name: "four segments", token: valid + "." + parts[2], wantErr: ErrInvalidToken},
+		{name: "empty", token: "", wantErr: ErrInvalidToken},
+		{name: "claims are not base64", token: parts[0] + ".!!." + authenticator.sign(parts[0]+".!!"), wantErr: ErrInvalidToken},
+		{name: "claims are not JSON", token: signed(`{"alg":"HS256","typ":"JWT"}`, "not json"), wantErr: ErrInvalidToken},
+		{name: "no subject", token: signed(`{"alg":"HS256","typ":"JWT"}`, `{"exp":1800000000}`), wantErr: ErrInvalidToken},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := authenticator.Authenticate(context.Background(), tt.token)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Authenticate() error = %v, want %v", err, tt.wantErr)
+			}
+			if got.ClientID != tt.want.ClientID || got.Tenant != tt.want.Tenant || !got.ExpiresAt.Equal(tt.want.ExpiresAt) {
+				t.Fatalf("Authenticate() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHMACAuthenticatorIssueRequiresClaims(t *testing.T) {
+	authenticator := NewHMACAuthenticator([]byte("secret"))
+
+	if _, err := authenticator.Issue(Identity{ExpiresAt: time.Now().Add(time.Hour)}); err == nil {
+		t.Error("Issue() accepted an identity without a client ID")
+	}
+	if _, err := authenticator.Issue(Identity{ClientID: "alice"}); err == nil {
+		t.Error("Issue() accepted an identity without an expiry")
+	}
+}
@@ -3,204 +3,703 @@ package signal
 import (
 	"context"
 	"encoding/json"
-	"errors"
-	"time"
+	"slices"
 
-	"github.com/HMasataka/conic"
 	"github.com/HMasataka/conic/domain"
+	"github.com/HMasataka/conic/internal/transport"
 	"github.com/HMasataka/conic/logging"
+	ws "github.com/gorilla/websocket"
 	"github.com/rs/xid"
 )
 
 type RegisterRequestHandler struct {
-	hub    domain.Hub
-	logger *logging.Logger
+	sessions      *Sessions
+	authenticator Authenticator
+	iceServers    []domain.ICEServer
+	requireHello  bool
+	logger        *logging.Logger
 }
 
-func NewRegisterRequestHandler(hub domain.Hub, logger *logging.Logger) *RegisterRequestHandler {
+// NewRegisterRequestHandler creates a register handler. A nil authenticator
+// lets clients register under any ID. The ICE servers are handed to clients
+// in the register response.
+func NewRegisterRequestHandler(sessions *Sessions, authenticator Authenticator, iceServers []domain.ICEServer, logger *logging.Logger) *RegisterRequestHandler {
 	return &RegisterRequestHandler{
-		hub:    hub,
-		logger: logger,
+		sessions:      sessions,
+		authenticator: authenticator,
+		iceServers:    iceServers,
+		logger:        logger,
 	}
 }
 
 func (h *RegisterRequestHandler) Handle(ctx context.Context, msg *domain.Message) (*domain.Message, error) {
+	logger := logging.FromContextOr(ctx, h.logger)
+
 	var req domain.RegisterRequest
 	if err := json.Unmarshal(msg.Data, &req); err != nil {
-		h.logger.Error("failed to unmarshal register request", "error", err)
-		return nil, errors.New("failed to unmarshal register request")
+		logger.Error("failed to unmarshal register request", "error", err)
+		return nil, domain.NewError(domain.ErrorCodeInvalidMessage, "failed to unmarshal register request")
+	}
+
+	conn, ok := transport.ConnectionFromContext(ctx)
+	if !ok {
+		logger.Error("connection not found in context")
+		return nil, domain.NewError(domain.ErrorCodeInternal, "connection not found")
+	}
+
+	if bound := conn.ID(); bound != "" {
+		logger.Warn("connection already registered", "client_id", bound, "requested", req.ClientID)
+		return nil, domain.NewError(domain.ErrorCodeAlreadyRegistered, "connection is already registered as "+bound)
 	}
 
-	conn, ok := conic.ConnectionFromContext(ctx)
-	if !ok || conn == nil {
-		h.logger.Error("connection not found in context")
-		return nil, errors.New("connection not found")
+	if _, ok := conn.Capabilities(); h.requireHello && !ok {
+		logger.Warn("register without hello refused", "client_id", req.ClientID)
+		return h.refuse(ctx, conn, msg, req.ClientID, "hello is required before register", "hello required")
 	}
 
-	socket := domain.NewClient(req.ClientID, conn)
+	// Connections authenticated on upgrade skip the token check
+	identity, authenticated := IdentityFromContext(ctx)
 
-	if err := h.hub.Register(socket); err != nil {
-		h.logger.Error("failed to register client", "client_id", req.ClientID, "error", err)
-		return nil, errors.New("failed to register client")
+	if req.ResumeToken != "" {
+		return h.resume(ctx, conn, msg, req, identity, authenticated)
+	}
+	if !authenticated && h.authenticator != nil {
+		var err error
+		identity, err = h.authenticator.Authenticate(ctx, req.Token)
+		if err != nil {
+			logger.Warn("register authentication failed", "error", err, "client_id", req.ClientID)
+			return h.refuse(ctx, conn, msg, req.ClientID, "authentication failed: "+err.Error(), "authentication failed")
+		}
+		authenticated = true
 	}
 
-	resp := domain.RegisterResponse{
-		ClientID: req.ClientID,
-		Success:  true,
+	clientID := req.ClientID
+	if authenticated {
+		if clientID != "" && clientID != identity.ClientID {
+			logger.Warn("register client ID not allowed by token", "client_id", clientID, "allowed", identity.ClientID)
+			return h.refuse(ctx, conn, msg, clientID, "token does not allow client ID "+clientID, "authentication failed")
+		}
+		clientID = identity.ClientID
 	}
 
-	respData, err := json.Marshal(resp)
+	if clientID == "" {
+		clientID = xid.New().String()
+	}
+	identity.ClientID = clientID
+
+	resumeToken, err := h.sessions.Register(conn, identity)
 	if err != nil {
-		return nil, errors.New("failed to marshal register response: " + err.Error())
+		logger.Error("failed to register client", "client_id", clientID, "error", err)
+		return nil, err
 	}
 
-	response := &domain.Message{
-		ID:        xid.New().String(),
-		Type:      domain.MessageTypeRegisterResponse,
-		Timestamp: time.Now(),
-		Data:      respData,
+	response, err := domain.NewMessage(domain.MessageTypeRegisterResponse, domain.RegisterResponse{
+		ClientID:    clientID,
+		Success:     true,
+		ResumeToken: resumeToken,
+		ICEServers:  h.iceServers,
+	})
+	if err != nil {
+		return nil, domain.NewError(domain.ErrorCodeInternal, "failed to marshal register response: "+err.Error())
 	}
 
-	h.logger.Info("client registered", "client_id", req.ClientID)
+	logger.Info("client registered", "client_id", clientID)
 
 	return response, nil
 }
 
+// resume moves an existing session onto conn. The resume token stands in for
+// authentication, but a connection authenticated on upgrade may only resume
+// its own ID. The response is sent before the held messages are replayed.
+func (h *RegisterRequestHandler) resume(ctx context.Context, conn *transport.Connection, msg *domain.Message, req domain.RegisterRequest, identity Identity, authenticated bool) (*domain.Message, error) {
+	logger := logging.FromContextOr(ctx, h.logger)
+
+	if authenticated && req.ClientID != identity.ClientID {
+		logger.Warn("resume client ID not allowed by token", "client_id", req.ClientID, "allowed", identity.ClientID)
+		return nil, domain.NewError(domain.ErrorCodeUnauthorized, "token does not allow client ID "+req.ClientID)
+	}
+
+	err := h.sessions.Resume(ctx, conn, req.ClientID, req.ResumeToken, func(token string) {
+		response, err := domain.NewMessage(domain.MessageTypeRegisterResponse, domain.RegisterResponse{
+			ClientID:    req.ClientID,
+			Success:     true,
+			ResumeToken: token,
+			Resumed:     true,
+			ICEServers:  h.iceServers,
+		})
+		if err != nil {
+			logger.Error("failed to create register response", "error", err)
+			return
+		}
+		response.ReplyTo = msg.ID
+
+		data, err := json.Marshal(response)
+		if err != nil {
+			logger.Error("failed to marshal register response", "error", err)
+			return
+		}
+
+		if err := conn.Send(ctx, data); err != nil {
+			logger.Error("failed to send register response", "client_id", req.ClientID, "error", err)
+		}
+	})
+	if err != nil {
+		logger.Warn("failed to resume session", "client_id", req.ClientID, "error", err)
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+// refuse replies with a failed register response and closes the connection
+// with closeText once the response has been written
+func (h *RegisterRequestHandler) refuse(ctx context.Context, conn *transport.Connection, msg *domain.Message, clientID, reason, closeText string) (*domain.Message, error) {
+	response, err := domain.NewMessage(domain.MessageTypeRegisterResponse, domain.RegisterResponse{
+		ClientID: clientID,
+		Success:  false,
+		Error:    reason,
+	})
+	if err != nil {
+		return nil, domain.NewError(domain.ErrorCodeInternal, "failed to marshal register response: "+err.Error())
+	}
+	response.ReplyTo = msg.ID
+
+	data, err := json.Marshal(response)
+	if err != nil {
+		return nil, domain.NewError(domain.ErrorCodeInternal, "failed to marshal register response: "+err.Error())
+	}
+
+	if err := conn.Send(ctx, data); err != nil {
+		logging.FromContextOr(ctx, h.logger).Error("failed to send register failure", "error", err)
+	}
+
+	conn.CloseWithReason(ws.ClosePolicyViolation, closeText)
+	return nil, nil
+}
+
 // CanHandle implements protocol.Handler
 func (h *RegisterRequestHandler) CanHandle(messageType domain.MessageType) bool {
 	return messageType == domain.MessageTypeRegisterRequest
 }
 
-// SDPHandler handles SDP exchange
-type SDPHandler struct {
-	hub    domain.Hub
-	logger *logging.Logger
+type UnregisterRequestHandler struct {
+	hub      domain.Hub
+	sessions *Sessions
+	logger   *logging.Logger
 }
 
-// NewSDPHandler creates a new SDP handler
-func NewSDPHandler(hub domain.Hub, logger *logging.Logger) *SDPHandler {
-	return &SDPHandler{
-		hub:    hub,
-		logger: logger,
+func NewUnregisterRequestHandler(hub domain.Hub, sessions *Sessions, logger *logging.Logger) *UnregisterRequestHandler {
+	return &UnregisterRequestHandler{
+		hub:      hub,
+		sessions: sessions,
+		logger:   logger,
 	}
 }
 
-// Handle implements protocol.Handler
-func (h *SDPHandler) Handle(ctx context.Context, message *domain.Message) (*domain.Message, error) {
-	var sdpMsg domain.SDPMessage
-	if err := json.Unmarshal(message.Data, &sdpMsg); err != nil {
-		return nil, errors.New("failed to unmarshal SDP message")
+func (h *UnregisterRequestHandler) Handle(ctx context.Context, msg *domain.Message) (*domain.Message, error) {
+	logger := logging.FromContextOr(ctx, h.logger)
+
+	var req domain.UnregisterRequest
+	if err := json.Unmarshal(msg.Data, &req); err != nil {
+		logger.Error("failed to unmarshal unregister request", "error", err)
+		return nil, domain.NewError(domain.ErrorCodeInvalidMessage, "failed to unmarshal unregister request")
+	}
+
+	clientID, err := requestClientID(ctx, req.ClientID)
+	if err != nil {
+		logger.Warn("rejected unregister request", "error", err, "client_id", req.ClientID)
+		return nil, err
+	}
+	req.ClientID = clientID
+
+	if _, exists := h.hub.GetClient(req.ClientID); !exists {
+		logger.Warn("client not registered", "client_id", req.ClientID)
+		return nil, domain.NewError(domain.ErrorCodeNotRegistered, "client not registered: "+req.ClientID)
+	}
+
+	// The socket stays open, so detach it from the ID to keep the close hook
+	// from unregistering the client a second time.
+	conn, ok := transport.ConnectionFromContext(ctx)
+	if ok {
+		conn.SetID("")
+	}
+
+	if err := h.sessions.Unregister(req.ClientID); err != nil {
+		if ok {
+			conn.SetID(req.ClientID)
+		}
+		logger.Error("failed to unregister client", "client_id", req.ClientID, "error", err)
+		return nil, err
+	}
+
+	response, err := domain.NewMessage(domain.MessageTypeUnregisterResponse, domain.UnregisterResponse{
+		ClientID: req.ClientID,
+		Success:  true,
+	})
+	if err != nil {
+		return nil, domain.NewError(domain.ErrorCodeInternal, "failed to marshal unregister response: "+err.Error())
+	}
+
+	logger.Info("client unregistered", "client_id", req.ClientID)
+
+	return response, nil
+}
+
+func (h *UnregisterRequestHandler) CanHandle(messageType domain.MessageType) bool {
+	return messageType == domain.MessageTypeUnregisterRequest
+}
+
+// ForwardHandler forwards addressed messages to their recipient
+type ForwardHandler struct {
+	hub            domain.Hub
+	sessions       *Sessions
+	policy         Policy
+	senderMismatch SenderMismatchAction
+	logger         *logging.Logger
+}
+
+// NewForwardHandler creates a new forward handler. Every message is checked
+// against policy before it is forwarded.
+func NewForwardHandler(hub domain.Hub, sessions *Sessions, policy Policy, senderMismatch SenderMismatchAction, logger *logging.Logger) *ForwardHandler {
+	return &ForwardHandler{
+		hub:            hub,
+		sessions:       sessions,
+		policy:         policy,
+		senderMismatch: senderMismatch,
+		logger:         logger,
+	}
+}
+
+// Handle implements registry.Handler
+func (h *ForwardHandler) Handle(ctx context.Context, message *domain.Message) (*domain.Message, error) {
+	logger := logging.FromContextOr(ctx, h.logger)
+
+	sender, ok := senderID(ctx)
+	if !ok {
+		logger.Warn("message from unregistered connection", "type", message.Type)
+		return nil, domain.NewError(domain.ErrorCodeNotRegistered, "register before sending "+string(message.Type))
+	}
+
+	if message.Type.ServerOriginated() {
+		logger.Warn("client sent server message type", "type", message.Type, "client_id", sender)
+		return nil, domain.NewError(domain.ErrorCodeForbidden, "clients may not send "+string(message.Type))
+	}
+
+	if err := resolveRoute(message); err != nil {
+		logger.Error("failed to resolve message route", "error", err, "type", message.Type)
+		return nil, err
+	}
+
+	claimed := message.FromID
+	accepted, err := bindSender(message, sender, h.senderMismatch, legacyPayloadField(message.Type))
+	if err != nil {
+		logger.Error("failed to bind message sender", "error", err, "type", message.Type)
+		return nil, err
+	}
+
+	if !accepted {
+		logger.Warn("rejected spoofed sender",
+			"type", message.Type,
+			"client_id", sender,
+			"claimed", claimed,
+		)
+		return nil, domain.NewError(domain.ErrorCodeSenderMismatch, "sender does not match registered client "+sender)
+	}
+
+	// Only the server replies to requests, so a relayed reply could only
+	// impersonate it
+	message.ReplyTo = ""
+
+	request := h.policyRequest(message)
+	if !h.policy.Allow(ctx, request) {
+		logger.Warn("message denied by policy",
+			"type", message.Type,
+			"from", message.FromID,
+			"to", message.ToID,
+		)
+		return nil, domain.NewError(domain.ErrorCodeForbidden, "not allowed to send "+string(message.Type)+" to "+message.ToID)
 	}
 
-	// TODO domain.MessageがFromID, ToIDを持つようにする
 	m, err := json.Marshal(message)
 	if err != nil {
-		h.logger.Error("failed to marshal SDP message", "error", err)
-		return nil, errors.New("failed to marshal SDP message")
+		logger.Error("failed to marshal message", "error", err, "type", message.Type)
+		return nil, domain.NewError(domain.ErrorCodeInternal, "failed to marshal message")
+	}
+
+	// The hub reports unknown recipients, or holds the message for them when
+	// it has a mailbox
+	if err := h.hub.SendTo(message.ToID, m); err != nil {
+		logger.Warn("failed to forward message", "error", err, "type", message.Type, "to_id", message.ToID)
+		return nil, err
 	}
 
-	if err := h.hub.SendTo(sdpMsg.ToID, m); err != nil {
-		h.logger.Error("failed to send SDP message", "error", err, "to_id", sdpMsg.ToID)
-		return nil, errors.New("failed to send SDP message")
+	h.sessions.Peers().Connect(message.FromID, message.ToID)
+
+	if observer, ok := h.policy.(PolicyObserver); ok {
+		observer.Forwarded(ctx, request)
 	}
 
-	h.logger.Debug("SDP forwarded",
-		"from", sdpMsg.FromID,
-		"to", sdpMsg.ToID,
-		"type", sdpMsg.SessionDescription.Type,
+	logger.Debug("message forwarded",
+		"type", message.Type,
+		"from", message.FromID,
+		"to", message.ToID,
 	)
 
 	return nil, nil
 }
 
-func (h *SDPHandler) CanHandle(messageType domain.MessageType) bool {
-	return messageType == domain.MessageTypeSDP
+// policyRequest describes message to the policy using the identities its
+// sender and recipient registered with
+func (h *ForwardHandler) policyRequest(message *domain.Message) PolicyRequest {
+	return PolicyRequest{
+		Type: message.Type,
+		From: h.sessions.policyIdentity(message.FromID),
+		To:   h.sessions.policyIdentity(message.ToID),
+	}
+}
+
+// CanHandle implements registry.Handler. Any message type can be forwarded
+// as long as it is addressed; Handle rejects the types only the server sends.
+func (h *ForwardHandler) CanHandle(messageType domain.MessageType) bool {
+	return true
+}
+
+// legacyRoute holds the routing fields that SDP, candidate and data channel
+// payloads carried before they moved onto the envelope.
+type legacyRoute struct {
+	FromID string `json:"from_id"`
+	ToID   string `json:"to_id"`
+}
+
+// resolveRoute fills the envelope routing fields of message. Payloads of the
+// legacy peer-to-peer types are only decoded when the envelope has no ToID.
+func resolveRoute(message *domain.Message) error {
+	if message.ToID != "" {
+		return nil
+	}
+
+	if legacyPayloadField(message.Type) == "" {
+		return domain.NewError(domain.ErrorCodeUnknownType, "no handler found for unaddressed message type: "+string(message.Type))
+	}
+
+	var route legacyRoute
+	if err := json.Unmarshal(message.Data, &route); err != nil {
+		return domain.NewError(domain.ErrorCodeInvalidMessage, "failed to unmarshal "+string(message.Type)+" message")
+	}
+
+	if route.ToID == "" {
+		return domain.NewError(domain.ErrorCodeInvalidMessage, "message is not addressed: "+string(message.Type))
+	}
+
+	message.ToID = route.ToID
+	if message.FromID == "" {
+		message.FromID = route.FromID
+	}
+
+	return nil
 }
 
-type ICECandidateHandler struct {
+// legacyPayloadField returns the payload field that repeats the sender for
+// message types that predate the envelope routing fields
+func legacyPayloadField(messageType domain.MessageType) string {
+	switch messageType {
+	case domain.MessageTypeSDP, domain.MessageTypeCandidate, domain.MessageTypeDataChannel:
+		return "from_id"
+	default:
+		return ""
+	}
+}
+
+// requestClientID resolves the client a request acts on. Clients may omit
+// the ID, but may not act on behalf of another client.
+func requestClientID(ctx context.Context, requested string) (string, error) {
+	sender, ok := senderID(ctx)
+	if !ok {
+		return "", domain.NewError(domain.ErrorCodeNotRegistered, "register before acting as "+requested)
+	}
+
+	if requested != "" && requested != sender {
+		return "", domain.NewError(domain.ErrorCodeSenderMismatch, "cannot act as "+requested+" from connection registered as "+sender)
+	}
+
+	return sender, nil
+}
+
+type ListPeersHandler struct {
+	hub      domain.Hub
+	sessions *Sessions
+	logger   *logging.Logger
+}
+
+func NewListPeersHandler(hub domain.Hub, sessions *Sessions, logger *logging.Logger) *ListPeersHandler {
+	return &ListPeersHandler{
+		hub:      hub,
+		sessions: sessions,
+		logger:   logger,
+	}
+}
+
+func (h *ListPeersHandler) Handle(ctx context.Context, message *domain.Message) (*domain.Message, error) {
+	logger := logging.FromContextOr(ctx, h.logger)
+
+	var req domain.ListPeersRequest
+	if len(message.Data) > 0 {
+		if err := json.Unmarshal(message.Data, &req); err != nil {
+			logger.Error("failed to unmarshal list peers request", "error", err)
+			return nil, domain.NewError(domain.ErrorCodeInvalidMessage, "failed to unmarshal list peers request")
+		}
+	}
+
+	clientID, err := requestClientID(ctx, "")
+	if err != nil {
+		logger.Warn("rejected list peers request", "error", err)
+		return nil, err
+	}
+
+	var peers []string
+	if req.RoomID != "" {
+		members := h.hub.GetRoomMembers(req.RoomID)
+		if !slices.Contains(members, clientID) {
+			logger.Warn("list peers of room without membership", "room_id", req.RoomID, "client_id", clientID)
+			return nil, domain.NewError(domain.ErrorCodeForbidden, "not a member of room "+req.RoomID)
+		}
+
+		peers = slices.DeleteFunc(members, func(id string) bool {
+			return id == clientID
+		})
+	} else {
+		peers = visiblePeers(h.hub, h.sessions.Presence(), clientID)
+	}
+
+	if peers == nil {
+		peers = []string{}
+	}
+
+	response, err := domain.NewMessage(domain.MessageTypeListPeersResponse, domain.ListPeersResponse{
+		RoomID: req.RoomID,
+		Peers:  peers,
+	})
+	if err != nil {
+		return nil, domain.NewError(domain.ErrorCodeInternal, "failed to marshal list peers response: "+err.Error())
+	}
+
+	return response, nil
+}
+
+func (h *ListPeersHandler) CanHandle(messageType domain.MessageType) bool {
+	return messageType == domain.MessageTypeListPeersRequest
+}
+
+type JoinRoomHandler struct {
 	hub    domain.Hub
 	logger *logging.Logger
 }
 
-func NewICECandidateHandler(hub domain.Hub, logger *logging.Logger) *ICECandidateHandler {
-	return &ICECandidateHandler{
+func NewJoinRoomHandler(hub domain.Hub, logger *logging.Logger) *JoinRoomHandler {
+	return &JoinRoomHandler{
 		hub:    hub,
 		logger: logger,
 	}
 }
 
-func (h *ICECandidateHandler) Handle(ctx context.Context, message *domain.Message) (*domain.Message, error) {
-	var iceMsg domain.ICECandidateMessage
-	if err := json.Unmarshal(message.Data, &iceMsg); err != nil {
-		h.logger.Error("failed to unmarshal ICE candidate message", "error", err)
-		return nil, errors.New("failed to unmarshal ICE candidate message")
+func (h *JoinRoomHandler) Handle(ctx context.Context, message *domain.Message) (*domain.Message, error) {
+	logger := logging.FromContextOr(ctx, h.logger)
+
+	var req domain.JoinRoomRequest
+	if err := json.Unmarshal(message.Data, &req); err != nil {
+		logger.Error("failed to unmarshal join room request", "error", err)
+		return nil, domain.NewError(domain.ErrorCodeInvalidMessage, "failed to unmarshal join room request")
 	}
 
-	// TODO domain.MessageがFromID, ToIDを持つようにする
-	m, err := json.Marshal(message)
+	clientID, err := requestClientID(ctx, req.ClientID)
 	if err != nil {
-		h.logger.Error("failed to marshal SDP message", "error", err)
-		return nil, errors.New("failed to marshal SDP message")
+		logger.Warn("rejected join room request", "error", err, "client_id", req.ClientID)
+		return nil, err
 	}
+	req.ClientID = clientID
 
-	if err := h.hub.SendTo(iceMsg.ToID, m); err != nil {
-		h.logger.Error("failed to send ICE candidate", "error", err, "to_id", iceMsg.ToID)
-		return nil, errors.New("failed to send ICE candidate")
+	if err := h.hub.JoinRoom(req.RoomID, req.ClientID); err != nil {
+		logger.Error("failed to join room", "error", err, "room_id", req.RoomID, "client_id", req.ClientID)
+		return nil, err
 	}
 
-	h.logger.Debug("ICE candidate forwarded",
-		"from", iceMsg.FromID,
-		"to", iceMsg.ToID,
-	)
+	response, err := domain.NewMessage(domain.MessageTypeJoinRoomResponse, domain.JoinRoomResponse{
+		RoomID:  req.RoomID,
+		Members: h.hub.GetRoomMembers(req.RoomID),
+		Success: true,
+	})
+	if err != nil {
+		return nil, domain.NewError(domain.ErrorCodeInternal, "failed to marshal join room response: "+err.Error())
+	}
 
-	return nil, nil
+	logger.Debug("client joined room", "room_id", req.RoomID, "client_id", req.ClientID)
+
+	return response, nil
 }
 
-func (h *ICECandidateHandler) CanHandle(messageType domain.MessageType) bool {
-	return messageType == domain.MessageTypeCandidate
+func (h *JoinRoomHandler) CanHandle(messageType domain.MessageType) bool {
+	return messageType == domain.MessageTypeJoinRoomRequest
 }
 
-type DataChannelHandler struct {
+type LeaveRoomHandler struct {
 	hub    domain.Hub
 	logger *logging.Logger
 }
 
-func NewDataChannelHandler(hub domain.Hub, logger *logging.Logger) *DataChannelHandler {
-	return &DataChannelHandler{
+func NewLeaveRoomHandler(hub domain.Hub, logger *logging.Logger) *LeaveRoomHandler {
+	return &LeaveRoomHandler{
 		hub:    hub,
 		logger: logger,
 	}
 }
 
-func (h *DataChannelHandler) Handle(ctx context.Context, message *domain.Message) (*domain.Message, error) {
-	var dcMsg domain.DataChannelMessage
-	if err := json.Unmarshal(message.Data, &dcMsg); err != nil {
-		h.logger.Error("failed to unmarshal data channel message", "error", err)
-		return nil, errors.New("failed to unmarshal data channel message")
+func (h *LeaveRoomHandler) Handle(ctx context.Context, message *domain.Message) (*domain.Message, error) {
+	logger := logging.FromContextOr(ctx, h.logger)
+
+	var req domain.LeaveRoomRequest
+	if err := json.Unmarshal(message.Data, &req); err != nil {
+		logger.Error("failed to unmarshal leave room request", "error", err)
+		return nil, domain.NewError(domain.ErrorCodeInvalidMessage, "failed to unmarshal leave room request")
+	}
+
+	clientID, err := requestClientID(ctx, req.ClientID)
+	if err != nil {
+		logger.Warn("rejected leave room request", "error", err, "client_id", req.ClientID)
+		return nil, err
+	}
+	req.ClientID = clientID
+
+	if err := h.hub.LeaveRoom(req.RoomID, req.ClientID); err != nil {
+		logger.Error("failed to leave room", "error", err, "room_id", req.RoomID, "client_id", req.ClientID)
+		return nil, err
+	}
+
+	response, err := domain.NewMessage(domain.MessageTypeLeaveRoomResponse, domain.LeaveRoomResponse{
+		RoomID:  req.RoomID,
+		Success: true,
+	})
+	if err != nil {
+		return nil, domain.NewError(domain.ErrorCodeInternal, "failed to marshal leave room response: "+err.Error())
+	}
+
+	logger.Debug("client left room", "room_id", req.RoomID, "client_id", req.ClientID)
+
+	return response, nil
+}
+
+func (h *LeaveRoomHandler) CanHandle(messageType domain.MessageType) bool {
+	return messageType == domain.MessageTypeLeaveRoomRequest
+}
+
+// RoomMessageHandler broadcasts room messages to the other members of the
+// room. Only members may send to a room, and each recipient is checked
+// against the policy.
+type RoomMessageHandler struct {
+	hub            domain.Hub
+	sessions       *Sessions
+	policy         Policy
+	senderMismatch SenderMismatchAction
+	logger         *logging.Logger
+}
+
+func NewRoomMessageHandler(hub domain.Hub, sessions *Sessions, policy Policy, senderMismatch SenderMismatchAction, logger *logging.Logger) *RoomMessageHandler {
+	return &RoomMessageHandler{
+		hub:            hub,
+		sessions:       sessions,
+		policy:         policy,
+		senderMismatch: senderMismatch,
+		logger:         logger,
+	}
+}
+
+func (h *RoomMessageHandler) Handle(ctx context.Context, message *domain.Message) (*domain.Message, error) {
+	logger := logging.FromContextOr(ctx, h.logger)
+
+	sender, ok := senderID(ctx)
+	if !ok {
+		logger.Warn("room message from unregistered connection")
+		return nil, domain.NewError(domain.ErrorCodeNotRegistered, "register before sending room messages")
+	}
+
+	claimed := message.FromID
+	accepted, err := bindSender(message, sender, h.senderMismatch, "from_id")
+	if err != nil {
+		logger.Error("failed to bind room message sender", "error", err)
+		return nil, err
+	}
+
+	if !accepted {
+		logger.Warn("rejected spoofed sender", "type", message.Type, "client_id", sender, "claimed", claimed)
+		return nil, domain.NewError(domain.ErrorCodeSenderMismatch, "sender does not match registered client "+sender)
+	}
+
+	var roomMsg domain.RoomMessage
+	if err := json.Unmarshal(message.Data, &roomMsg); err != nil {
+		logger.Error("failed to unmarshal room message", "error", err)
+		return nil, domain.NewError(domain.ErrorCodeInvalidMessage, "failed to unmarshal room message")
+	}
+	message.ReplyTo = ""
+
+	members := h.hub.GetRoomMembers(roomMsg.RoomID)
+	if !slices.Contains(members, sender) {
+		logger.Warn("room message from non-member", "client_id", sender, "room_id", roomMsg.RoomID)
+		return nil, domain.NewError(domain.ErrorCodeForbidden, "not a member of room "+roomMsg.RoomID)
+	}
+
+	recipients, denied := h.recipients(ctx, message.Type, sender, members)
+	if len(recipients) == 0 && denied > 0 {
+		logger.Warn("room message denied by policy", "from", sender, "room_id", roomMsg.RoomID)
+		return nil, domain.NewError(domain.ErrorCodeForbidden, "not allowed to send "+string(message.Type)+" to room "+roomMsg.RoomID)
 	}
 
-	// TODO domain.MessageがFromID, ToIDを持つようにする
 	m, err := json.Marshal(message)
 	if err != nil {
-		h.logger.Error("failed to marshal SDP message", "error", err)
-		return nil, errors.New("failed to marshal SDP message")
+		logger.Error("failed to marshal room message", "error", err)
+		return nil, domain.NewError(domain.ErrorCodeInternal, "failed to marshal room message")
 	}
 
-	if err := h.hub.SendTo(dcMsg.ToID, m); err != nil {
-		h.logger.Error("failed to send data channel message", "error", err, "to_id", dcMsg.ToID)
-		return nil, errors.New("failed to send data channel message")
+	if err := h.hub.SendToMultiple(recipients, m); err != nil {
+		logger.Error("failed to send room message", "error", err, "room_id", roomMsg.RoomID)
+		return nil, err
 	}
 
-	h.logger.Debug("data channel message forwarded",
-		"from", dcMsg.FromID,
-		"to", dcMsg.ToID,
-		"label", dcMsg.Label,
-		"size", len(dcMsg.Payload),
+	logger.Debug("room message forwarded",
+		"from", sender,
+		"room_id", roomMsg.RoomID,
+		"recipients", len(recipients),
+		"denied", denied,
 	)
 
 	return nil, nil
 }
 
-func (h *DataChannelHandler) CanHandle(messageType domain.MessageType) bool {
-	return messageType == domain.MessageTypeDataChannel
+// recipients returns the members other than sender that the policy lets
+// sender message, and how many it denied
+func (h *RoomMessageHandler) recipients(ctx context.Context, messageType domain.MessageType, sender string, members []string) ([]string, int) {
+	from := h.sessions.policyIdentity(sender)
+
+	recipients := make([]string, 0, len(members))
+	denied := 0
+	for _, memberID := range members {
+		if memberID == sender {
+			continue
+		}
+
+		request := PolicyRequest{
+			Type: messageType,
+			From: from,
+			To:   h.sessions.policyIdentity(memberID),
+		}
+		if !h.policy.Allow(ctx, request) {
+			denied++
+			continue
+		}
+		recipients = append(recipients, memberID)
+	}
+
+	return recipients, denied
+}
+
+func (h *RoomMessageHandler) CanHandle(messageType domain.MessageType) bool {
+	return messageType == domain.MessageTypeRoomMessage
 }
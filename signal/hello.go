@@ -0,0 +1,99 @@
+package signal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/HMasataka/conic/domain"
+	"github.com/HMasataka/conic/internal/transport"
+	"github.com/HMasataka/conic/logging"
+	ws "github.com/gorilla/websocket"
+)
+
+// HelloHandler answers hello messages with a welcome carrying the agreed
+// protocol version and features, and records them on the connection.
+// Clients that share no version with the server are sent an incompatible
+// error and disconnected.
+type HelloHandler struct {
+	features []domain.Feature
+	logger   *logging.Logger
+}
+
+// NewHelloHandler creates a hello handler offering features
+func NewHelloHandler(features []domain.Feature, logger *logging.Logger) *HelloHandler {
+	return &HelloHandler{
+		features: features,
+		logger:   logger,
+	}
+}
+
+func (h *HelloHandler) Handle(ctx context.Context, msg *domain.Message) (*domain.Message, error) {
+	logger := logging.FromContextOr(ctx, h.logger)
+
+	var hello domain.Hello
+	if err := json.Unmarshal(msg.Data, &hello); err != nil {
+		logger.Error("failed to unmarshal hello", "error", err)
+		return nil, domain.NewError(domain.ErrorCodeInvalidMessage, "failed to unmarshal hello")
+	}
+
+	conn, ok := transport.ConnectionFromContext(ctx)
+	if !ok {
+		logger.Error("connection not found in context")
+		return nil, domain.NewError(domain.ErrorCodeInternal, "connection not found")
+	}
+
+	if conn.ID() != "" {
+		return nil, domain.NewError(domain.ErrorCodeInvalidMessage, "hello must be sent before register")
+	}
+	if _, ok := conn.Capabilities(); ok {
+		return nil, domain.NewError(domain.ErrorCodeInvalidMessage, "hello was already sent")
+	}
+
+	version, ok := domain.NegotiateVersion(hello.Version, hello.MinVersion)
+	if !ok {
+		logger.Warn("incompatible protocol version", "version", hello.Version, "min_version", hello.MinVersion)
+		return h.reject(ctx, conn, msg, domain.NewError(domain.ErrorCodeIncompatible,
+			fmt.Sprintf("server speaks protocol versions %d to %d", domain.MinProtocolVersion, domain.ProtocolVersion)))
+	}
+
+	capabilities := domain.Capabilities{
+		Version:  version,
+		Features: domain.CommonFeatures(h.features, hello.Features),
+	}
+	conn.SetCapabilities(capabilities)
+
+	logger.Debug("protocol negotiated", "version", capabilities.Version, "features", capabilities.Features)
+
+	return domain.NewMessage(domain.MessageTypeWelcome, domain.Welcome{
+		Version:  capabilities.Version,
+		Features: capabilities.Features,
+	})
+}
+
+// reject sends err in reply to msg and closes the connection once it has
+// been written
+func (h *HelloHandler) reject(ctx context.Context, conn *transport.Connection, msg *domain.Message, err *domain.Error) (*domain.Message, error) {
+	response, marshalErr := domain.NewErrorMessage(err, msg.ID)
+	if marshalErr != nil {
+		return nil, domain.NewError(domain.ErrorCodeInternal, "failed to create error message: "+marshalErr.Error())
+	}
+	response.ReplyTo = msg.ID
+
+	data, marshalErr := json.Marshal(response)
+	if marshalErr != nil {
+		return nil, domain.NewError(domain.ErrorCodeInternal, "failed to marshal error message: "+marshalErr.Error())
+	}
+
+	if sendErr := conn.Send(ctx, data); sendErr != nil {
+		logging.FromContextOr(ctx, h.logger).Error("failed to send incompatible error", "error", sendErr)
+	}
+
+	conn.CloseWithReason(ws.CloseProtocolError, err.Message)
+	return nil, nil
+}
+
+// CanHandle implements protocol.Handler
+func (h *HelloHandler) CanHandle(messageType domain.MessageType) bool {
+	return messageType == domain.MessageTypeHello
+}
@@ -0,0 +1,170 @@
+package signal
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/HMasataka/conic/domain"
+	"github.com/HMasataka/conic/internal/transport"
+	"github.com/HMasataka/conic/metrics"
+)
+
+// maxTypeLabels limits the distinct message types labeled in the metrics.
+// Clients choose the types of forwarded messages, so further types are
+// counted as "other".
+const maxTypeLabels = 64
+
+// Metrics exposes the hub statistics and per-connection measurements in the
+// Prometheus text format
+type Metrics struct {
+	registry *metrics.Registry
+
+	typesMu sync.Mutex
+	types   map[domain.MessageType]bool
+
+	clients           *metrics.Gauge
+	rooms             *metrics.Gauge
+	messagesHeld      *metrics.Gauge
+	queueDepth        *metrics.Gauge
+	messagesSent      *metrics.Counter
+	messagesQueued    *metrics.Counter
+	forwardFailures   *metrics.Counter
+	messagesDropped   *metrics.Counter
+	slowConsumers     *metrics.Counter
+	throttled         *metrics.Counter
+	uptime            *metrics.Gauge
+	received          *metrics.Counter
+	handlerErrors     *metrics.Counter
+	handlerDuration   *metrics.Histogram
+	connections       *metrics.Gauge
+	connectionSeconds *metrics.Histogram
+	upgradesRejected  *metrics.Counter
+	replayDrops       *metrics.Counter
+}
+
+// NewMetrics creates the metrics of a signaling server built on hub
+func NewMetrics(hub domain.Hub) *Metrics {
+	registry := metrics.NewRegistry()
+
+	m := &Metrics{
+		registry: registry,
+		types:    make(map[domain.MessageType]bool),
+
+		clients:         registry.Gauge("conic_connected_clients", "Clients registered on this node."),
+		rooms:           registry.Gauge("conic_rooms", "Rooms with at least one member."),
+		messagesHeld:    registry.Gauge("conic_messages_held", "Messages waiting in the mailbox for their recipient."),
+		queueDepth:      registry.Gauge("conic_hub_queue_depth", "Messages waiting in the per-client outbound queues.", "queue"),
+		messagesSent:    registry.Counter("conic_messages_sent_total", "Messages the hub delivered to clients."),
+		messagesQueued:  registry.Counter("conic_messages_queued_total", "Messages the hub accepted, once per broadcast and once per addressed recipient."),
+		forwardFailures: registry.Counter("conic_forward_failures_total", "Messages, broadcast or addressed, that could not be queued for or sent to a client."),
+		messagesDropped: registry.Counter("conic_messages_dropped_total", "Queued messages discarded to make room for newer ones for a slow consumer."),
+		slowConsumers:   registry.Counter("conic_slow_consumers_total", "Clients evicted for not keeping up with their messages."),
+		throttled:       registry.Counter("conic_messages_throttled_total", "Messages over a rate limit.", "type"),
+		uptime:          registry.Gauge("conic_uptime_seconds", "Seconds since the hub was created."),
+
+		received:        registry.Counter("conic_messages_received_total", "Messages received from clients.", "type"),
+		handlerErrors:   registry.Counter("conic_handler_errors_total", "Messages whose handler returned an error.", "type", "code"),
+		handlerDuration: registry.Histogram("conic_handler_duration_seconds", "Time spent handling a message.", nil, "type"),
+
+		connections:       registry.Gauge("conic_open_connections", "Open websocket connections, registered or not."),
+		connectionSeconds: registry.Histogram("conic_connection_duration_seconds", "How long websocket connections stayed open.", []float64{1, 10, 60, 300, 900, 1800, 3600, 4 * 3600, 12 * 3600}),
+		upgradesRejected:  registry.Counter("conic_upgrades_rejected_total", "Websocket upgrade requests that were refused.", "reason"),
+		replayDrops:       registry.Counter("conic_resume_replay_dropped_total", "Held messages that could not be replayed to a resumed client."),
+	}
+
+	registry.OnCollect(func() {
+		m.collect(hub.GetStats())
+	})
+
+	return m
+}
+
+// collect copies a stats snapshot into the metrics
+func (m *Metrics) collect(stats domain.HubStats) {
+	m.clients.Set(float64(stats.ConnectedClients))
+	m.rooms.Set(float64(stats.Rooms))
+	m.messagesHeld.Set(float64(stats.MessagesHeld))
+	m.queueDepth.Set(float64(stats.SendQueue), "send")
+	m.messagesSent.Set(float64(stats.MessagesSent))
+	m.messagesQueued.Set(float64(stats.MessagesReceived))
+	m.forwardFailures.Set(float64(stats.ForwardFailures))
+	m.messagesDropped.Set(float64(stats.MessagesDropped))
+	m.slowConsumers.Set(float64(stats.SlowConsumers))
+	m.uptime.Set(stats.Uptime)
+
+	// Messages throttled before they were decoded have no type
+	throttled := map[string]int64{"": stats.MessagesThrottled}
+	for messageType, count := range stats.ThrottledByType {
+		throttled[""] -= count
+		throttled[m.typeLabel(messageType)] += count
+	}
+	for label, count := range throttled {
+		m.throttled.Set(float64(count), label)
+	}
+}
+
+// typeLabel returns the label value for messageType
+func (m *Metrics) typeLabel(messageType domain.MessageType) string {
+	m.typesMu.Lock()
+	defer m.typesMu.Unlock()
+
+	if !m.types[messageType] {
+		if len(m.types) >= maxTypeLabels {
+			return "other"
+		}
+		m.types[messageType] = true
+	}
+	return string(messageType)
+}
+
+// instrument sets the connection hooks that feed the per-message and
+// per-connection metrics. Hooks already set keep being called.
+func (m *Metrics) instrument(options *transport.ConnectionOptions) {
+	onReceived := options.OnReceived
+	options.OnReceived = func(messageType domain.MessageType) {
+		m.received.Inc(m.typeLabel(messageType))
+		if onReceived != nil {
+			onReceived(messageType)
+		}
+	}
+
+	onClosed := options.OnClosed
+	options.OnClosed = func(connected time.Duration) {
+		m.connections.Add(-1)
+		m.connectionSeconds.Observe(connected.Seconds())
+		if onClosed != nil {
+			onClosed(connected)
+		}
+	}
+}
+
+// handled records how long a message took to handle and the error its
+// handler returned. NewRouter feeds it through protocol.Timing.
+func (m *Metrics) handled(messageType domain.MessageType, elapsed time.Duration, err error) {
+	label := m.typeLabel(messageType)
+	m.handlerDuration.Observe(elapsed.Seconds(), label)
+	if err != nil {
+		m.handlerErrors.Inc(label, string(domain.ErrorFrom(err).Code))
+	}
+}
+
+// opened counts a new connection
+func (m *Metrics) opened() {
+	m.connections.Add(1)
+}
+
+// rejected counts a refused upgrade request
+func (m *Metrics) rejected(reason string) {
+	m.upgradesRejected.Inc(reason)
+}
+
+// replayDropped counts held messages a resumed client missed
+func (m *Metrics) replayDropped(count int) {
+	m.replayDrops.Add(float64(count))
+}
+
+// ServeHTTP serves the metrics to a Prometheus scraper
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.registry.ServeHTTP(w, r)
+}
@@ -0,0 +1,116 @@
+package signal
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+
+	ws "github.com/gorilla/websocket"
+)
+
+// originPolicy decides which browser origins may open websocket connections
+type originPolicy struct {
+	any      bool
+	patterns []originPattern
+}
+
+// originPattern matches an origin by scheme and host. An empty scheme
+// matches any scheme and a wildcard host matches every subdomain of host.
+type originPattern struct {
+	scheme   string
+	host     string
+	wildcard bool
+}
+
+func newOriginPolicy(allowed []string) (originPolicy, error) {
+	var policy originPolicy
+	for _, pattern := range allowed {
+		if pattern == "*" {
+			policy.any = true
+			continue
+		}
+		parsed, ok := parseOriginPattern(pattern)
+		if !ok {
+			return originPolicy{}, fmt.Errorf("invalid allowed origin %q: want an origin such as https://example.com or https://*.example.com", pattern)
+		}
+		policy.patterns = append(policy.patterns, parsed)
+	}
+	return policy, nil
+}
+
+// ValidOriginPattern reports whether pattern is an origin ServerOptions
+// AllowedOrigins understands
+func ValidOriginPattern(pattern string) bool {
+	if pattern == "*" {
+		return true
+	}
+	_, ok := parseOriginPattern(pattern)
+	return ok
+}
+
+func parseOriginPattern(pattern string) (originPattern, bool) {
+	var parsed originPattern
+
+	host := strings.ToLower(strings.TrimSpace(pattern))
+	if scheme, rest, ok := strings.Cut(host, "://"); ok {
+		parsed.scheme = scheme
+		host = rest
+	}
+	host = strings.TrimSuffix(host, "/")
+
+	if rest, ok := strings.CutPrefix(host, "*."); ok {
+		parsed.wildcard = true
+		host = rest
+	}
+
+	if host == "" || strings.ContainsAny(host, "*/?#@ ") {
+		return originPattern{}, false
+	}
+	parsed.host = host
+
+	return parsed, true
+}
+
+// allows reports whether r may be upgraded. Requests without an Origin
+// header do not come from browsers and are always allowed. Without
+// patterns, only the origin of the server itself is allowed.
+func (p originPolicy) allows(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || p.any {
+		return true
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	scheme := strings.ToLower(u.Scheme)
+	host := strings.ToLower(u.Host)
+
+	if len(p.patterns) == 0 {
+		return host == strings.ToLower(r.Host)
+	}
+
+	for _, pattern := range p.patterns {
+		if pattern.scheme != "" && pattern.scheme != scheme {
+			continue
+		}
+		if pattern.wildcard && strings.HasSuffix(host, "."+pattern.host) {
+			return true
+		}
+		if !pattern.wildcard && host == pattern.host {
+			return true
+		}
+	}
+
+	return false
+}
+
+// offersSubprotocol reports whether r offers one of subprotocols
+func offersSubprotocol(r *http.Request, subprotocols []string) bool {
+	return slices.ContainsFunc(ws.Subprotocols(r), func(offered string) bool {
+		return slices.Contains(subprotocols, offered)
+	})
+}
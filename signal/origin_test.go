@@ -0,0 +1,59 @@
+package signal
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNewServerRejectsInvalidOrigins(t *testing.T) {
+	for _, pattern := range []string{"", "https://", "https://*", "https://example.com/path", "https://a b.com", "user@example.com"} {
+		options := DefaultServerOptions()
+		options.AllowedOrigins = []string{"https://example.com", pattern}
+
+		if _, err := NewServer(nil, nil, options); err == nil {
+			t.Errorf("NewServer() accepted the allowed origin %q", pattern)
+		}
+	}
+}
+
+func TestOriginPolicy(t *testing.T) {
+	tests := []struct {
+		name    string
+		allowed []string
+		host    string
+		origin  string
+		want    bool
+	}{
+		{name: "no origin header", allowed: []string{"https://example.com"}, origin: "", want: true},
+		{name: "same origin by default", host: "example.com", origin: "https://example.com", want: true},
+		{name: "other origin by default", host: "example.com", origin: "https://evil.com", want: false},
+		{name: "any", allowed: []string{"*"}, origin: "https://evil.com", want: true},
+		{name: "exact", allowed: []string{"https://app.example.com"}, origin: "https://app.example.com", want: true},
+		{name: "other scheme", allowed: []string{"https://app.example.com"}, origin: "http://app.example.com", want: false},
+		{name: "any scheme", allowed: []string{"app.example.com"}, origin: "http://app.example.com", want: true},
+		{name: "port must match", allowed: []string{"https://app.example.com"}, origin: "https://app.example.com:8443", want: false},
+		{name: "subdomain", allowed: []string{"https://*.example.com"}, origin: "https://a.b.example.com", want: true},
+		{name: "wildcard excludes the domain", allowed: []string{"https://*.example.com"}, origin: "https://example.com", want: false},
+		{name: "suffix is not a subdomain", allowed: []string{"https://*.example.com"}, origin: "https://evilexample.com", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy, err := newOriginPolicy(tt.allowed)
+			if err != nil {
+				t.Fatalf("newOriginPolicy() error = %v", err)
+			}
+
+			r := httptest.NewRequest("GET", "/ws", nil)
+			if tt.host != "" {
+				r.Host = tt.host
+			}
+			if tt.origin != "" {
+				r.Header.Set("Origin", tt.origin)
+			}
+			if got := policy.allows(r); got != tt.want {
+				t.Fatalf("allows(%q) = %v, want %v", tt.origin, got, tt.want)
+			}
+		})
+	}
+}
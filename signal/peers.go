@@ -0,0 +1,61 @@
+package signal
+
+import "sync"
+
+// PeerTracker remembers which clients have signaled each other so that the
+// remaining side can be told when one of them leaves.
+type PeerTracker struct {
+	mu       sync.Mutex
+	contacts map[string]map[string]struct{}
+}
+
+// NewPeerTracker creates an empty peer tracker
+func NewPeerTracker() *PeerTracker {
+	return &PeerTracker{
+		contacts: make(map[string]map[string]struct{}),
+	}
+}
+
+// Connect records that fromID and toID have exchanged a message
+func (t *PeerTracker) Connect(fromID, toID string) {
+	if fromID == "" || toID == "" || fromID == toID {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.link(fromID, toID)
+	t.link(toID, fromID)
+}
+
+func (t *PeerTracker) link(a, b string) {
+	peers, ok := t.contacts[a]
+	if !ok {
+		peers = make(map[string]struct{})
+		t.contacts[a] = peers
+	}
+	peers[b] = struct{}{}
+}
+
+// Leave forgets clientID and returns the clients it was in contact with
+func (t *PeerTracker) Leave(clientID string) []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	peers := t.contacts[clientID]
+	delete(t.contacts, clientID)
+
+	contacts := make([]string, 0, len(peers))
+	for peerID := range peers {
+		contacts = append(contacts, peerID)
+		if reverse, ok := t.contacts[peerID]; ok {
+			delete(reverse, clientID)
+			if len(reverse) == 0 {
+				delete(t.contacts, peerID)
+			}
+		}
+	}
+
+	return contacts
+}
@@ -0,0 +1,174 @@
+package signal
+
+import (
+	"context"
+	"slices"
+	"sync"
+
+	"github.com/HMasataka/conic/domain"
+)
+
+// PolicyRequest describes a message one client wants to send to another
+type PolicyRequest struct {
+	Type domain.MessageType
+	From Identity
+	To   Identity
+}
+
+// Policy decides whether a client may send a message to another client
+type Policy interface {
+	Allow(ctx context.Context, req PolicyRequest) bool
+}
+
+// PolicyObserver is implemented by policies that keep state about the
+// messages they allowed, such as accepted invites
+type PolicyObserver interface {
+	// Forwarded is called after an allowed message reached its recipient
+	Forwarded(ctx context.Context, req PolicyRequest)
+	// Departed is called after a client unregistered
+	Departed(clientID string)
+}
+
+// AllowAllPolicy lets every registered client message every other client
+type AllowAllPolicy struct{}
+
+// Allow implements Policy
+func (AllowAllPolicy) Allow(context.Context, PolicyRequest) bool {
+	return true
+}
+
+// Relation is a relationship between the sender and recipient of a message
+type Relation string
+
+const (
+	// RelationAny holds for every pair of clients
+	RelationAny Relation = "any"
+	// RelationSameRoom holds when both clients share at least one room
+	RelationSameRoom Relation = "same_room"
+	// RelationSameTenant holds when both clients authenticated with the same
+	// non-empty tenant
+	RelationSameTenant Relation = "same_tenant"
+	// RelationInvited holds when the recipient accepted an invite from the
+	// sender, or the sender accepted one from the recipient
+	RelationInvited Relation = "invited"
+)
+
+// Rule allows or denies messages of the listed types between clients in the
+// given relation
+type Rule struct {
+	// Types lists the message types the rule applies to. Empty matches all.
+	Types    []domain.MessageType `json:"types,omitempty"`
+	Relation Relation             `json:"relation"`
+	Allow    bool                 `json:"allow"`
+}
+
+// DefaultRules allow invites to be exchanged freely and everything else
+// within a room, a tenant or an accepted invite
+func DefaultRules() []Rule {
+	return []Rule{
+		{Types: []domain.MessageType{domain.MessageTypeInvite, domain.MessageTypeInviteAccept}, Relation: RelationAny, Allow: true},
+		{Relation: RelationSameRoom, Allow: true},
+		{Relation: RelationSameTenant, Allow: true},
+		{Relation: RelationInvited, Allow: true},
+	}
+}
+
+// RulePolicy evaluates rules in order. The first rule whose types match and
+// whose relation holds decides; messages no rule matches are denied unless
+// DefaultAllow is set.
+type RulePolicy struct {
+	DefaultAllow bool
+
+	hub     domain.Hub
+	rules   []Rule
+	mu      sync.Mutex
+	invites map[string]map[string]bool // inviter -> invitee -> accepted
+}
+
+// NewRulePolicy creates a rule-based policy. The hub is consulted for room
+// membership.
+func NewRulePolicy(hub domain.Hub, rules ...Rule) *RulePolicy {
+	return &RulePolicy{
+		hub:     hub,
+		rules:   rules,
+		invites: make(map[string]map[string]bool),
+	}
+}
+
+// Allow implements Policy
+func (p *RulePolicy) Allow(ctx context.Context, req PolicyRequest) bool {
+	for _, rule := range p.rules {
+		if len(rule.Types) > 0 && !slices.Contains(rule.Types, req.Type) {
+			continue
+		}
+
+		if p.holds(rule.Relation, req) {
+			return rule.Allow
+		}
+	}
+
+	return p.DefaultAllow
+}
+
+func (p *RulePolicy) holds(relation Relation, req PolicyRequest) bool {
+	switch relation {
+	case RelationAny:
+		return true
+	case RelationSameRoom:
+		rooms := p.hub.GetClientRooms(req.To.ClientID)
+		for _, roomID := range p.hub.GetClientRooms(req.From.ClientID) {
+			if slices.Contains(rooms, roomID) {
+				return true
+			}
+		}
+		return false
+	case RelationSameTenant:
+		return req.From.Tenant != "" && req.From.Tenant == req.To.Tenant
+	case RelationInvited:
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		return p.invites[req.From.ClientID][req.To.ClientID] || p.invites[req.To.ClientID][req.From.ClientID]
+	default:
+		return false
+	}
+}
+
+// Forwarded implements PolicyObserver. Invites are recorded when they are
+// delivered and marked accepted when the invitee answers with invite_accept.
+func (p *RulePolicy) Forwarded(ctx context.Context, req PolicyRequest) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	from, to := req.From.ClientID, req.To.ClientID
+
+	switch req.Type {
+	case domain.MessageTypeInvite:
+		invitees, ok := p.invites[from]
+		if !ok {
+			invitees = make(map[string]bool)
+			p.invites[from] = invitees
+		}
+		if !invitees[to] {
+			invitees[to] = false
+		}
+	case domain.MessageTypeInviteAccept:
+		if accepted, invited := p.invites[to][from]; invited && !accepted {
+			p.invites[to][from] = true
+		}
+	}
+}
+
+// Departed implements PolicyObserver. Invites do not outlive the clients
+// that exchanged them.
+func (p *RulePolicy) Departed(clientID string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(p.invites, clientID)
+	for inviter, invitees := range p.invites {
+		delete(invitees, clientID)
+		if len(invitees) == 0 {
+			delete(p.invites, inviter)
+		}
+	}
+}
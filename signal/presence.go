@@ -0,0 +1,69 @@
+package signal
+
+import (
+	"encoding/json"
+	"slices"
+
+	"github.com/HMasataka/conic/domain"
+)
+
+// PresenceScope decides which clients see each other come and go
+type PresenceScope string
+
+const (
+	// PresenceGlobal lists every registered client and announces registering
+	// and unregistering clients to all others with peer_joined and peer_left
+	PresenceGlobal PresenceScope = "global"
+	// PresenceRoom only lists clients that share a room. Arrivals and
+	// departures are announced by the room_member_joined and room_member_left
+	// events of each room.
+	PresenceRoom PresenceScope = "room"
+)
+
+// visiblePeers returns the sorted IDs of the clients clientID can see,
+// excluding itself
+func visiblePeers(hub domain.Hub, scope PresenceScope, clientID string) []string {
+	var peers []string
+
+	switch scope {
+	case PresenceGlobal:
+		for _, client := range hub.GetClients() {
+			peers = append(peers, client.ID())
+		}
+	default:
+		for _, roomID := range hub.GetClientRooms(clientID) {
+			peers = append(peers, hub.GetRoomMembers(roomID)...)
+		}
+	}
+
+	slices.Sort(peers)
+	peers = slices.Compact(peers)
+
+	return slices.DeleteFunc(peers, func(id string) bool {
+		return id == clientID
+	})
+}
+
+// notifyPeers sends a peer event about clientID to the recipients that
+// support presence
+func notifyPeers(hub domain.Hub, messageType domain.MessageType, clientID string, recipients []string) error {
+	recipients = slices.DeleteFunc(slices.Clone(recipients), func(id string) bool {
+		client, ok := hub.GetClient(id)
+		return ok && !domain.ClientSupports(client, domain.FeaturePresence)
+	})
+	if len(recipients) == 0 {
+		return nil
+	}
+
+	msg, err := domain.NewMessage(messageType, domain.PeerEvent{ClientID: clientID})
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	return hub.SendToMultiple(recipients, data)
+}
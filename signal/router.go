@@ -1,18 +1,150 @@
 package signal
 
 import (
+	"slices"
+	"time"
+
 	"github.com/HMasataka/conic/domain"
 	"github.com/HMasataka/conic/internal/protocol"
 	"github.com/HMasataka/conic/logging"
+	"github.com/HMasataka/conic/registry"
 )
 
-func NewRouter(hub domain.Hub, logger *logging.Logger) *protocol.Router {
+type RouterOptions struct {
+	// NotifyPeerLeft sends peer_left to the clients a departing client has
+	// exchanged messages with
+	NotifyPeerLeft bool
+
+	// SenderMismatch decides how messages claiming another client's ID as
+	// their sender are handled
+	SenderMismatch SenderMismatchAction
+
+	// Authenticator verifies the token in register requests from
+	// connections that were not authenticated on upgrade. Nil disables
+	// authentication.
+	Authenticator Authenticator
+
+	// Presence decides which clients list_peers returns and who is sent
+	// peer_joined and peer_left when a client registers or unregisters
+	Presence PresenceScope
+
+	// Policy decides which clients may send addressed messages to each
+	// other. Nil allows everything.
+	Policy Policy
+
+	// ResumeGrace is how long a client whose connection dropped may resume
+	// its session with the token from its register response. Zero disables
+	// resumption.
+	ResumeGrace time.Duration
+
+	// ResumeBuffer limits the messages held for a client while it is
+	// disconnected
+	ResumeBuffer int
+
+	// ICEServers are sent to clients in their register response
+	ICEServers []domain.ICEServer
+
+	// Features are offered to clients that send hello. Nil offers every
+	// feature, except resume when ResumeGrace is zero.
+	Features []domain.Feature
+
+	// RequireHello refuses to register clients that did not send hello
+	// first, shutting out clients that predate the exchange
+	RequireHello bool
+
+	// HandlerTimeout bounds how long handling a message may take, and
+	// HandlerTimeouts overrides it per message type. Zero means no timeout.
+	HandlerTimeout  time.Duration
+	HandlerTimeouts map[domain.MessageType]time.Duration
+
+	// Validator rejects malformed payloads before they are handled. Nil
+	// uses the built-in rules with DefaultValidationOptions.
+	Validator *Validator
+
+	// Middlewares wrap every handler, inside the built-in logging, recovery,
+	// timeout and validation middlewares
+	Middlewares []registry.Middleware
+
+	// Metrics records how long messages take to handle when set
+	Metrics *Metrics
+
+	// Sessions shares a session registry with other components, such as an
+	// admin API. Nil creates one from NotifyPeerLeft, Presence and the
+	// resume options.
+	Sessions *Sessions
+}
+
+func DefaultRouterOptions() RouterOptions {
+	return RouterOptions{
+		NotifyPeerLeft: true,
+		SenderMismatch: SenderMismatchReject,
+		Presence:       PresenceGlobal,
+		ResumeBuffer:   256,
+		HandlerTimeout: 10 * time.Second,
+	}
+}
+
+func NewRouter(hub domain.Hub, logger *logging.Logger, options RouterOptions) *protocol.Router {
+	validator := options.Validator
+	if validator == nil {
+		validator = NewValidator(DefaultValidationOptions())
+	}
+
 	router := protocol.NewRouter(logger)
+	if options.Metrics != nil {
+		router.Use(protocol.Timing(options.Metrics.handled))
+	}
+	router.Use(
+		protocol.Logger(logger),
+		protocol.Recover(logger),
+		protocol.Timeout(options.HandlerTimeouts, options.HandlerTimeout),
+		validator.Middleware(),
+	)
+	router.Use(options.Middlewares...)
+
+	sessions := options.Sessions
+	if sessions == nil {
+		sessions = NewSessions(hub, logger, SessionOptions{
+			NotifyContacts: options.NotifyPeerLeft,
+			Presence:       options.Presence,
+			ResumeGrace:    options.ResumeGrace,
+			ResumeBuffer:   options.ResumeBuffer,
+		})
+	}
+
+	policy := options.Policy
+	if policy == nil {
+		policy = AllowAllPolicy{}
+	}
+	if observer, ok := policy.(PolicyObserver); ok {
+		sessions.OnDepart(observer.Departed)
+	}
+
+	features := options.Features
+	if features == nil {
+		features = slices.DeleteFunc(domain.Features(), func(feature domain.Feature) bool {
+			return feature == domain.FeatureResume && sessions.options.ResumeGrace <= 0
+		})
+	}
+
+	registerHandler := NewRegisterRequestHandler(sessions, options.Authenticator, options.ICEServers, logger)
+	registerHandler.requireHello = options.RequireHello
+
+	router.Register(domain.MessageTypeHello, NewHelloHandler(features, logger))
+	router.Register(domain.MessageTypeRegisterRequest, registerHandler)
+	router.Register(domain.MessageTypeUnregisterRequest, NewUnregisterRequestHandler(hub, sessions, logger))
+	router.Register(domain.MessageTypeListPeersRequest, NewListPeersHandler(hub, sessions, logger))
+	router.Register(domain.MessageTypeJoinRoomRequest, NewJoinRoomHandler(hub, logger))
+	router.Register(domain.MessageTypeLeaveRoomRequest, NewLeaveRoomHandler(hub, logger))
+	router.Register(domain.MessageTypeRoomMessage, NewRoomMessageHandler(hub, sessions, policy, options.SenderMismatch, logger))
 
-	router.Register(domain.MessageTypeRegisterRequest, NewRegisterRequestHandler(hub, logger))
-	router.Register(domain.MessageTypeSDP, NewSDPHandler(hub, logger))
-	router.Register(domain.MessageTypeCandidate, NewICECandidateHandler(hub, logger))
-	router.Register(domain.MessageTypeDataChannel, NewDataChannelHandler(hub, logger))
+	// Peer-to-peer messages are forwarded by their envelope routing fields, so
+	// new addressed message types need no dedicated handler.
+	forwardHandler := NewForwardHandler(hub, sessions, policy, options.SenderMismatch, logger)
+	router.Register(domain.MessageTypeSDP, forwardHandler)
+	router.Register(domain.MessageTypeCandidate, forwardHandler)
+	router.Register(domain.MessageTypeDataChannel, forwardHandler)
+	router.SetFallback(forwardHandler)
 
 	return router
 }
@@ -0,0 +1,76 @@
+package signal
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/HMasataka/conic/domain"
+	"github.com/HMasataka/conic/internal/transport"
+)
+
+// SenderMismatchAction decides what happens to a message whose claimed sender
+// differs from the client ID its connection registered as
+type SenderMismatchAction int
+
+const (
+	// SenderMismatchReject drops the message and replies with an error
+	SenderMismatchReject SenderMismatchAction = iota
+	// SenderMismatchRewrite replaces the claimed sender with the registered one
+	SenderMismatchRewrite
+)
+
+// senderID returns the client ID the connection in ctx registered as
+func senderID(ctx context.Context) (string, bool) {
+	conn, ok := transport.ConnectionFromContext(ctx)
+	if !ok {
+		return "", false
+	}
+
+	id := conn.ID()
+	return id, id != ""
+}
+
+// bindSender makes the message claim to come from sender. Claims are read
+// from the envelope and, if payloadField is set, from that payload field.
+// It reports false when a mismatched claim must be rejected.
+func bindSender(message *domain.Message, sender string, action SenderMismatchAction, payloadField string) (bool, error) {
+	var payload map[string]json.RawMessage
+	var payloadSender string
+
+	if payloadField != "" {
+		if err := json.Unmarshal(message.Data, &payload); err != nil {
+			return false, domain.NewError(domain.ErrorCodeInvalidMessage, "failed to unmarshal "+string(message.Type)+" message")
+		}
+
+		if raw, ok := payload[payloadField]; ok {
+			if err := json.Unmarshal(raw, &payloadSender); err != nil {
+				return false, domain.NewError(domain.ErrorCodeInvalidMessage, "invalid "+payloadField+" in "+string(message.Type)+" message")
+			}
+		}
+	}
+
+	envelopeMismatch := message.FromID != "" && message.FromID != sender
+	payloadMismatch := payloadSender != "" && payloadSender != sender
+
+	if (envelopeMismatch || payloadMismatch) && action == SenderMismatchReject {
+		return false, nil
+	}
+
+	message.FromID = sender
+
+	if payloadMismatch {
+		raw, err := json.Marshal(sender)
+		if err != nil {
+			return false, err
+		}
+		payload[payloadField] = raw
+
+		data, err := json.Marshal(payload)
+		if err != nil {
+			return false, err
+		}
+		message.Data = data
+	}
+
+	return true, nil
+}
@@ -1,9 +1,16 @@
 package signal
 
 import (
+	"context"
+	"encoding/json"
+	"math/rand/v2"
 	"net/http"
+	"slices"
+	"sync"
+	"time"
 
 	"github.com/HMasataka/conic"
+	"github.com/HMasataka/conic/domain"
 	"github.com/HMasataka/conic/internal/protocol"
 	"github.com/HMasataka/conic/internal/transport"
 	"github.com/HMasataka/conic/logging"
@@ -12,49 +19,297 @@ import (
 
 type ServerOptions struct {
 	transport.ConnectionOptions
+
+	// Authenticator verifies a token presented on websocket upgrade, either
+	// as a bearer Authorization header or a token query parameter. Upgrades
+	// without a token are still accepted and must authenticate on register.
+	Authenticator Authenticator
+
+	// Metrics records per-message and per-connection metrics when set
+	Metrics *Metrics
+
+	// AllowedOrigins lists the origins browsers may connect from, such as
+	// "https://example.com", or "https://*.example.com" for its subdomains.
+	// Ports other than the default must be included. A pattern without a
+	// scheme matches any scheme and "*" allows every origin. Empty allows
+	// only the origin of the server itself. Requests without an Origin
+	// header do not come from browsers and are always allowed.
+	AllowedOrigins []string
+
+	// Subprotocols are websocket subprotocols the server speaks besides
+	// those selecting the codecs in ConnectionOptions, in order of
+	// preference
+	Subprotocols []string
+
+	// RequireSubprotocol rejects upgrades that offer none of Subprotocols
+	// or the codec subprotocols
+	RequireSubprotocol bool
 }
 
 func DefaultServerOptions() ServerOptions {
+	connectionOptions := transport.DefaultConnectionOptions()
+	connectionOptions.ReplyErrors = true
+	connectionOptions.RateLimit = transport.RateLimit{Rate: 50, Burst: 100}
+	connectionOptions.ThrottleAction = transport.ThrottleError
+
 	return ServerOptions{
-		ConnectionOptions: transport.DefaultConnectionOptions(),
+		ConnectionOptions: connectionOptions,
 	}
 }
 
 type Server struct {
-	upgrader ws.Upgrader
-	router   *protocol.Router
-	logger   *logging.Logger
-	options  ServerOptions
+	upgrader     ws.Upgrader
+	origins      originPolicy
+	subprotocols []string
+	router       *protocol.Router
+	logger       *logging.Logger
+	options      ServerOptions
+
+	mu           sync.Mutex
+	connections  map[*transport.Connection]struct{}
+	wg           sync.WaitGroup
+	shuttingDown bool
 }
 
-func NewServer(router *protocol.Router, logger *logging.Logger, options ServerOptions) *Server {
+// NewServer creates a server that upgrades requests and hands their messages
+// to router. It fails when an allowed origin is not a valid pattern.
+func NewServer(router *protocol.Router, logger *logging.Logger, options ServerOptions) (*Server, error) {
+	origins, err := newOriginPolicy(options.AllowedOrigins)
+	if err != nil {
+		return nil, err
+	}
+
+	subprotocols := slices.Clone(options.Subprotocols)
+	for _, subprotocol := range transport.CodecSubprotocols(options.Codecs) {
+		if !slices.Contains(subprotocols, subprotocol) {
+			subprotocols = append(subprotocols, subprotocol)
+		}
+	}
+
 	upgrader := ws.Upgrader{
+		// Origins are checked by Handle so that rejections are logged and
+		// counted
 		CheckOrigin: func(r *http.Request) bool {
 			return true
 		},
-		ReadBufferSize:  int(options.ReadBufferSize),
-		WriteBufferSize: int(options.WriteBufferSize),
+		Subprotocols:      subprotocols,
+		ReadBufferSize:    int(options.ReadBufferSize),
+		WriteBufferSize:   int(options.WriteBufferSize),
+		EnableCompression: options.EnableCompression,
 	}
 
-	return &Server{
-		upgrader: upgrader,
-		router:   router,
-		logger:   logger,
-		options:  options,
+	if options.Metrics != nil {
+		options.Metrics.instrument(&options.ConnectionOptions)
 	}
+
+	return &Server{
+		upgrader:     upgrader,
+		origins:      origins,
+		subprotocols: subprotocols,
+		router:       router,
+		logger:       logger,
+		options:      options,
+
+		connections: make(map[*transport.Connection]struct{}),
+	}, nil
 }
 
 func (s *Server) Handle(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	if !s.origins.allows(r) {
+		s.reject(w, r, http.StatusForbidden, "origin", "origin not allowed")
+		return
+	}
+
+	if s.options.RequireSubprotocol && !offersSubprotocol(r, s.subprotocols) {
+		s.reject(w, r, http.StatusBadRequest, "subprotocol", "unsupported subprotocol", "offered", ws.Subprotocols(r))
+		return
+	}
+
+	if s.options.Authenticator != nil {
+		if token := tokenFromRequest(r); token != "" {
+			identity, err := s.options.Authenticator.Authenticate(ctx, token)
+			if err != nil {
+				s.reject(w, r, http.StatusUnauthorized, "unauthorized", "unauthorized", "error", err)
+				return
+			}
+			ctx = WithIdentity(ctx, identity)
+		}
+	}
+
+	if s.isShuttingDown() {
+		s.reject(w, r, http.StatusServiceUnavailable, "shutting_down", "server shutting down")
+		return
+	}
+
 	conn, err := s.upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		s.logger.Error("failed to upgrade connection", "error", err)
+		if s.options.Metrics != nil {
+			s.options.Metrics.rejected("handshake")
+		}
 		return
 	}
 
 	s.logger.Info("websocket connection established")
 
-	ctx := conic.WithConnection(r.Context(), conn)
-	connection := transport.NewConnection(conn, s.router, s.logger, s.options.ConnectionOptions)
+	if s.options.Metrics != nil {
+		s.options.Metrics.opened()
+	}
+
+	s.mu.Lock()
+	connectionOptions := s.options.ConnectionOptions
+	s.mu.Unlock()
+
+	connection := transport.NewConnection(conn, s.router, s.logger, connectionOptions)
+	if !s.track(connection) {
+		// Shutdown began during the upgrade
+		connection.Close()
+		return
+	}
+	defer s.untrack(connection)
+
+	ctx = conic.WithConnection(ctx, conn)
+	ctx = transport.WithConnection(ctx, connection)
 
 	connection.Start(ctx)
 }
+
+// reject refuses an upgrade request, logging and counting the reason
+func (s *Server) reject(w http.ResponseWriter, r *http.Request, status int, reason, message string, attrs ...any) {
+	attrs = append(attrs, "reason", reason, "remote_addr", r.RemoteAddr, "origin", r.Header.Get("Origin"))
+	s.logger.Warn("websocket upgrade rejected", attrs...)
+
+	if s.options.Metrics != nil {
+		s.options.Metrics.rejected(reason)
+	}
+
+	http.Error(w, message, status)
+}
+
+// SetRateLimits changes the rate limits of new and open connections
+func (s *Server) SetRateLimits(limit transport.RateLimit, typeLimits map[domain.MessageType]transport.RateLimit, action transport.ThrottleAction) {
+	s.mu.Lock()
+	s.options.RateLimit = limit
+	s.options.TypeRateLimits = typeLimits
+	s.options.ThrottleAction = action
+	connections := s.openConnections()
+	s.mu.Unlock()
+
+	for _, connection := range connections {
+		connection.SetRateLimits(limit, typeLimits, action)
+	}
+
+	s.logger.Info("rate limits updated", "rate", limit.Rate, "burst", limit.Burst, "action", action, "connections", len(connections))
+}
+
+// openConnections returns the tracked connections. s.mu must be held.
+func (s *Server) openConnections() []*transport.Connection {
+	connections := make([]*transport.Connection, 0, len(s.connections))
+	for connection := range s.connections {
+		connections = append(connections, connection)
+	}
+	return connections
+}
+
+// track records an open connection. It returns false once Shutdown has
+// begun.
+func (s *Server) track(connection *transport.Connection) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.shuttingDown {
+		return false
+	}
+
+	s.wg.Add(1)
+	s.connections[connection] = struct{}{}
+	return true
+}
+
+func (s *Server) untrack(connection *transport.Connection) {
+	s.mu.Lock()
+	delete(s.connections, connection)
+	s.mu.Unlock()
+
+	s.wg.Done()
+}
+
+func (s *Server) isShuttingDown() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.shuttingDown
+}
+
+// Shutdown stops accepting upgrades and sends every open connection a
+// server_shutdown message, followed by a going away close frame. Each
+// client is told to wait a random delay of up to reconnectWindow before
+// reconnecting. Shutdown waits for the connections to close until ctx is
+// done, then closes the remaining ones without a close handshake.
+func (s *Server) Shutdown(ctx context.Context, reason string, reconnectWindow time.Duration) error {
+	s.mu.Lock()
+	s.shuttingDown = true
+	connections := s.openConnections()
+	s.mu.Unlock()
+
+	s.logger.Info("shutting down websocket server", "connections", len(connections))
+
+	for _, connection := range connections {
+		if connection.Supports(domain.FeatureServerShutdown) {
+			s.notifyShutdown(ctx, connection, reason, reconnectWindow)
+		}
+		connection.CloseWithReason(ws.CloseGoingAway, reason)
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		s.logger.Info("all connections drained")
+		return nil
+	case <-ctx.Done():
+	}
+
+	s.mu.Lock()
+	remaining := s.openConnections()
+	s.mu.Unlock()
+
+	s.logger.Warn("closing connections that did not drain in time", "connections", len(remaining))
+
+	for _, connection := range remaining {
+		connection.Close()
+	}
+
+	return ctx.Err()
+}
+
+func (s *Server) notifyShutdown(ctx context.Context, connection *transport.Connection, reason string, reconnectWindow time.Duration) {
+	var delay time.Duration
+	if reconnectWindow > 0 {
+		delay = rand.N(reconnectWindow)
+	}
+
+	msg, err := domain.NewMessage(domain.MessageTypeServerShutdown, domain.ServerShutdown{
+		Reason:           reason,
+		ReconnectAfterMs: delay.Milliseconds(),
+	})
+	if err != nil {
+		s.logger.Error("failed to create shutdown message", "error", err)
+		return
+	}
+
+	data, err := json.Marshal(msg)
+	if err != nil {
+		s.logger.Error("failed to marshal shutdown message", "error", err)
+		return
+	}
+
+	if err := connection.Send(ctx, data); err != nil {
+		s.logger.Debug("failed to send shutdown message", "client_id", connection.ID(), "error", err)
+	}
+}
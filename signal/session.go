@@ -0,0 +1,483 @@
+package signal
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/HMasataka/conic/domain"
+	"github.com/HMasataka/conic/internal/transport"
+	"github.com/HMasataka/conic/logging"
+	ws "github.com/gorilla/websocket"
+)
+
+type SessionOptions struct {
+	// NotifyContacts sends peer_left to the clients a departing client has
+	// exchanged messages with
+	NotifyContacts bool
+
+	// Presence decides who else hears about arrivals and departures
+	Presence PresenceScope
+
+	// ResumeGrace is how long a client whose connection dropped keeps its ID
+	// for resuming. Zero unregisters clients as soon as their connection
+	// closes.
+	ResumeGrace time.Duration
+
+	// ResumeBuffer limits the messages held for a client while it is
+	// disconnected
+	ResumeBuffer int
+
+	// Metrics counts the held messages that could not be replayed when set
+	Metrics *Metrics
+}
+
+func DefaultSessionOptions() SessionOptions {
+	return SessionOptions{
+		NotifyContacts: true,
+		Presence:       PresenceGlobal,
+		ResumeBuffer:   256,
+	}
+}
+
+// Sessions binds connections to client IDs and runs the bookkeeping shared
+// by explicit unregistration and dropped connections
+type Sessions struct {
+	hub      domain.Hub
+	peers    *PeerTracker
+	logger   *logging.Logger
+	options  SessionOptions
+	mu       sync.RWMutex
+	sessions map[string]*session
+	onDepart []func(clientID string)
+}
+
+// session is a registered client. Either conn or suspended is set.
+type session struct {
+	identity    Identity
+	resumeToken string
+	conn        *transport.Connection
+	suspended   *suspendedClient
+	timer       *time.Timer
+}
+
+// NewSessions creates a session registry on top of hub
+func NewSessions(hub domain.Hub, logger *logging.Logger, options SessionOptions) *Sessions {
+	return &Sessions{
+		hub:      hub,
+		peers:    NewPeerTracker(),
+		logger:   logger,
+		options:  options,
+		sessions: make(map[string]*session),
+	}
+}
+
+// Register binds conn to identity.ClientID and registers it with the hub.
+// It returns the token for resuming the session, which is empty when
+// resumption is disabled.
+func (s *Sessions) Register(conn *transport.Connection, identity Identity) (string, error) {
+	clientID := identity.ClientID
+
+	conn.SetID(clientID)
+	if err := s.hub.Register(conn); err != nil {
+		conn.SetID("")
+		return "", err
+	}
+
+	var token string
+	if conn.Supports(domain.FeatureResume) {
+		token = s.newResumeToken()
+	}
+
+	s.mu.Lock()
+	s.sessions[clientID] = &session{
+		identity:    identity,
+		resumeToken: token,
+		conn:        conn,
+	}
+	s.mu.Unlock()
+
+	if s.options.Presence == PresenceGlobal {
+		if err := notifyPeers(s.hub, domain.MessageTypePeerJoined, clientID, visiblePeers(s.hub, s.options.Presence, clientID)); err != nil {
+			s.logger.Error("failed to announce client", "client_id", clientID, "error", err)
+		}
+	}
+
+	s.watch(conn, clientID)
+	s.enforceExpiry(conn, identity)
+
+	return token, nil
+}
+
+// Resume moves the session of clientID onto conn if token matches. ready is
+// called with a new token once conn holds the ID and before the messages held
+// while the client was away are replayed. Peers never see the client leave.
+// A connection still holding the session is closed.
+func (s *Sessions) Resume(ctx context.Context, conn *transport.Connection, clientID, token string, ready func(token string)) error {
+	s.mu.Lock()
+	sess, ok := s.sessions[clientID]
+	if !ok || sess.resumeToken == "" || subtle.ConstantTimeCompare([]byte(sess.resumeToken), []byte(token)) != 1 {
+		s.mu.Unlock()
+		return domain.NewError(domain.ErrorCodeUnauthorized, "invalid or expired resume token")
+	}
+
+	if sess.identity.Expired(time.Now()) {
+		s.mu.Unlock()
+		return domain.NewError(domain.ErrorCodeUnauthorized, "credentials expired")
+	}
+	identity := sess.identity
+
+	previous, suspended := sess.conn, sess.suspended
+	if sess.timer != nil {
+		sess.timer.Stop()
+	}
+
+	newToken := s.newResumeToken()
+	sess.resumeToken = newToken
+	sess.conn = conn
+	sess.suspended = nil
+	sess.timer = nil
+	s.mu.Unlock()
+
+	conn.SetID(clientID)
+
+	if suspended != nil {
+		dropped, err := suspended.resume(ctx, conn, func() {
+			if err := s.hub.Replace(conn); err != nil {
+				s.logger.Error("failed to replace suspended client", "client_id", clientID, "error", err)
+			}
+			ready(newToken)
+		})
+		if dropped > 0 {
+			s.logger.Warn("dropped held messages on resume", "client_id", clientID, "dropped", dropped, "error", err)
+			if s.options.Metrics != nil {
+				s.options.Metrics.replayDropped(dropped)
+			}
+		}
+	} else {
+		if err := s.hub.Replace(conn); err != nil {
+			s.logger.Error("failed to replace client", "client_id", clientID, "error", err)
+		}
+		ready(newToken)
+	}
+
+	if previous != nil {
+		// Detach the old connection so that closing it leaves the session alone
+		previous.SetID("")
+		previous.CloseWithReason(ws.CloseNormalClosure, "session resumed on another connection")
+	}
+
+	s.watch(conn, clientID)
+	s.enforceExpiry(conn, identity)
+
+	s.logger.Info("client resumed session", "client_id", clientID)
+
+	return nil
+}
+
+// watch suspends or ends the session when conn closes. The ID check skips
+// connections that unregistered, re-registered or were resumed since.
+func (s *Sessions) watch(conn *transport.Connection, clientID string) {
+	conn.OnClose(func() {
+		if conn.ID() != clientID {
+			return
+		}
+
+		if s.options.ResumeGrace > 0 {
+			s.suspend(conn, clientID)
+			return
+		}
+
+		if err := s.Unregister(clientID); err != nil {
+			s.logger.Error("failed to unregister closed client", "client_id", clientID, "error", err)
+		}
+	})
+}
+
+// enforceExpiry closes conn once the credentials it registered with expire
+func (s *Sessions) enforceExpiry(conn *transport.Connection, identity Identity) {
+	if identity.ExpiresAt.IsZero() {
+		return
+	}
+
+	timer := time.AfterFunc(time.Until(identity.ExpiresAt), func() {
+		s.logger.Info("closing client with expired credentials", "client_id", identity.ClientID)
+		conn.CloseWithReason(ws.ClosePolicyViolation, "credentials expired")
+	})
+	conn.OnClose(func() {
+		timer.Stop()
+	})
+}
+
+// suspend keeps clientID registered after conn dropped and holds the
+// messages sent to it until it resumes or the grace period ends
+func (s *Sessions) suspend(conn *transport.Connection, clientID string) {
+	placeholder := newSuspendedClient(clientID, s.options.ResumeBuffer)
+	placeholder.onClose = func() {
+		go s.expire(clientID, placeholder)
+	}
+
+	s.mu.Lock()
+	sess, ok := s.sessions[clientID]
+	if !ok || sess.conn != conn {
+		s.mu.Unlock()
+		return
+	}
+	sess.conn = nil
+	sess.suspended = placeholder
+	sess.timer = time.AfterFunc(s.options.ResumeGrace, func() {
+		s.expire(clientID, placeholder)
+	})
+	s.mu.Unlock()
+
+	if err := s.hub.Replace(placeholder); err != nil {
+		s.logger.Error("failed to suspend client", "client_id", clientID, "error", err)
+		s.expire(clientID, placeholder)
+		return
+	}
+
+	s.logger.Info("client suspended", "client_id", clientID, "grace", s.options.ResumeGrace)
+}
+
+// expire ends a suspended session that was not resumed in time
+func (s *Sessions) expire(clientID string, placeholder *suspendedClient) {
+	s.mu.Lock()
+	sess, ok := s.sessions[clientID]
+	if !ok || sess.suspended != placeholder {
+		s.mu.Unlock()
+		return
+	}
+	// Invalidate the token first so that a late resume cannot race the
+	// unregistration
+	sess.resumeToken = ""
+	s.mu.Unlock()
+
+	s.logger.Info("session expired", "client_id", clientID, "dropped_messages", placeholder.count())
+
+	if err := s.Unregister(clientID); err != nil {
+		s.logger.Error("failed to unregister expired session", "client_id", clientID, "error", err)
+	}
+}
+
+// Kick ends the session of clientID without a grace period for resuming and
+// closes its connection with reason
+func (s *Sessions) Kick(clientID, reason string) error {
+	s.mu.Lock()
+	sess, ok := s.sessions[clientID]
+	if !ok {
+		s.mu.Unlock()
+		return domain.NewError(domain.ErrorCodeNotFound, "session not found: "+clientID)
+	}
+	conn := sess.conn
+	sess.resumeToken = ""
+	s.mu.Unlock()
+
+	if conn != nil {
+		// Detach the connection so that closing it does not suspend the session
+		conn.SetID("")
+	}
+
+	if err := s.Unregister(clientID); err != nil {
+		return err
+	}
+
+	if conn != nil {
+		conn.CloseWithReason(ws.ClosePolicyViolation, reason)
+	}
+
+	s.logger.Info("client kicked", "client_id", clientID, "reason", reason)
+
+	return nil
+}
+
+// Unregister removes clientID from the hub and sends a single peer_left to
+// its contacts and, with global presence, every other client
+func (s *Sessions) Unregister(clientID string) error {
+	if err := s.hub.Unregister(clientID); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	if sess, ok := s.sessions[clientID]; ok && sess.timer != nil {
+		sess.timer.Stop()
+	}
+	delete(s.sessions, clientID)
+	onDepart := s.onDepart
+	s.mu.Unlock()
+
+	contacts := s.peers.Leave(clientID)
+
+	var recipients []string
+	if s.options.NotifyContacts {
+		recipients = append(recipients, contacts...)
+	}
+	if s.options.Presence == PresenceGlobal {
+		recipients = append(recipients, visiblePeers(s.hub, s.options.Presence, clientID)...)
+	}
+	slices.Sort(recipients)
+	recipients = slices.Compact(recipients)
+
+	if err := notifyPeers(s.hub, domain.MessageTypePeerLeft, clientID, recipients); err != nil {
+		s.logger.Error("failed to announce departure", "client_id", clientID, "error", err)
+	}
+
+	for _, fn := range onDepart {
+		fn(clientID)
+	}
+
+	return nil
+}
+
+// Identity returns the identity clientID registered with
+func (s *Sessions) Identity(clientID string) (Identity, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	sess, ok := s.sessions[clientID]
+	if !ok {
+		return Identity{}, false
+	}
+	return sess.identity, true
+}
+
+// policyIdentity returns the identity clientID registered with, or one
+// carrying only the ID for clients registered elsewhere
+func (s *Sessions) policyIdentity(clientID string) Identity {
+	if identity, ok := s.Identity(clientID); ok {
+		return identity
+	}
+	return Identity{ClientID: clientID}
+}
+
+// Presence returns the presence scope of the sessions
+func (s *Sessions) Presence() PresenceScope {
+	return s.options.Presence
+}
+
+// Peers returns the tracker of which clients have signaled each other
+func (s *Sessions) Peers() *PeerTracker {
+	return s.peers
+}
+
+// OnDepart registers a function to run after a client unregisters
+func (s *Sessions) OnDepart(fn func(clientID string)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onDepart = append(s.onDepart, fn)
+}
+
+func (s *Sessions) newResumeToken() string {
+	if s.options.ResumeGrace <= 0 {
+		return ""
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		s.logger.Error("failed to generate resume token", "error", err)
+		return ""
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// replayRetryInterval is how often a replay retries a connection whose send
+// queue is full
+const replayRetryInterval = 10 * time.Millisecond
+
+// suspendedClient stands in for a client whose connection dropped. It holds
+// the messages sent to it until the client resumes, then passes anything
+// still in flight on to the new connection.
+type suspendedClient struct {
+	id      string
+	limit   int
+	onClose func()
+	mu      sync.Mutex
+	held    [][]byte
+	resumed domain.Client
+}
+
+func newSuspendedClient(id string, limit int) *suspendedClient {
+	return &suspendedClient{
+		id:    id,
+		limit: limit,
+	}
+}
+
+func (c *suspendedClient) ID() string {
+	return c.id
+}
+
+func (c *suspendedClient) Send(ctx context.Context, message []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.resumed != nil {
+		return c.resumed.Send(ctx, message)
+	}
+
+	if c.limit > 0 && len(c.held) >= c.limit {
+		return domain.NewError(domain.ErrorCodeUnavailable, "too many messages held for disconnected client "+c.id)
+	}
+
+	c.held = append(c.held, message)
+	return nil
+}
+
+// Close ends the suspended session, for example when the hub stops
+func (c *suspendedClient) Close() error {
+	if c.onClose != nil {
+		c.onClose()
+	}
+	return nil
+}
+
+// resume runs swap, then replays the held messages to client, waiting for
+// room in its send queue until ctx is done. Sends that arrive meanwhile wait,
+// and are passed on to client once the replay is done. It returns how many
+// held messages were dropped and why.
+func (c *suspendedClient) resume(ctx context.Context, client domain.Client, swap func()) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	swap()
+
+	var dropped int
+	var err error
+	for i, message := range c.held {
+		if err = sendWhenReady(ctx, client, message); err != nil {
+			dropped = len(c.held) - i
+			break
+		}
+	}
+	c.held = nil
+	c.resumed = client
+
+	return dropped, err
+}
+
+// sendWhenReady sends message to client, retrying while its send queue is
+// full until ctx is done
+func sendWhenReady(ctx context.Context, client domain.Client, message []byte) error {
+	for {
+		err := client.Send(ctx, message)
+		if !errors.Is(err, domain.ErrClientBusy) {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(replayRetryInterval):
+		}
+	}
+}
+
+func (c *suspendedClient) count() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.held)
+}
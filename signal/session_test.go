@@ -0,0 +1,85 @@
+package signal
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/HMasataka/conic/domain"
+)
+
+// boundedClient takes up to capacity messages and reports itself busy when
+// full
+type boundedClient struct {
+	mu       sync.Mutex
+	capacity int
+	messages []string
+}
+
+func (c *boundedClient) ID() string { return "bounded" }
+
+func (c *boundedClient) Send(ctx context.Context, message []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.messages) >= c.capacity {
+		return domain.ErrClientBusy
+	}
+	c.messages = append(c.messages, string(message))
+	return nil
+}
+
+func (c *boundedClient) Close() error { return nil }
+
+func (c *boundedClient) grow(capacity int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.capacity = capacity
+}
+
+func (c *boundedClient) count() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.messages)
+}
+
+func holding(count int) *suspendedClient {
+	suspended := newSuspendedClient("bounded", 0)
+	for i := 0; i < count; i++ {
+		suspended.Send(context.Background(), []byte(strconv.Itoa(i)))
+	}
+	return suspended
+}
+
+func TestResumeWaitsForQueueSpace(t *testing.T) {
+	suspended := holding(10)
+	client := &boundedClient{capacity: 4}
+
+	time.AfterFunc(50*time.Millisecond, func() { client.grow(10) })
+
+	dropped, err := suspended.resume(context.Background(), client, func() {})
+	if dropped != 0 || err != nil {
+		t.Fatalf("resume dropped %d messages: %v", dropped, err)
+	}
+	if got := client.count(); got != 10 {
+		t.Fatalf("replayed %d messages, want 10", got)
+	}
+}
+
+func TestResumeReportsDroppedMessages(t *testing.T) {
+	suspended := holding(10)
+	client := &boundedClient{capacity: 4}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	dropped, err := suspended.resume(ctx, client, func() {})
+	if dropped != 6 {
+		t.Fatalf("dropped = %d, want 6", dropped)
+	}
+	if err == nil {
+		t.Fatal("resume reported no error for dropped messages")
+	}
+}
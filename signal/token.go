@@ -0,0 +1,107 @@
+package signal
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrInvalidToken is returned for malformed tokens or bad signatures
+	ErrInvalidToken = errors.New("invalid token")
+
+	// ErrTokenExpired is returned for tokens past their expiry
+	ErrTokenExpired = errors.New("token expired")
+)
+
+// tokenHeader is the JWT header of every token the authenticator issues
+var tokenHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+type tokenClaims struct {
+	Subject   string `json:"sub"`
+	Tenant    string `json:"tenant,omitempty"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// HMACAuthenticator issues and verifies HS256-signed JWT-style tokens that
+// carry the allowed client ID and an expiry
+type HMACAuthenticator struct {
+	secret []byte
+	now    func() time.Time
+}
+
+// NewHMACAuthenticator creates an authenticator that signs with secret
+func NewHMACAuthenticator(secret []byte) *HMACAuthenticator {
+	return &HMACAuthenticator{
+		secret: secret,
+		now:    time.Now,
+	}
+}
+
+// Issue creates a token for identity
+func (a *HMACAuthenticator) Issue(identity Identity) (string, error) {
+	if identity.ClientID == "" {
+		return "", errors.New("client ID is required")
+	}
+
+	if identity.ExpiresAt.IsZero() {
+		return "", errors.New("expiry is required")
+	}
+
+	claims, err := json.Marshal(tokenClaims{
+		Subject:   identity.ClientID,
+		Tenant:    identity.Tenant,
+		ExpiresAt: identity.ExpiresAt.Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := tokenHeader + "." + base64.RawURLEncoding.EncodeToString(claims)
+	return signingInput + "." + a.sign(signingInput), nil
+}
+
+// Authenticate implements Authenticator
+func (a *HMACAuthenticator) Authenticate(ctx context.Context, token string) (Identity, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[0] != tokenHeader {
+		return Identity{}, ErrInvalidToken
+	}
+
+	expected := a.sign(parts[0] + "." + parts[1])
+	if !hmac.Equal([]byte(parts[2]), []byte(expected)) {
+		return Identity{}, ErrInvalidToken
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return Identity{}, ErrInvalidToken
+	}
+
+	var claims tokenClaims
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.Subject == "" {
+		return Identity{}, ErrInvalidToken
+	}
+
+	expiresAt := time.Unix(claims.ExpiresAt, 0)
+	if !a.now().Before(expiresAt) {
+		return Identity{}, ErrTokenExpired
+	}
+
+	return Identity{
+		ClientID:  claims.Subject,
+		Tenant:    claims.Tenant,
+		ExpiresAt: expiresAt,
+	}, nil
+}
+
+func (a *HMACAuthenticator) sign(signingInput string) string {
+	mac := hmac.New(sha256.New, a.secret)
+	mac.Write([]byte(signingInput))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,369 @@
+package signal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/HMasataka/conic/domain"
+	"github.com/HMasataka/conic/registry"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v4"
+)
+
+type ValidationOptions struct {
+	// MaxIDLength limits client, room and message IDs
+	MaxIDLength int
+
+	// MaxTokenLength limits authentication and resume tokens
+	MaxTokenLength int
+
+	// MaxSDPSize limits session descriptions in bytes
+	MaxSDPSize int
+
+	// MaxCandidateSize limits ICE candidate lines in bytes
+	MaxCandidateSize int
+
+	// MaxPayloadSize limits data channel and room message payloads in bytes
+	MaxPayloadSize int
+
+	// MaxLabelLength limits data channel labels
+	MaxLabelLength int
+}
+
+func DefaultValidationOptions() ValidationOptions {
+	return ValidationOptions{
+		MaxIDLength:      128,
+		MaxTokenLength:   4096,
+		MaxSDPSize:       64 * 1024,
+		MaxCandidateSize: 1024,
+		MaxPayloadSize:   256 * 1024,
+		MaxLabelLength:   255,
+	}
+}
+
+// ValidateFunc checks the payload of a message, reporting each invalid field
+// to fields
+type ValidateFunc func(msg *domain.Message, fields *FieldErrors)
+
+// Validator checks incoming messages before they are handled. The envelope
+// of every message is checked, and the payload by the rule for its type.
+// Messages that fail are answered with an invalid message error listing the
+// invalid fields.
+type Validator struct {
+	options ValidationOptions
+	rules   map[domain.MessageType]ValidateFunc
+}
+
+// NewValidator creates a validator with rules for the built-in message types
+func NewValidator(options ValidationOptions) *Validator {
+	v := &Validator{
+		options: options,
+		rules:   make(map[domain.MessageType]ValidateFunc),
+	}
+
+	v.Register(domain.MessageTypeHello, v.validateHello)
+	v.Register(domain.MessageTypeRegisterRequest, v.validateRegister)
+	v.Register(domain.MessageTypeUnregisterRequest, v.validateUnregister)
+	v.Register(domain.MessageTypeListPeersRequest, v.validateListPeers)
+	v.Register(domain.MessageTypeJoinRoomRequest, v.validateRoomRequest)
+	v.Register(domain.MessageTypeLeaveRoomRequest, v.validateRoomRequest)
+	v.Register(domain.MessageTypeRoomMessage, v.validateRoomMessage)
+	v.Register(domain.MessageTypeSDP, v.validateSDP)
+	v.Register(domain.MessageTypeCandidate, v.validateCandidate)
+	v.Register(domain.MessageTypeDataChannel, v.validateDataChannel)
+
+	return v
+}
+
+// Register sets the rule for messageType, replacing any built-in one
+func (v *Validator) Register(messageType domain.MessageType, rule ValidateFunc) {
+	v.rules[messageType] = rule
+}
+
+// Validate returns an invalid message error listing the invalid fields of
+// msg, or nil when it is valid
+func (v *Validator) Validate(msg *domain.Message) error {
+	var fields FieldErrors
+
+	v.checkID(&fields, "id", msg.ID, false)
+	v.checkID(&fields, "from_id", msg.FromID, false)
+	v.checkID(&fields, "to_id", msg.ToID, false)
+	v.checkID(&fields, "reply_to", msg.ReplyTo, false)
+
+	if rule, ok := v.rules[msg.Type]; ok {
+		rule(msg, &fields)
+	}
+
+	return fields.Err(msg.Type)
+}
+
+// Middleware rejects invalid messages before they reach their handler
+func (v *Validator) Middleware() registry.Middleware {
+	return func(next registry.Handler) registry.Handler {
+		return registry.Wrap(next, func(ctx context.Context, msg *domain.Message) (*domain.Message, error) {
+			if err := v.Validate(msg); err != nil {
+				return nil, err
+			}
+			return next.Handle(ctx, msg)
+		})
+	}
+}
+
+// FieldErrors collects the invalid fields of a message
+type FieldErrors struct {
+	fields []domain.FieldError
+}
+
+// Add reports that field is invalid for reason, such as "is required"
+func (f *FieldErrors) Add(field, reason string) {
+	f.fields = append(f.fields, domain.FieldError{Field: field, Reason: reason})
+}
+
+// Addf reports that field is invalid for a formatted reason
+func (f *FieldErrors) Addf(field, format string, args ...any) {
+	f.Add(field, fmt.Sprintf(format, args...))
+}
+
+// Empty reports whether no field was reported
+func (f *FieldErrors) Empty() bool {
+	return len(f.fields) == 0
+}
+
+// Err returns an invalid message error for the reported fields, or nil when
+// there are none
+func (f *FieldErrors) Err(messageType domain.MessageType) error {
+	if f.Empty() {
+		return nil
+	}
+	return domain.NewValidationError(messageType, f.fields...)
+}
+
+// decode unmarshals the payload of msg into payload. A payload that cannot be
+// decoded is reported as an invalid data field.
+func decode(msg *domain.Message, payload any, fields *FieldErrors) bool {
+	if len(msg.Data) == 0 {
+		fields.Add("data", "is required")
+		return false
+	}
+	if err := json.Unmarshal(msg.Data, payload); err != nil {
+		fields.Add("data", "is malformed: "+err.Error())
+		return false
+	}
+	return true
+}
+
+// checkID reports an ID that is missing when required, too long, or uses
+// characters other than letters, digits and -_.:@
+func (v *Validator) checkID(fields *FieldErrors, field, id string, required bool) {
+	if id == "" {
+		if required {
+			fields.Add(field, "is required")
+		}
+		return
+	}
+
+	if len(id) > v.options.MaxIDLength {
+		fields.Addf(field, "must be at most %d characters", v.options.MaxIDLength)
+		return
+	}
+
+	for _, r := range id {
+		if !validIDRune(r) {
+			fields.Addf(field, "contains %q, only letters, digits and -_.:@ are allowed", r)
+			return
+		}
+	}
+}
+
+func validIDRune(r rune) bool {
+	switch {
+	case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		return true
+	default:
+		return strings.ContainsRune("-_.:@", r)
+	}
+}
+
+// checkSize reports a value over limit bytes
+func checkSize(fields *FieldErrors, field string, size, limit int) {
+	if size > limit {
+		fields.Addf(field, "must be at most %d bytes", limit)
+	}
+}
+
+// checkRecipient reports an addressed message without a recipient in either
+// the envelope or the legacy payload field
+func (v *Validator) checkRecipient(msg *domain.Message, fields *FieldErrors, payloadToID string) {
+	if msg.ToID == "" && payloadToID == "" {
+		fields.Add("to_id", "is required")
+		return
+	}
+	v.checkID(fields, "data.to_id", payloadToID, false)
+}
+
+func (v *Validator) validateHello(msg *domain.Message, fields *FieldErrors) {
+	var hello domain.Hello
+	if !decode(msg, &hello, fields) {
+		return
+	}
+
+	if hello.Version < 1 {
+		fields.Add("data.version", "must be at least 1")
+	}
+	if hello.MinVersion < 0 {
+		fields.Add("data.min_version", "must not be negative")
+	}
+	if len(hello.Features) > 64 {
+		fields.Add("data.features", "must list at most 64 features")
+	}
+}
+
+func (v *Validator) validateRegister(msg *domain.Message, fields *FieldErrors) {
+	var req domain.RegisterRequest
+	if !decode(msg, &req, fields) {
+		return
+	}
+
+	v.checkID(fields, "data.client_id", req.ClientID, req.ResumeToken != "")
+	checkSize(fields, "data.token", len(req.Token), v.options.MaxTokenLength)
+	checkSize(fields, "data.resume_token", len(req.ResumeToken), v.options.MaxTokenLength)
+}
+
+func (v *Validator) validateUnregister(msg *domain.Message, fields *FieldErrors) {
+	var req domain.UnregisterRequest
+	if !decode(msg, &req, fields) {
+		return
+	}
+
+	v.checkID(fields, "data.client_id", req.ClientID, false)
+}
+
+func (v *Validator) validateListPeers(msg *domain.Message, fields *FieldErrors) {
+	// list_peers_request may be sent without a payload
+	if len(msg.Data) == 0 || string(msg.Data) == "null" {
+		return
+	}
+
+	var req domain.ListPeersRequest
+	if !decode(msg, &req, fields) {
+		return
+	}
+
+	v.checkID(fields, "data.room_id", req.RoomID, false)
+}
+
+// validateRoomRequest checks join and leave requests, which share a shape
+func (v *Validator) validateRoomRequest(msg *domain.Message, fields *FieldErrors) {
+	var req domain.JoinRoomRequest
+	if !decode(msg, &req, fields) {
+		return
+	}
+
+	v.checkID(fields, "data.room_id", req.RoomID, true)
+	v.checkID(fields, "data.client_id", req.ClientID, false)
+}
+
+func (v *Validator) validateRoomMessage(msg *domain.Message, fields *FieldErrors) {
+	var roomMessage domain.RoomMessage
+	if !decode(msg, &roomMessage, fields) {
+		return
+	}
+
+	v.checkID(fields, "data.room_id", roomMessage.RoomID, true)
+	v.checkID(fields, "data.from_id", roomMessage.FromID, false)
+	checkSize(fields, "data.payload", len(roomMessage.Payload), v.options.MaxPayloadSize)
+}
+
+// sdpPayload is domain.SDPMessage with the description type kept as a
+// string, so that unknown types are reported as a field error
+type sdpPayload struct {
+	FromID             string `json:"from_id"`
+	ToID               string `json:"to_id"`
+	SessionDescription *struct {
+		Type string `json:"type"`
+		SDP  string `json:"sdp"`
+	} `json:"session_description"`
+}
+
+func (v *Validator) validateSDP(msg *domain.Message, fields *FieldErrors) {
+	var payload sdpPayload
+	if !decode(msg, &payload, fields) {
+		return
+	}
+
+	v.checkRecipient(msg, fields, payload.ToID)
+	v.checkID(fields, "data.from_id", payload.FromID, false)
+
+	description := payload.SessionDescription
+	if description == nil {
+		fields.Add("data.session_description", "is required")
+		return
+	}
+
+	sdpType := webrtc.NewSDPType(description.Type)
+	if sdpType == webrtc.SDPTypeUnknown {
+		fields.Add("data.session_description.type", "must be one of offer, answer, pranswer or rollback")
+		return
+	}
+
+	// A rollback carries no description
+	if sdpType == webrtc.SDPTypeRollback {
+		return
+	}
+
+	if description.SDP == "" {
+		fields.Add("data.session_description.sdp", "is required")
+		return
+	}
+	if len(description.SDP) > v.options.MaxSDPSize {
+		fields.Addf("data.session_description.sdp", "must be at most %d bytes", v.options.MaxSDPSize)
+		return
+	}
+
+	var parsed sdp.SessionDescription
+	if err := parsed.UnmarshalString(description.SDP); err != nil {
+		fields.Add("data.session_description.sdp", "is malformed: "+err.Error())
+		return
+	}
+	if len(parsed.MediaDescriptions) == 0 {
+		fields.Add("data.session_description.sdp", "has no media sections")
+	}
+}
+
+func (v *Validator) validateCandidate(msg *domain.Message, fields *FieldErrors) {
+	var payload domain.ICECandidateMessage
+	if !decode(msg, &payload, fields) {
+		return
+	}
+
+	v.checkRecipient(msg, fields, payload.ToID)
+	v.checkID(fields, "data.from_id", payload.FromID, false)
+
+	// An empty candidate signals the end of candidates
+	candidate := payload.Candidate.Candidate
+	if candidate == "" {
+		return
+	}
+
+	checkSize(fields, "data.candidate.candidate", len(candidate), v.options.MaxCandidateSize)
+	if !strings.HasPrefix(strings.TrimPrefix(candidate, "a="), "candidate:") {
+		fields.Add("data.candidate.candidate", "must be a candidate attribute starting with candidate:")
+	}
+	if mid := payload.Candidate.SDPMid; mid != nil {
+		checkSize(fields, "data.candidate.sdpMid", len(*mid), v.options.MaxIDLength)
+	}
+}
+
+func (v *Validator) validateDataChannel(msg *domain.Message, fields *FieldErrors) {
+	var payload domain.DataChannelMessage
+	if !decode(msg, &payload, fields) {
+		return
+	}
+
+	v.checkRecipient(msg, fields, payload.ToID)
+	v.checkID(fields, "data.from_id", payload.FromID, false)
+	checkSize(fields, "data.label", len(payload.Label), v.options.MaxLabelLength)
+	checkSize(fields, "data.payload", len(payload.Payload), v.options.MaxPayloadSize)
+}
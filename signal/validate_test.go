@@ -0,0 +1,186 @@
+package signal
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/HMasataka/conic/domain"
+)
+
+// testSDP is a minimal session description with one media section
+const testSDP = "v=0\r\no=- 0 0 IN IP4 127.0.0.1\r\ns=-\r\nt=0 0\r\n" +
+	"m=audio 9 UDP/TLS/RTP/SAVPF 111\r\nc=IN IP4 0.0.0.0\r\na=rtpmap:111 opus/48000/2\r\n"
+
+// sdpData is the payload of an sdp message with the given description
+func sdpData(sdpType, description string) string {
+	data, _ := json.Marshal(map[string]any{
+		"session_description": map[string]string{"type": sdpType, "sdp": description},
+	})
+	return string(data)
+}
+
+func TestValidator(t *testing.T) {
+	field := func(name, reason string) domain.FieldError {
+		return domain.FieldError{Field: name, Reason: reason}
+	}
+	maxSDP := DefaultValidationOptions().MaxSDPSize
+
+	tests := []struct {
+		name string
+		msg  domain.Message
+		want []domain.FieldError
+	}{
+		{
+			name: "offer",
+			msg:  domain.Message{Type: domain.MessageTypeSDP, ToID: "bob", Data: json.RawMessage(sdpData("offer", testSDP))},
+		},
+		{
+			name: "rollback with no SDP",
+			msg:  domain.Message{Type: domain.MessageTypeSDP, ToID: "bob", Data: json.RawMessage(sdpData("rollback", ""))},
+		},
+		{
+			name: "offer with no SDP",
+			msg:  domain.Message{Type: domain.MessageTypeSDP, ToID: "bob", Data: json.RawMessage(sdpData("offer", ""))},
+			want: []domain.FieldError{field("data.session_description.sdp", "is required")},
+		},
+		{
+			name: "unknown SDP type",
+			msg:  domain.Message{Type: domain.MessageTypeSDP, ToID: "bob", Data: json.RawMessage(sdpData("bogus", testSDP))},
+			want: []domain.FieldError{field("data.session_description.type", "must be one of offer, answer, pranswer or rollback")},
+		},
+		{
+			name: "SDP without media",
+			msg:  domain.Message{Type: domain.MessageTypeSDP, ToID: "bob", Data: json.RawMessage(sdpData("answer", "v=0\r\no=- 0 0 IN IP4 127.0.0.1\r\ns=-\r\nt=0 0\r\n"))},
+			want: []domain.FieldError{field("data.session_description.sdp", "has no media sections")},
+		},
+		{
+			name: "oversized SDP",
+			msg:  domain.Message{Type: domain.MessageTypeSDP, ToID: "bob", Data: json.RawMessage(sdpData("offer", testSDP+strings.Repeat("a=x\r\n", maxSDP/5)))},
+			want: []domain.FieldError{field("data.session_description.sdp", "must be at most 65536 bytes")},
+		},
+		{
+			name: "no session description",
+			msg:  domain.Message{Type: domain.MessageTypeSDP, ToID: "bob", Data: json.RawMessage(`{}`)},
+			want: []domain.FieldError{field("data.session_description", "is required")},
+		},
+		{
+			name: "no recipient",
+			msg:  domain.Message{Type: domain.MessageTypeSDP, Data: json.RawMessage(sdpData("offer", testSDP))},
+			want: []domain.FieldError{field("to_id", "is required")},
+		},
+		{
+			name: "legacy data.to_id recipient",
+			msg:  domain.Message{Type: domain.MessageTypeSDP, Data: json.RawMessage(`{"to_id":"bob",` + sdpData("offer", testSDP)[1:])},
+		},
+		{
+			name: "invalid legacy data.to_id",
+			msg:  domain.Message{Type: domain.MessageTypeCandidate, Data: json.RawMessage(`{"to_id":"bob smith","candidate":{"candidate":""}}`)},
+			want: []domain.FieldError{field("data.to_id", `contains ' ', only letters, digits and -_.:@ are allowed`)},
+		},
+		{
+			name: "candidate",
+			msg:  domain.Message{Type: domain.MessageTypeCandidate, ToID: "bob", Data: json.RawMessage(`{"candidate":{"candidate":"candidate:1 1 udp 2130706431 10.0.0.1 5000 typ host","sdpMid":"0"}}`)},
+		},
+		{
+			name: "a=-prefixed candidate",
+			msg:  domain.Message{Type: domain.MessageTypeCandidate, ToID: "bob", Data: json.RawMessage(`{"candidate":{"candidate":"a=candidate:1 1 udp 2130706431 10.0.0.1 5000 typ host"}}`)},
+		},
+		{
+			name: "end of candidates",
+			msg:  domain.Message{Type: domain.MessageTypeCandidate, ToID: "bob", Data: json.RawMessage(`{"candidate":{"candidate":""}}`)},
+		},
+		{
+			name: "not a candidate",
+			msg:  domain.Message{Type: domain.MessageTypeCandidate, ToID: "bob", Data: json.RawMessage(`{"candidate":{"candidate":"a=mid:0"}}`)},
+			want: []domain.FieldError{field("data.candidate.candidate", "must be a candidate attribute starting with candidate:")},
+		},
+		{
+			name: "null list_peers data",
+			msg:  domain.Message{Type: domain.MessageTypeListPeersRequest, Data: json.RawMessage(`null`)},
+		},
+		{
+			name: "list_peers without data",
+			msg:  domain.Message{Type: domain.MessageTypeListPeersRequest},
+		},
+		{
+			name: "list_peers with an invalid room",
+			msg:  domain.Message{Type: domain.MessageTypeListPeersRequest, Data: json.RawMessage(`{"room_id":"room/1"}`)},
+			want: []domain.FieldError{field("data.room_id", `contains '/', only letters, digits and -_.:@ are allowed`)},
+		},
+		{
+			name: "register without data",
+			msg:  domain.Message{Type: domain.MessageTypeRegisterRequest},
+			want: []domain.FieldError{field("data", "is required")},
+		},
+		{
+			name: "resume without client ID",
+			msg:  domain.Message{Type: domain.MessageTypeRegisterRequest, Data: json.RawMessage(`{"resume_token":"t"}`)},
+			want: []domain.FieldError{field("data.client_id", "is required")},
+		},
+		{
+			name: "join without room",
+			msg:  domain.Message{Type: domain.MessageTypeJoinRoomRequest, Data: json.RawMessage(`{}`)},
+			want: []domain.FieldError{field("data.room_id", "is required")},
+		},
+		{
+			name: "hello without version",
+			msg:  domain.Message{Type: domain.MessageTypeHello, Data: json.RawMessage(`{"min_version":-1}`)},
+			want: []domain.FieldError{
+				field("data.version", "must be at least 1"),
+				field("data.min_version", "must not be negative"),
+			},
+		},
+		{
+			name: "invalid envelope",
+			msg: domain.Message{
+				ID:   strings.Repeat("x", 129),
+				Type: domain.MessageTypeDataChannel, FromID: "a!", ToID: "bob",
+				Data: json.RawMessage(`{"label":"chat","payload":"AAE="}`),
+			},
+			want: []domain.FieldError{
+				field("id", "must be at most 128 characters"),
+				field("from_id", `contains '!', only letters, digits and -_.:@ are allowed`),
+			},
+		},
+		{
+			name: "type without a rule",
+			msg:  domain.Message{Type: "custom", Data: json.RawMessage(`"anything"`)},
+		},
+	}
+
+	validator := NewValidator(DefaultValidationOptions())
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validator.Validate(&tt.msg)
+			if tt.want == nil {
+				if err != nil {
+					t.Fatalf("Validate() error = %v", err)
+				}
+				return
+			}
+
+			got := domain.ErrorFrom(err)
+			if got.Code != domain.ErrorCodeInvalidMessage {
+				t.Fatalf("Validate() error = %v, want an invalid message error", err)
+			}
+			if !reflect.DeepEqual(got.Fields, tt.want) {
+				t.Fatalf("Validate() fields = %v, want %v", got.Fields, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidatorRegister(t *testing.T) {
+	validator := NewValidator(DefaultValidationOptions())
+	validator.Register("custom", func(msg *domain.Message, fields *FieldErrors) {
+		fields.Addf("data", "must not be %s", msg.Data)
+	})
+
+	err := validator.Validate(&domain.Message{Type: "custom", Data: json.RawMessage(`1`)})
+	want := []domain.FieldError{{Field: "data", Reason: "must not be 1"}}
+	if got := domain.ErrorFrom(err).Fields; !reflect.DeepEqual(got, want) {
+		t.Fatalf("Validate() fields = %v, want %v", got, want)
+	}
+}